@@ -43,6 +43,10 @@ var TargetICCProfileIIIF = getEnv("TARGET_ICC_PROFILE_IIIF")
 // for generation of downloadable TIFFs
 var TargetICCProfileTIFF = getEnv("TARGET_ICC_PROFILE_TIFF")
 
+// DefaultCMYKICCProfile is the path to the ICC profile, e.g. a SWOP or
+// FOGRA one, assumed for CMYK images that do not embed a CMYK profile
+var DefaultCMYKICCProfile = getEnv("DEFAULT_CMYK_ICC_PROFILE")
+
 /**************************
  * END Command-line paths *
  **************************/
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+
+	"github.com/gigamorph/go-pyramid/pyramid/agent"
+	"github.com/gigamorph/go-pyramid/pyramid/batch"
+	"github.com/gigamorph/go-pyramid/pyramid/input"
+)
+
+// runBatch converts every image of a directory tree or of a manifest
+// (CSV or JSON lines) and returns the exit code: non-zero if any failed.
+func runBatch(args []string) int {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	params := paramsFlags(fs)
+	workersPtr := fs.Int("w", runtime.NumCPU(), "number of concurrent conversions")
+	outDirPtr := fs.String("o", "", "output directory, required when converting a directory tree")
+	logPtr := fs.String("log", "", "file to write the per-file results to as JSON lines (default stdout)")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		log.Printf("usage: pyramid batch [options] <dir|manifest>")
+		return 2
+	}
+	src := fs.Arg(0)
+
+	jobs, err := loadJobs(src, *outDirPtr, params())
+	if err != nil {
+		log.Printf("ERROR main batch failed to load jobs - %v", err)
+		return 2
+	}
+
+	var resultLog io.Writer = os.Stdout
+	if *logPtr != "" {
+		f, err := os.Create(*logPtr)
+		if err != nil {
+			log.Printf("ERROR main batch failed to create result log - %v", err)
+			return 2
+		}
+		defer f.Close()
+		resultLog = f
+	}
+
+	runner := batch.Runner{
+		Converter: agent.New(),
+		Workers:   *workersPtr,
+		Log:       resultLog,
+	}
+	summary, err := runner.Run(jobs)
+	log.Printf("batch done: %d total, %d succeeded, %d failed\n", summary.Total, summary.Succeeded, summary.Failed)
+	if err != nil {
+		log.Printf("ERROR main batch - %v", err)
+		return 1
+	}
+	if summary.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func loadJobs(src, outDir string, defaults input.Params) ([]input.Params, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		if outDir == "" {
+			return nil, fmt.Errorf("-o is required when converting a directory tree")
+		}
+		return batch.FromDir(src, outDir, defaults, nil)
+	}
+	return batch.FromManifest(src, defaults)
+}
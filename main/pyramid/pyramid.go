@@ -1,46 +1,145 @@
 // Usage:
-// go run pyramid.go [options] <infile> <outfile>
-// options: -m, -c, -q, -p, -t (see main function below)
+// go run pyramid.go [convert] [options] <infile> <outfile>
+// go run pyramid.go batch [options] [batch options] <dir|manifest>
+// go run pyramid.go serve [options] [serve options]
+// go run pyramid.go verify [verify options] <file>...
+// options: -m, -c, -q, -p, -t, -b, -bigtiff, -tilew, -tileh, -minsize, -maxlevels
+// batch options: -w, -o, -log
+// serve options: -addr, -dir, -w, -queue
+// verify options: -tilew, -tileh, -c, -predictor, -width, -height
+// (see paramsFlags, runBatch, runServe and runVerify)
 package main
 
 import (
 	"flag"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/gigamorph/go-pyramid/pyramid/agent"
 	"github.com/gigamorph/go-pyramid/pyramid/input"
 )
 
 func main() {
-	maxSizePtr := flag.Uint("m", 0, "max size")
-	compressionPtr := flag.String("c", "", "compression method")
-	qualityPtr := flag.Int("q", 90, "jpeg quality (1-100)")
-	targetProfilePtr := flag.String("p", "test/resources/sRGBProfile.icc", "ICC profile of target file")
-	tempDirPtr := flag.String("t", "/tmp/go-pyramid", "path to temp dir")
-	flag.Parse()
-
-	args := flag.Args()
-
-	inFile := args[0]
-	outFile := args[1]
-
-	log.Printf("BEGIN processing image file %s\n", inFile)
-	log.Printf("maxSize: %d\n", *maxSizePtr)
-
-	params := input.Params{
-		InFile:           inFile,
-		OutFile:          outFile,
-		MaxSize:          *maxSizePtr,
-		Compression:      *compressionPtr,
-		Quality:          *qualityPtr,
-		TargetICCProfile: *targetProfilePtr,
-		TempDir:          *tempDirPtr,
+	args := os.Args[1:]
+	cmd := "convert"
+	if len(args) > 0 {
+		switch args[0] {
+		case "convert", "batch", "serve", "verify":
+			cmd, args = args[0], args[1:]
+		}
 	}
 
+	switch cmd {
+	case "batch":
+		os.Exit(runBatch(args))
+	case "serve":
+		os.Exit(runServe(args))
+	case "verify":
+		os.Exit(runVerify(args))
+	default:
+		runConvert(args)
+	}
+}
+
+// paramsFlags defines the conversion options on fs. The returned function
+// builds input.Params from them once fs has been parsed.
+func paramsFlags(fs *flag.FlagSet) func() input.Params {
+	maxSizePtr := fs.Uint("m", 0, "max size")
+	compressionPtr := fs.String("c", "", "compression codec (jpeg, deflate, lzw, zstd, webp, none)")
+	qualityPtr := fs.Int("q", 90, "jpeg and webp quality (1-100)")
+	levelPtr := fs.Int("level", 0, "deflate (1-9) or zstd (1-22) level (0: codec default)")
+	predictorPtr := fs.String("predictor", "", "predictor for deflate, lzw and zstd (none, horizontal)")
+	targetProfilePtr := fs.String("p", "test/resources/sRGBProfile.icc", "ICC profile of target file")
+	tempDirPtr := fs.String("t", "/tmp/go-pyramid", "path to temp dir")
+	builderPtr := fs.String("b", "tiffcp", "pyramid builder (tiffcp, native)")
+	bigTIFFPtr := fs.String("bigtiff", "auto", "write BigTIFF (auto, always, never)")
+	tileWidthPtr := fs.Uint("tilew", 256, "tile width")
+	tileHeightPtr := fs.Uint("tileh", 256, "tile height")
+	minLevelSizePtr := fs.Uint("minsize", 128, "minimum long edge of the smallest level")
+	maxLevelsPtr := fs.Uint("maxlevels", 0, "maximum number of levels (0: no limit)")
+	kernelPtr := fs.String("kernel", "", "resampling kernel (nearest, linear, cubic, lanczos3)")
+	linearPtr := fs.Bool("linear", false, "resample in linear light")
+	levelSourcePtr := fs.String("levelsource", "previous", "make each level from the previous one or the full image (previous, full)")
+	sharpenPtr := fs.Float64("sharpen", 0, "sigma of the sharpening after resizing (0: none)")
+	highBitDepthPtr := fs.String("highbitdepth", "", "input of more than 8 bits per sample (keep, reduce, fail; default keep, reduce for tiles)")
+	ditherPtr := fs.Bool("dither", false, "dither when reducing to 8 bits")
+	losslessPtr := fs.String("lossless", "deflate", "compression of levels of more than 8 bits (deflate, lzw, zstd)")
+	formatPtr := fs.String("format", "tiff", "output format (tiff, iiif, dzi, zoomify)")
+	iiifIDPtr := fs.String("iiifid", "", "URI of the IIIF image service, required with -format iiif")
+	iiifVersionPtr := fs.String("iiifversion", "3", "IIIF Image API version (3, 2)")
+	overlapPtr := fs.Uint("overlap", 1, "pixels shared by adjacent DZI tiles")
+	tileFormatPtr := fs.String("tileformat", "jpg", "format of the DZI tiles (jpg, png)")
+	metadataPtr := fs.String("metadata", "drop", "metadata of the input to copy into the pyramid (drop, allowlist, all)")
+	metadataTagsPtr := fs.String("metadatatags", "", "comma-separated exiftool tag names copied with -metadata allowlist")
+
+	return func() input.Params {
+		return input.Params{
+			MaxSize:          *maxSizePtr,
+			Compression:      *compressionPtr,
+			Quality:          *qualityPtr,
+			CompressionLevel: *levelPtr,
+			Predictor:        *predictorPtr,
+			TargetICCProfile: *targetProfilePtr,
+			TempDir:          *tempDirPtr,
+			PyramidBuilder:   *builderPtr,
+			BigTIFF:          *bigTIFFPtr,
+			TileWidth:        *tileWidthPtr,
+			TileHeight:       *tileHeightPtr,
+			MinLevelSize:     *minLevelSizePtr,
+			MaxLevels:        *maxLevelsPtr,
+
+			Kernel:      *kernelPtr,
+			LinearLight: *linearPtr,
+			LevelSource: *levelSourcePtr,
+			Sharpen:     *sharpenPtr,
+
+			HighBitDepth:        *highBitDepthPtr,
+			Dither:              *ditherPtr,
+			LosslessCompression: *losslessPtr,
+
+			OutputFormat: *formatPtr,
+			IIIFID:       *iiifIDPtr,
+			IIIFVersion:  *iiifVersionPtr,
+			TileOverlap:  *overlapPtr,
+			TileFormat:   *tileFormatPtr,
+
+			Metadata:     *metadataPtr,
+			MetadataTags: splitList(*metadataTagsPtr),
+		}
+	}
+}
+
+func runConvert(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	params := paramsFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		log.Fatalf("usage: pyramid [convert] [options] <infile> <outfile>")
+	}
+	p := params()
+	p.InFile = fs.Arg(0)
+	p.OutFile = fs.Arg(1)
+
+	log.Printf("BEGIN processing image file %s\n", p.InFile)
+	log.Printf("maxSize: %d\n", p.MaxSize)
+
 	ag := agent.New()
 
-	_, err := ag.Convert(params)
+	_, err := ag.Convert(p)
 	if err != nil {
 		log.Printf("ERROR main agent.Convert failed - %v", err)
 	}
 }
+
+// splitList splits the comma-separated list s, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
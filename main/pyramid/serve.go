@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"runtime"
+
+	"github.com/gigamorph/go-pyramid/pyramid/agent"
+	"github.com/gigamorph/go-pyramid/pyramid/server"
+)
+
+// runServe runs the JSON HTTP API of package server until it fails.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	params := paramsFlags(fs)
+	addrPtr := fs.String("addr", ":8080", "address to listen on")
+	dirPtr := fs.String("dir", "/tmp/go-pyramid-server", "directory for uploads and pyramids")
+	workersPtr := fs.Int("w", runtime.NumCPU(), "number of concurrent conversions")
+	queuePtr := fs.Int("queue", 100, "number of jobs that may wait for a worker")
+	retentionPtr := fs.Duration("retention", 0, "how long finished jobs and their pyramids are kept (0: until deleted)")
+	fs.Parse(args)
+
+	srv, err := server.New(agent.New(), server.Config{
+		Dir:       *dirPtr,
+		Workers:   *workersPtr,
+		QueueSize: *queuePtr,
+		Retention: *retentionPtr,
+		Defaults:  params(),
+	})
+	if err != nil {
+		log.Printf("ERROR main serve failed to start - %v", err)
+		return 2
+	}
+	defer srv.Close()
+
+	log.Printf("listening on %s\n", *addrPtr)
+	if err := http.ListenAndServe(*addrPtr, srv); err != nil {
+		log.Printf("ERROR main serve - %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gigamorph/go-pyramid/pyramid/compression"
+	"github.com/gigamorph/go-pyramid/pyramid/verify"
+)
+
+// runVerify checks pyramidal TIFF files, writes a JSON report per file to
+// stdout, one per line, and returns the exit code: 1 if any file has a
+// violation, 2 if any cannot be read.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	tileWidthPtr := fs.Int("tilew", 256, "expected tile width (0: not checked)")
+	tileHeightPtr := fs.Int("tileh", 256, "expected tile height (0: not checked)")
+	compressionPtr := fs.String("c", "", "expected compression codec (jpeg, deflate, lzw, zstd, webp, none; default not checked)")
+	predictorPtr := fs.String("predictor", "", "expected predictor for deflate, lzw and zstd (none, horizontal)")
+	widthPtr := fs.Int("width", 0, "expected width of the top level (0: not checked)")
+	heightPtr := fs.Int("height", 0, "expected height of the top level (0: not checked)")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		log.Printf("usage: pyramid verify [verify options] <file>...")
+		return 2
+	}
+	if err := checkCompressionFlags(*compressionPtr, *predictorPtr); err != nil {
+		log.Printf("usage: pyramid verify - %v", err)
+		fs.Usage()
+		return 2
+	}
+	want := verify.Expected{
+		TileWidth:   *tileWidthPtr,
+		TileHeight:  *tileHeightPtr,
+		Compression: compression.Option{Codec: compression.Codec(*compressionPtr), Predictor: compression.Predictor(*predictorPtr)},
+		Width:       *widthPtr,
+		Height:      *heightPtr,
+	}
+
+	code := 0
+	enc := json.NewEncoder(os.Stdout)
+	for _, file := range fs.Args() {
+		report, err := verify.Verify(file, want)
+		if err != nil {
+			log.Printf("ERROR main verify - %v", err)
+			report = verify.ErrorReport(file, err)
+			code = 2
+		}
+		if err := enc.Encode(report); err != nil {
+			log.Printf("ERROR main verify failed to write report - %v", err)
+			return 2
+		}
+		if !report.OK() && code == 0 {
+			code = 1
+		}
+	}
+	return code
+}
+
+// checkCompressionFlags checks the -c and -predictor flags, "" meaning not
+// checked.
+func checkCompressionFlags(codec, predictor string) error {
+	switch c := compression.Codec(codec); c {
+	case "", compression.None, compression.JPEG, compression.Deflate, compression.LZW, compression.ZSTD, compression.WebP:
+	default:
+		return fmt.Errorf("unknown codec %q", c)
+	}
+	switch p := compression.Predictor(predictor); p {
+	case "":
+	case compression.PredictorNone, compression.PredictorHorizontal:
+		switch compression.Codec(codec) {
+		case compression.Deflate, compression.LZW, compression.ZSTD:
+		default:
+			return fmt.Errorf("-predictor %s needs -c deflate, lzw or zstd", p)
+		}
+	default:
+		return fmt.Errorf("unknown predictor %q", p)
+	}
+	return nil
+}
@@ -1,21 +1,26 @@
 package agent
 
 import (
+	gocontext "context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gigamorph/go-pyramid/config"
+	"github.com/gigamorph/go-pyramid/pyramid/backend"
+	"github.com/gigamorph/go-pyramid/pyramid/compression"
 	"github.com/gigamorph/go-pyramid/pyramid/context"
+	"github.com/gigamorph/go-pyramid/pyramid/icc"
 	"github.com/gigamorph/go-pyramid/pyramid/input"
 	"github.com/gigamorph/go-pyramid/pyramid/output"
-	"github.com/gigamorph/go-pyramid/shellcmds/combined"
-	im "github.com/gigamorph/go-pyramid/shellcmds/imagemagick"
-	"github.com/gigamorph/go-pyramid/shellcmds/tiff"
-	"github.com/gigamorph/go-pyramid/shellcmds/vips"
+	"github.com/gigamorph/go-pyramid/pyramid/progress"
+	"github.com/gigamorph/go-pyramid/pyramid/ptiff"
+	"github.com/gigamorph/go-pyramid/pyramid/tiles"
+	"github.com/gigamorph/go-pyramid/pyramid/verify"
+	"github.com/gigamorph/go-pyramid/shellcmds/exiftool"
 )
 
 func getFirstWord(s string) string {
@@ -30,131 +35,234 @@ func getFirstWord(s string) string {
 // Agent is a wrapper around tools and operations used to convert
 // images to pyramidal TIFF.
 //
-// There should be only one instance of Agent running at any time.
 // A typical usage is:
 //
-// agent := NewAgent()
-// agent.Initialize()
-// defer agent.Finalize()
-// agent.Convert(params) // params is of convert.Params type
+// agent := agent.New()
+// agent.Convert(params) // params is of input.Params type
+//
+// An Agent is safe for concurrent use: Convert may be called from many
+// goroutines at once, with any combination of input files and temp dirs.
+// Each call keeps its intermediate files in a directory of its own under
+// TempDir, and DeleteTemp removes only that directory.
+//
+// The image operations are delegated to a backend.Backend, which defaults
+// to the shell programs configured in package config. Backends passed to
+// NewWithBackend must be safe for concurrent use as well.
 type Agent struct {
+	backend backend.Backend
 }
 
-// New returns a new instance of Agent.
+// New returns a new instance of Agent that uses the shell backend.
 func New() *Agent {
-	agent := Agent{}
+	return NewWithBackend(backend.NewShell())
+}
+
+// NewWithBackend returns a new instance of Agent that performs
+// image operations with b.
+func NewWithBackend(b backend.Backend) *Agent {
+	agent := Agent{backend: b}
 	return &agent
 }
 
 // Convert is the public method to call to actually convert an image.
 // p contains input, output, and other information needed for conversion.
+//
+// Errors can be told apart with errors.Is and errors.As: see
+// ErrInvalidParams, ErrUnsupportedImage, ErrNoSpace, ErrCorruptInput and
+// StageError.
 func (a *Agent) Convert(p input.Params) (*output.Params, error) {
-	c := context.New(p)
-	a.mkdirp(c.Input.TempDir)
+	return a.ConvertContext(gocontext.Background(), p)
+}
 
+// ConvertContext is like Convert but gives up when ctx is done: the running
+// tool is killed along with any process it started, the temp files of the
+// conversion and the incomplete output file are removed, and the returned
+// error wraps ctx.Err(), so that errors.Is(err, context.Canceled) or
+// errors.Is(err, context.DeadlineExceeded) tells why.
+func (a *Agent) ConvertContext(ctx gocontext.Context, p input.Params) (*output.Params, error) {
+	c := context.New(p)
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("pyramid.agent.Agent#Convert %w - %v", ErrInvalidParams, err)
+	}
+	if err := a.mkdirp(c.Input.TempDir); err != nil {
+		return nil, err
+	}
 	if c.Input.IMTempDir != nil {
-		a.mkdirp(*c.Input.IMTempDir)
+		if err := a.mkdirp(*c.Input.IMTempDir); err != nil {
+			return nil, err
+		}
 	}
-
-	err := a.toPyramidTIFF(c)
-	if err != nil {
-		return nil, fmt.Errorf("pyramid.agent.Agent#Convert failed to create pyramid - %v", err)
+	if err := c.MakeWorkDir(); err != nil {
+		return nil, fmt.Errorf("pyramid.agent.Agent#Convert - %w", err)
 	}
-	if p.DeleteTemp {
-		err = os.RemoveAll(c.Input.TempDir)
-		if err != nil {
-			log.Printf("ERROR pyramid.agent.Agent#Convert failed to delete temp dir %s - %v\n", c.Input.TempDir, err)
+	defer func() {
+		if !p.DeleteTemp && ctx.Err() == nil {
+			return
+		}
+		if err := c.RemoveWorkDir(); err != nil {
+			log.Printf("ERROR pyramid.agent.Agent#Convert failed to delete work dir %s - %v\n", c.WorkDir, err)
 		}
+	}()
+
+	err := a.toPyramidTIFF(ctx, c)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		if err := os.Remove(p.OutFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("ERROR pyramid.agent.Agent#Convert failed to delete %s - %v\n", p.OutFile, err)
+		}
+		if !errors.Is(err, ctxErr) {
+			err = ctxErr
+		}
+		return nil, fmt.Errorf("pyramid.agent.Agent#Convert gave up on %s - %w", p.InFile, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pyramid.agent.Agent#Convert failed to create pyramid - %w", err)
 	}
 	return &c.Output, nil
 }
 
-func (a *Agent) toPyramidTIFF(c *context.Context) (err error) {
+func (a *Agent) toPyramidTIFF(ctx gocontext.Context, c *context.Context) (err error) {
 	targetICCProfile := config.TargetICCProfileIIIF
 	if c.Input.TargetICCProfile != "" {
 		targetICCProfile = c.Input.TargetICCProfile
 	}
 
 	// Make sure input is a single file TIFF
-	if err = vips.ToTiff(fmt.Sprintf("%s[0]", c.Input.InFile), c.TiffFile); err != nil {
-		return fmt.Errorf("pyramid.agent.Agent#ToPyramidTIFF failed to convert %s to TIFF - %v", c.Input.InFile, err)
+	err = a.runStage(c, stageEvent(progress.StageToTIFF, c.TiffFile, c.Input.InFile), func() error {
+		return a.backend.ToTIFF(ctx, c.Input.InFile, c.TiffFile)
+	})
+	if err != nil {
+		return fmt.Errorf("pyramid.agent.Agent#ToPyramidTIFF failed to convert %s to TIFF - %w", c.Input.InFile, err)
 	}
 
 	tiff := c.TiffFile
 
-	c.Width, err = vips.Width(c.TiffFile)
-	if err != nil {
-		return fmt.Errorf("pyramid.agent.Agent#ToPyramidTIFF failed to get width - %v", err)
-	}
-	c.Height, err = vips.Height(c.TiffFile)
+	var info *backend.ImageInfo
+	err = a.runStage(c, stageEvent(progress.StageProbe, "", tiff), func() (err error) {
+		info, err = a.backend.Probe(ctx, tiff, c.Input.IMTempDir)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("pyramid.agent.Agent#ToPyramidTIFF failed to get height - %v", err)
+		return fmt.Errorf("pyramid.agent.Agent#toPyramidTIFF failed get info from %s - %w", tiff, err)
 	}
+	c.Width = info.Width
+	c.Height = info.Height
+	c.BitDepth = info.BitDepth
 
 	c.Output.InputWidth = c.Width
 	c.Output.InputHeight = c.Height
 
-	imageFormat, channels, depth, iccProfileName, err := im.GetInfo(tiff, c.Input.IMTempDir)
-	if err != nil {
-		return fmt.Errorf("pyramid.agent.Agent#toPyramidTIFF failed get info from %s - %v", tiff, err)
-	}
+	channels := info.Channels
 	channelsPrefix := getFirstWord(channels)
+	profile := a.readProfile(c, info)
+	iccProfileName := profile.name
 
-	depth64, err := strconv.ParseUint(depth, 10, 64)
-	if err != nil {
-		return fmt.Errorf("pyramid.agent.Agent#toPyramidTIFF failed to parse depth - %v", err)
-	}
-	c.BitDepth = uint(depth64)
-
-	log.Printf("imageFormat: %s, channels: %s, profile: %s for %s\n", imageFormat, channels, iccProfileName, tiff)
+	log.Printf("imageFormat: %s, channels: %s, profile: %s for %s\n", info.Format, channels, iccProfileName, tiff)
 
 	// Check if channels is supported
 	if valid := a.validateChannels(channelsPrefix); !valid {
-		return fmt.Errorf("image %s has channels %s which is not supported at this time",
-			tiff, channels)
+		return fmt.Errorf("%w: image %s has channels %s which is not supported at this time",
+			ErrUnsupportedImage, tiff, channels)
+	}
+
+	if c.BitDepth > 8 {
+		c.Output.HighBitDepth = c.Input.HighBitDepth
+		switch c.Input.HighBitDepth {
+		case "fail":
+			return fmt.Errorf("%w: image %s has %d bits per sample and HighBitDepth is fail",
+				ErrUnsupportedImage, tiff, c.BitDepth)
+		case "reduce":
+			err = a.runStage(c, stageEvent(progress.StageReduceDepth, c.EightBitFile, tiff), func() error {
+				return a.backend.ReduceDepth(ctx, tiff, c.EightBitFile, c.Input.Dither)
+			})
+			if err != nil {
+				return fmt.Errorf("Agent#toPyramidTIFF ReduceDepth failed - %w", err)
+			}
+			tiff = c.EightBitFile
+		}
+	}
+	depth := uint(8) // of the colour transforms
+	if c.KeepsHighBitDepth() {
+		depth = 16
+	}
+
+	newProfile := false
+
+	// CMYK goes straight to the target RGB profile so that the rest of the
+	// pipeline only sees RGB. Without a CMYK profile embedded in the image
+	// the configured default one is assumed.
+	if channelsPrefix == "cmyk" || channelsPrefix == "cmyka" {
+		cmykProfile := ""
+		if !profile.isCMYK() {
+			if config.DefaultCMYKICCProfile == "" {
+				return fmt.Errorf("%w: CMYK image %s has no CMYK profile and DEFAULT_CMYK_ICC_PROFILE is not set",
+					ErrUnsupportedImage, tiff)
+			}
+			cmykProfile = config.DefaultCMYKICCProfile
+		}
+		log.Printf("Converting CMYK image %s with profile [%s] to %s\n", tiff, iccProfileName, targetICCProfile)
+		err = a.runStage(c, stageEvent(progress.StageCMYKToRGB, c.RGBFile, tiff), func() error {
+			return a.backend.CMYKToRGB(ctx, tiff, c.RGBFile, cmykProfile, targetICCProfile, depth)
+		})
+		if err != nil {
+			return fmt.Errorf("Agent#toPyramidTIFF CMYKToRGB failed - %w", err)
+		}
+		tiff = c.RGBFile
+		channelsPrefix = "srgb" + strings.TrimPrefix(channelsPrefix, "cmyk")
+		newProfile = true
 	}
+	c.Bands = a.bands(channelsPrefix)
 
 	// We have to flatten the image to remove the alpha channel / trasparency
 	// before proceeding
 	if channelsPrefix == "srgba" {
-		if err = vips.RemoveAlpha(tiff, c.NoalphaFile); err != nil {
-			return fmt.Errorf("Agent#toPyramidTIFF RemoveAlpha failed - %v", err)
+		err = a.runStage(c, stageEvent(progress.StageRemoveAlpha, c.NoalphaFile, tiff), func() error {
+			return a.backend.RemoveAlpha(ctx, tiff, c.NoalphaFile)
+		})
+		if err != nil {
+			return fmt.Errorf("Agent#toPyramidTIFF RemoveAlpha failed - %w", err)
 		}
 	} else if channelsPrefix == "graya" {
-		if err = vips.RemoveAlphaFromGraya(tiff, c.NoalphaFile); err != nil {
-			return fmt.Errorf("Agent#toPyramidTIFF RemoveAlphaGraya failed - %v", err)
+		err = a.runStage(c, stageEvent(progress.StageRemoveAlpha, c.NoalphaFile, tiff), func() error {
+			return a.backend.RemoveAlphaFromGraya(ctx, tiff, c.NoalphaFile)
+		})
+		if err != nil {
+			return fmt.Errorf("Agent#toPyramidTIFF RemoveAlphaGraya failed - %w", err)
 		}
 	} else {
 		c.NoalphaFile = tiff
 	}
 
-	newProfile := false
-
 	// In the case of gray with no embedded color profile or with an embedded
 	// sRGB profile that was probably erroneously applied to the image,
 	// we can't just apply sRGB with the icc_transform because sRGB isn't
 	// an appropriate profile for the icc_transform command, so we have to call
 	// vipsthumbnail instead which does some magick behind the scenes to properly
 	// convert between the profiles.
-	if channelsPrefix == "gray" && (iccProfileName == "" || iccProfileName == "sRGB Profile") {
+	if channelsPrefix == "gray" && (!profile.present() || profile.isSRGB()) {
 		log.Printf("Fixing gray image %s with profile [%s]", c.NoalphaFile, iccProfileName)
-		err = vips.FixGray(c.NoalphaFile, c.GrayFixedFile)
+		err = a.runStage(c, stageEvent(progress.StageFixGray, c.GrayFixedFile, c.NoalphaFile), func() error {
+			return a.backend.FixGray(ctx, c.NoalphaFile, c.GrayFixedFile, c.Width, c.Height)
+		})
 		if err != nil {
-			return fmt.Errorf("Agent#toPyramidTIFF FixGray failed - %v", err)
+			return fmt.Errorf("Agent#toPyramidTIFF FixGray failed - %w", err)
 		}
 		newProfile = true
-	} else if channelsPrefix == "gray" && iccProfileName == "Adobe RGB (1998)" {
+		c.Bands = 3
+	} else if channelsPrefix == "gray" && profile.isRGB() {
 		log.Printf("Converting gray image %s to sRGB", c.NoalphaFile)
-		err = combined.GrayToSRGB(c.NoalphaFile, c.GrayFixedFile)
+		err = a.runStage(c, stageEvent(progress.StageGrayToSRGB, c.GrayFixedFile, c.NoalphaFile), func() error {
+			return a.backend.GrayToSRGB(ctx, c.NoalphaFile, c.GrayFixedFile)
+		})
 		if err != nil {
-			return fmt.Errorf("Agent#toPyramidTIFF GrayToSRGB failed - %v", err)
+			return fmt.Errorf("Agent#toPyramidTIFF GrayToSRGB failed - %w", err)
 		}
 		newProfile = true
+		c.Bands = 3
 	} else {
 		c.GrayFixedFile = c.NoalphaFile
 	}
 
-	if iccProfileName == "" {
+	if !newProfile && !profile.present() {
 		log.Printf("WARNING icc profile not available for image %s - profile won't be converted\n", c.GrayFixedFile)
 	}
 
@@ -162,110 +270,464 @@ func (a *Agent) toPyramidTIFF(c *context.Context) (err error) {
 	// - If no ICC profile is embedded, browsers will usually assume the image is in sRGB.
 	// - When ICC profile description string is "sRGB.icc", vips complained it is not complained that
 	//   it is not compatible with the the destination profile (sRGB IEC61966-2.1).
-	if !newProfile && iccProfileName != "" && !strings.HasPrefix(strings.ToLower(iccProfileName), "srgb") {
-		fmt.Printf("ICC transform %s -> %s (%s)\n", c.GrayFixedFile, c.ProfileFixedFile, targetICCProfile)
-		err = vips.ICCTransform(fmt.Sprintf("%s[0]", c.GrayFixedFile), c.ProfileFixedFile, targetICCProfile)
+	if !newProfile && profile.present() && !profile.isSRGB() {
+		log.Printf("ICC transform %s -> %s (%s)\n", c.GrayFixedFile, c.ProfileFixedFile, targetICCProfile)
+		err = a.runStage(c, stageEvent(progress.StageICCTransform, c.ProfileFixedFile, c.GrayFixedFile), func() error {
+			return a.backend.ICCTransform(ctx, c.GrayFixedFile, c.ProfileFixedFile, targetICCProfile, depth)
+		})
 		if err != nil {
-			return fmt.Errorf("Agent#toPyramidTIFF ICCTransform failed - %v", err)
+			return fmt.Errorf("Agent#toPyramidTIFF ICCTransform failed - %w", err)
+		}
+		if c.Bands == 1 {
+			// A gray image transformed to an RGB target profile is RGB.
+			var info *backend.ImageInfo
+			err = a.runStage(c, stageEvent(progress.StageProbe, "", c.ProfileFixedFile), func() (err error) {
+				info, err = a.backend.Probe(ctx, c.ProfileFixedFile, c.Input.IMTempDir)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("Agent#toPyramidTIFF failed get info from %s - %w", c.ProfileFixedFile, err)
+			}
+			c.Bands = a.bands(getFirstWord(info.Channels))
 		}
 	} else {
 		c.ProfileFixedFile = c.GrayFixedFile
 	}
 
-	err = a.createPyramid(c, c.ProfileFixedFile)
+	err = a.createPyramid(ctx, c, c.ProfileFixedFile)
 	if err != nil {
-		return fmt.Errorf("Agent#toPyramidTIFF createPyramid failed - %v", err)
+		return fmt.Errorf("Agent#toPyramidTIFF createPyramid failed - %w", err)
 	}
 	return nil
 }
 
-func (a *Agent) createPyramid(c *context.Context, inFile string) (err error) {
+func (a *Agent) createPyramid(ctx gocontext.Context, c *context.Context, inFile string) (err error) {
 	var w, h uint
 
-	if w, h, err = a.initialResize(c, inFile); err != nil {
-		return fmt.Errorf("Agent#createPyramid initialResize failed - %v", err)
+	if w, h, err = a.initialResize(ctx, c, inFile); err != nil {
+		return fmt.Errorf("Agent#createPyramid initialResize failed - %w", err)
 	}
 	c.Output.OutputWidth = w
 	c.Output.OutputHeight = h
 
-	if err = a.createSubImages(c, w, h); err != nil {
-		return fmt.Errorf("Agent#createPyramid createSubImages failed - %v", err)
+	levels, err := a.createSubImages(ctx, c, inFile, w, h)
+	if err != nil {
+		return fmt.Errorf("Agent#createPyramid createSubImages failed - %w", err)
+	}
+	if c.WritesTiles() {
+		if err = a.writeTiles(ctx, c, levels); err != nil {
+			return fmt.Errorf("Agent#createPyramid writeTiles failed - %w", err)
+		}
+		return nil
+	}
+	if err = a.combineSubImages(ctx, c, levels); err != nil {
+		return fmt.Errorf("Agent#createPyramid combineImages failed - %w", err)
+	}
+	if c.WritesMetadata() {
+		if err = a.writeMetadata(ctx, c); err != nil {
+			return fmt.Errorf("Agent#createPyramid writeMetadata failed - %w", err)
+		}
+	}
+	return nil
+}
+
+// writeMetadata copies the tags of the Metadata policy from InFile into the
+// pyramid, then writes and checks the rights metadata of Tags, and checks
+// that exiftool left a valid tiled pyramid behind.
+func (a *Agent) writeMetadata(ctx gocontext.Context, c *context.Context) error {
+	want := verify.ExpectedFromOutput(&c.Output)
+	before, err := verify.Verify(c.Input.OutFile, want)
+	if err != nil {
+		return err
 	}
-	if err = a.combineSubImages(c); err != nil {
-		return fmt.Errorf("Agent#createPyramid combineImages failed - %v", err)
+	if c.CopiesMetadata() {
+		err = a.runStage(c, stageEvent(progress.StageMetadata, c.Input.OutFile, c.Input.InFile), func() error {
+			return a.backend.CopyMetadata(ctx, c.Input.InFile, c.Input.OutFile, c.MetadataTags())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if assignments := c.Input.Tags.Assignments(); len(assignments) > 0 {
+		err = a.runStage(c, stageEvent(progress.StageTags, c.Input.OutFile), func() error {
+			return a.writeTags(ctx, c, assignments)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	after, err := verify.Verify(c.Input.OutFile, want)
+	if err != nil {
+		return fmt.Errorf("pyramid unreadable after writing metadata - %v", err)
+	}
+	if violations := after.Since(before); len(violations) > 0 {
+		return fmt.Errorf("pyramid no longer valid after writing metadata - %s: %s",
+			violations[0].Check, violations[0].Message)
+	}
+	return nil
+}
+
+// writeTags writes the rights metadata of Tags into the pyramid and reads
+// it back into c.Output. Values cut to the length limit of their tag are
+// reported as warnings; any other difference is an error.
+func (a *Agent) writeTags(ctx gocontext.Context, c *context.Context, assignments []exiftool.Assignment) error {
+	if err := a.backend.WriteTags(ctx, c.Input.OutFile, c.Input.Tags); err != nil {
+		return err
+	}
+	names := make([]string, len(assignments))
+	for i, as := range assignments {
+		names[i] = as.ReadTag()
+	}
+	values, err := a.backend.ReadTags(ctx, c.Input.OutFile, names)
+	if err != nil {
+		return err
+	}
+	for _, as := range assignments {
+		name := as.ReadTag()
+		got, ok := values[name]
+		switch {
+		case ok && got == strings.TrimSpace(as.Value):
+		case ok && as.Truncated(got):
+			c.Output.TagWarnings = append(c.Output.TagWarnings,
+				fmt.Sprintf("%s cut to %d characters", name, as.MaxLen))
+		case !ok:
+			return fmt.Errorf("%s missing after writing it", name)
+		default:
+			return fmt.Errorf("%s is %q after writing %q", name, got, as.Value)
+		}
+		c.Output.Tags = append(c.Output.Tags, output.Tag{Name: name, Value: got})
 	}
 	return nil
 }
 
 // Prepare the top-level image for the pyramidal TIFF.
-func (a *Agent) initialResize(c *context.Context, inFile string) (w, h uint, err error) {
+func (a *Agent) initialResize(ctx gocontext.Context, c *context.Context, inFile string) (w, h uint, err error) {
 	w, h = c.InitialWH()
-	fmt.Printf("initial w: %d, h: %d\n", w, h)
-	top := fmt.Sprintf("%s_0.tif", c.TmpFilePrefix)
-	inFile0 := fmt.Sprintf("%s[0]", inFile)
+	log.Printf("initial w: %d, h: %d\n", w, h)
+	top := levelFile(c, 0)
 
 	// Resize original to maxSize.
-	err = vips.Resize(inFile0, top, w, h)
+	e := stageEvent(progress.StageResize, top, inFile)
+	e.Levels = len(c.LevelSizes(w, h))
+	opts := a.resizeOptions(c)
+	if w == c.Width && h == c.Height {
+		opts.Sharpen = 0 // not resized
+	}
+	err = a.runStage(c, e, func() error {
+		return a.backend.Resize(ctx, inFile, top, w, h, opts)
+	})
 	if err != nil {
-		log.Printf("ERROR initialResize Resize failed for %s - %v\n", inFile0, err)
+		log.Printf("ERROR initialResize Resize failed for %s - %v\n", inFile, err)
 	}
 
 	return w, h, err
 }
 
-// Create sub-images for the pyramid.
-func (a *Agent) createSubImages(c *context.Context, w, h uint) (err error) {
-	depth := 1
-
-	for w, h, depth = w/2, h/2, 1; w > 0 && h > 0 && (w > 127 || h > 127); depth++ {
-		inFile := fmt.Sprintf("%s_%d.tif", c.TmpFilePrefix, depth-1)
-		outFile := fmt.Sprintf("%s_%d.tif", c.TmpFilePrefix, depth)
+// Create sub-images for the pyramid, each from the level above or, if
+// LevelSource is "full", from fullFile, the full-resolution image. It
+// returns the files of all levels, the top-level one made by
+// initialResize first, in order of decreasing size.
+func (a *Agent) createSubImages(ctx gocontext.Context, c *context.Context, fullFile string, w, h uint) (levels []string, err error) {
+	sizes := c.LevelSizes(w, h)
+	c.Output.Levels = sizes
+	c.Output.TileWidth = c.Input.TileWidth
+	c.Output.TileHeight = c.Input.TileHeight
+	opts := a.resizeOptions(c)
+	levels = []string{levelFile(c, 0)}
+
+	for depth := 1; depth < len(sizes); depth++ {
+		inFile := levels[depth-1]
+		if c.Input.LevelSource == "full" {
+			inFile = fullFile
+		}
+		outFile := levelFile(c, depth)
 
-		if err = vips.Resize(inFile, outFile, w, h); err != nil {
-			return err
+		e := stageEvent(progress.StageResize, outFile, inFile)
+		e.Level, e.Levels = depth, len(sizes)
+		err = a.runStage(c, e, func() error {
+			return a.backend.Resize(ctx, inFile, outFile, sizes[depth].Width, sizes[depth].Height, opts)
+		})
+		if err != nil {
+			return nil, err
 		}
-		w /= 2
-		h /= 2
+		levels = append(levels, outFile)
+	}
+	return levels, nil
+}
+
+// levelFile returns the temp file of level i of the pyramid, 0 being the
+// full-size one.
+func levelFile(c *context.Context, i int) string {
+	return fmt.Sprintf("%s_%d.tif", c.TmpFilePrefix, i)
+}
+
+func (a *Agent) resizeOptions(c *context.Context) backend.ResizeOptions {
+	return backend.ResizeOptions{
+		Kernel:      c.Input.Kernel,
+		LinearLight: c.Input.LinearLight,
+		Sharpen:     c.Input.Sharpen,
 	}
-	return err
 }
 
-func (a *Agent) combineSubImages(c *context.Context) error {
-	inFiles, err := filepath.Glob(fmt.Sprintf("%s_*.tif", c.TmpFilePrefix))
+// combineSubImages assembles inFiles, the levels made by createSubImages
+// in order of decreasing size, into the pyramidal TIFF.
+func (a *Agent) combineSubImages(ctx gocontext.Context, c *context.Context, inFiles []string) error {
+	var levelDepth uint
+	c.Bands, levelDepth = a.levelFormat(ctx, c, inFiles[0])
+	bigTIFF, err := c.UseBigTIFF(c.Output.OutputWidth, c.Output.OutputHeight)
 	if err != nil {
-		return fmt.Errorf("combineSubImages failed to get list of files for %s - %v", c.TmpFilePrefix, err)
+		return fmt.Errorf("Agent#combineSubImages %w - %v", ErrInvalidParams, err)
+	}
+	if bigTIFF {
+		log.Printf("Writing %s as BigTIFF\n", c.Input.OutFile)
+		if c.WritesMetadata() {
+			return fmt.Errorf("%w: metadata cannot be written to BigTIFF %s", ErrUnsupportedImage, c.Input.OutFile)
+		}
+	}
+	c.Output.BigTIFF = bigTIFF
+
+	c.OutBitDepth = levelDepth
+	c.Output.BitDepth = c.OutBitDepth
+	tileCompression := c.Compression()
+	c.Output.Compression = tileCompression
+	if c.OutBitDepth > 8 {
+		log.Printf("Keeping %d bits per sample, compressing %s losslessly with %s\n",
+			c.OutBitDepth, c.Input.OutFile, tileCompression)
+	}
+	if tileCompression.Codec == compression.WebP && (c.OutBitDepth != 8 || c.Bands != 3) {
+		return fmt.Errorf("%w: WebP tiles need 8-bit RGB, image %s has %d bands of %d bits",
+			ErrUnsupportedImage, c.Input.InFile, c.Bands, c.OutBitDepth)
 	}
 
-	compression := c.CompressionOption()
-	if c.BitDepth > 8 {
-		compression = "" // no compression for depth 16 images (jpeg can't handle 16 bit)
-		log.Printf("WARNING: JPEG can't handle 16 bit images, so no compression applied for %s\n", inFiles[0])
+	switch c.Input.PyramidBuilder {
+	case "", "tiffcp":
+		err = a.runStage(c, stageEvent(progress.StageCombine, c.Input.OutFile, inFiles...), func() error {
+			return a.backend.BuildPyramid(ctx, inFiles, c.Input.OutFile, backend.PyramidOptions{
+				Compression: tileCompression,
+				TileWidth:   c.Input.TileWidth,
+				TileHeight:  c.Input.TileHeight,
+				BigTIFF:     bigTIFF,
+			})
+		})
+	case "native":
+		var opts ptiff.Options
+		if opts, err = c.PTIFFOptions(); err != nil {
+			return fmt.Errorf("Agent#combineSubImages %w - %v", ErrInvalidParams, err)
+		}
+		opts.BigTIFF = bigTIFF
+
+		err = a.runStage(c, stageEvent(progress.StageCombine, c.Input.OutFile, inFiles...), func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return ptiff.BuildPyramid(inFiles, c.Input.OutFile, opts)
+		})
+	default:
+		return fmt.Errorf("Agent#combineSubImages %w - unknown pyramid builder %s", ErrInvalidParams, c.Input.PyramidBuilder)
 	}
 
-	err = tiff.BuildPyramid(inFiles, c.Input.OutFile, map[string]string{
-		"c": compression,
-	})
+	if err != nil {
+		return fmt.Errorf("Agent#combineSubImages failed to build pyramid - %w", err)
+	}
+	return nil
+}
+
+// writeTiles writes inFiles, the levels made by createSubImages, as the
+// tile tree of OutputFormat.
+func (a *Agent) writeTiles(ctx gocontext.Context, c *context.Context, inFiles []string) error {
+	_, c.OutBitDepth = a.levelFormat(ctx, c, inFiles[0])
+	c.Output.BitDepth = c.OutBitDepth
+	if c.OutBitDepth != 8 {
+		return fmt.Errorf("%w: tiles need 8-bit levels, image %s has %d bits per sample",
+			ErrUnsupportedImage, c.Input.InFile, c.OutBitDepth)
+	}
+	c.Output.Compression = compression.Option{Codec: compression.JPEG, Quality: c.Input.Quality}
+
+	if c.Input.OutputFormat == "dzi" && c.Input.TileFormat == "png" {
+		c.Output.Compression = compression.Option{Codec: compression.Deflate}
+	}
 
+	err := a.runStage(c, stageEvent(progress.StageCombine, c.Input.OutFile, inFiles...), func() error {
+		var err error
+		switch c.Input.OutputFormat {
+		case "iiif":
+			c.Output.TileCount, err = tiles.WriteIIIF(ctx, inFiles, c.Input.OutFile, tiles.IIIFOptions{
+				ID:         c.Input.IIIFID,
+				Version:    c.Input.IIIFVersion,
+				TileWidth:  int(c.Input.TileWidth),
+				TileHeight: int(c.Input.TileHeight),
+				Quality:    c.Input.Quality,
+			})
+		case "dzi":
+			c.Output.TileCount, err = tiles.WriteDZI(ctx, inFiles, c.Input.OutFile, tiles.DZIOptions{
+				TileSize: int(c.Input.TileWidth),
+				Overlap:  int(c.Input.TileOverlap),
+				Format:   c.Input.TileFormat,
+				Quality:  c.Input.Quality,
+			})
+		case "zoomify":
+			c.Output.TileCount, err = tiles.WriteZoomify(ctx, inFiles, c.Input.OutFile, tiles.ZoomifyOptions{
+				TileSize: int(c.Input.TileWidth),
+				Quality:  c.Input.Quality,
+			})
+		}
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("Agent#combineSubImages failed to build pyramid - %v", err)
+		return fmt.Errorf("Agent#writeTiles failed to write tiles - %w", err)
 	}
 	return nil
 }
 
+// levelFormat returns the number of samples per pixel and of bits per
+// sample of level file as the backend probes them, or else those expected
+// from the conversion.
+func (a *Agent) levelFormat(ctx gocontext.Context, c *context.Context, file string) (bands, depth uint) {
+	bands = c.Bands
+	depth = 8
+	if c.KeepsHighBitDepth() {
+		depth = c.BitDepth
+	}
+	info, err := a.backend.Probe(ctx, file, c.Input.IMTempDir)
+	if err != nil {
+		return bands, depth
+	}
+	if info.Bands != 0 {
+		bands = info.Bands
+	}
+	if info.BitDepth != 0 {
+		depth = info.BitDepth
+	}
+	return bands, depth
+}
+
+// embeddedProfile describes the ICC profile embedded in the image.
+type embeddedProfile struct {
+	name       string        // description, "" if unknown
+	colorSpace icc.Signature // colour space of the profile, 0 if unknown
+}
+
+func (p embeddedProfile) present() bool {
+	return p.name != "" || p.colorSpace != 0
+}
+
+func (p embeddedProfile) isSRGB() bool {
+	return strings.HasPrefix(strings.ToLower(p.name), "srgb")
+}
+
+// isCMYK tells whether the profile is for CMYK data. Without the parsed
+// profile, any profile of a CMYK image is assumed to be one.
+func (p embeddedProfile) isCMYK() bool {
+	if p.colorSpace != 0 {
+		return p.colorSpace == icc.ColorSpaceCMYK
+	}
+	return p.present()
+}
+
+// isRGB tells whether the profile is for RGB data. Without the parsed
+// profile, only Adobe RGB is recognised.
+func (p embeddedProfile) isRGB() bool {
+	if p.colorSpace != 0 {
+		return p.colorSpace == icc.ColorSpaceRGB
+	}
+	return p.name == "Adobe RGB (1998)"
+}
+
+// readProfile parses the ICC profile found by Probe, or else the one
+// embedded in the input file, or in the TIFF converted from it if package
+// icc cannot read the input format. If none can be read, it falls back to
+// the profile name found by the backend.
+func (a *Agent) readProfile(c *context.Context, info *backend.ImageInfo) embeddedProfile {
+	if info.ICCProfile != nil {
+		if p, ok := parseProfile(info.ICCProfile, c.TiffFile); ok {
+			return p
+		}
+	}
+	for _, file := range []string{c.Input.InFile, c.TiffFile} {
+		b, err := icc.ExtractFile(file)
+		if err != nil {
+			log.Printf("pyramid.agent.Agent#readProfile cannot read the profile of %s - %v\n", file, err)
+			continue
+		}
+		if b == nil {
+			return embeddedProfile{}
+		}
+		if p, ok := parseProfile(b, file); ok {
+			return p
+		}
+		break
+	}
+	return embeddedProfile{name: info.ICCProfileName}
+}
+
+// parseProfile parses profile b read from file, logging why it cannot.
+func parseProfile(b []byte, file string) (embeddedProfile, bool) {
+	p, err := icc.Parse(b)
+	if err != nil {
+		log.Printf("WARNING pyramid.agent.Agent#readProfile invalid profile in %s - %v\n", file, err)
+		return embeddedProfile{}, false
+	}
+	desc, err := p.Description()
+	if err != nil {
+		log.Printf("WARNING pyramid.agent.Agent#readProfile no description in profile of %s - %v\n", file, err)
+	}
+	return embeddedProfile{name: desc, colorSpace: p.ColorSpace}, true
+}
+
+// runStage runs f, reporting the start and the end of the stage described
+// by e to c.Input.Progress, if set. An error of f is returned as a *StageError.
+func (a *Agent) runStage(c *context.Context, e progress.Event, f func() error) error {
+	wrap := func(err error) error {
+		if err == nil {
+			return nil
+		}
+		return newStageError(e.Stage, err)
+	}
+	report := c.Input.Progress
+	if report == nil {
+		return wrap(f())
+	}
+	e.Phase = progress.PhaseStart
+	e.Start = time.Now()
+	report(e)
+
+	err := wrap(f())
+	e.Phase = progress.PhaseFinish
+	e.Duration = time.Since(e.Start)
+	e.Err = err
+	report(e)
+	return err
+}
+
+func stageEvent(stage progress.Stage, outFile string, inFiles ...string) progress.Event {
+	return progress.Event{Stage: stage, InFiles: inFiles, OutFile: outFile}
+}
+
 func (a *Agent) validateChannels(channels string) bool {
 	switch channels {
-	case "srgb", "gray", "cmyk", "srgba", "graya":
+	case "srgb", "gray", "cmyk", "srgba", "graya", "cmyka":
 		return true
 	default:
 		return false
 	}
 }
 
+// bands returns the number of bands left after the alpha channel,
+// if any, has been removed.
+func (a *Agent) bands(channels string) uint {
+	switch channels {
+	case "gray", "graya":
+		return 1
+	default:
+		return 3
+	}
+}
+
 func (a *Agent) mkdirp(d string) error {
 	log.Printf("pyramid.agent.Agent#mkdirp making sure directory %s exists", d)
 	err := os.MkdirAll(d, 0700)
 	if err != nil {
-		return fmt.Errorf("pyramid.Agent#mkdirp failed to create directory %s - %v", d, err)
+		return fmt.Errorf("pyramid.Agent#mkdirp failed to create directory %s - %w", d, err)
 	}
 	return nil
 }
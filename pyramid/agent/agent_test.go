@@ -1,10 +1,29 @@
 package agent
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/gigamorph/go-pyramid/config"
+	"github.com/gigamorph/go-pyramid/pyramid/backend"
+	pcontext "github.com/gigamorph/go-pyramid/pyramid/context"
 	"github.com/gigamorph/go-pyramid/pyramid/input"
+	"github.com/gigamorph/go-pyramid/pyramid/output"
+	"github.com/gigamorph/go-pyramid/pyramid/progress"
+	"github.com/gigamorph/go-pyramid/shellcmds/exiftool"
+	"github.com/gigamorph/go-pyramid/util"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestConvert(t *testing.T) {
@@ -62,6 +81,941 @@ func TestConvert(t *testing.T) {
 	})
 }
 
+func TestToPyramidTIFF(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "go-pyramid-agent-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	inFile := "/images/in.jpg"
+	rgb := fakeImage{width: 1000, height: 600, channels: "srgb", depth: 8}
+	levels := []string{"Resize", "Resize", "Resize"} // 1000x600, 500x300, 250x150
+
+	tests := []struct {
+		name         string
+		image        func(img fakeImage) fakeImage
+		calls        []string
+		compression  string
+		highBitDepth string
+		bitDepth     uint // expected bit depth of the pyramid, if not 8
+		err          bool
+	}{
+		{
+			name:  "sRGB",
+			image: func(img fakeImage) fakeImage { img.profile = "sRGB IEC61966-2.1"; return img },
+			calls: []string{"ToTIFF", "Probe"},
+		},
+		{
+			name:  "AdobeRGB",
+			image: func(img fakeImage) fakeImage { img.profile = "Adobe RGB (1998)"; return img },
+			calls: []string{"ToTIFF", "Probe", "ICCTransform"},
+		},
+		{
+			name:  "NoProfile",
+			image: func(img fakeImage) fakeImage { return img },
+			calls: []string{"ToTIFF", "Probe"},
+		},
+		{
+			name: "RGBA",
+			image: func(img fakeImage) fakeImage {
+				img.channels, img.profile = "srgba", "Adobe RGB (1998)"
+				return img
+			},
+			calls: []string{"ToTIFF", "Probe", "RemoveAlpha", "ICCTransform"},
+		},
+		{
+			name:  "GrayNoProfile",
+			image: func(img fakeImage) fakeImage { img.channels = "gray"; return img },
+			calls: []string{"ToTIFF", "Probe", "FixGray"},
+		},
+		{
+			name: "GrayAlphaSRGB",
+			image: func(img fakeImage) fakeImage {
+				img.channels, img.profile = "graya", "sRGB Profile"
+				return img
+			},
+			// The gray fixes only look at images that were "gray" to begin with.
+			calls: []string{"ToTIFF", "Probe", "RemoveAlphaFromGraya"},
+		},
+		{
+			name: "GrayAdobeRGB",
+			image: func(img fakeImage) fakeImage {
+				img.channels, img.profile = "gray", "Adobe RGB (1998)"
+				return img
+			},
+			calls: []string{"ToTIFF", "Probe", "GrayToSRGB"},
+		},
+		{
+			name: "Gray16Bit",
+			image: func(img fakeImage) fakeImage {
+				img.channels, img.profile, img.depth = "gray", "Dot Gain 20%", 16
+				return img
+			},
+			calls:       []string{"ToTIFF", "Probe", "ICCTransform", "Probe"},
+			compression: "deflate:horizontal",
+			bitDepth:    16,
+		},
+		{
+			name:         "RGB16BitReduce",
+			image:        func(img fakeImage) fakeImage { img.depth = 16; return img },
+			calls:        []string{"ToTIFF", "Probe", "ReduceDepth"},
+			compression:  "jpeg:90",
+			highBitDepth: "reduce",
+		},
+		{
+			name:         "RGB16BitFail",
+			image:        func(img fakeImage) fakeImage { img.depth = 16; return img },
+			calls:        []string{"ToTIFF", "Probe"},
+			highBitDepth: "fail",
+			err:          true,
+		},
+		{
+			name: "CMYK",
+			image: func(img fakeImage) fakeImage {
+				img.channels, img.profile = "cmyk", "U.S. Web Coated (SWOP) v2"
+				return img
+			},
+			calls: []string{"ToTIFF", "Probe", "CMYKToRGB"},
+		},
+		{
+			name: "CMYKAlpha",
+			image: func(img fakeImage) fakeImage {
+				img.channels, img.profile = "cmyka", "Coated FOGRA39 (ISO 12647-2:2004)"
+				return img
+			},
+			calls: []string{"ToTIFF", "Probe", "CMYKToRGB", "RemoveAlpha"},
+		},
+		{
+			name:  "CMYKNoProfile",
+			image: func(img fakeImage) fakeImage { img.channels = "cmyk"; return img },
+			calls: []string{"ToTIFF", "Probe"},
+			err:   true, // DEFAULT_CMYK_ICC_PROFILE is not set
+		},
+		{
+			name:  "UnsupportedChannels",
+			image: func(img fakeImage) fakeImage { img.channels = "lab"; return img },
+			calls: []string{"ToTIFF", "Probe"},
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newFakeBackend(inFile, tt.image(rgb))
+			a := NewWithBackend(b)
+
+			out, err := a.Convert(input.Params{
+				InFile:           inFile,
+				OutFile:          "/images/out.tif",
+				Compression:      "jpeg",
+				Quality:          90,
+				TargetICCProfile: "target.icc",
+				TempDir:          tempDir,
+				HighBitDepth:     tt.highBitDepth,
+			})
+
+			calls := tt.calls
+			if tt.err {
+				assert.NotNil(t, err, "Convert should fail")
+				assert.Equal(t, calls, b.calls, "operations")
+				return
+			}
+			assert.Nil(t, err, "Convert")
+			calls = append(append(calls, levels...), "Probe", "BuildPyramid")
+			assert.Equal(t, calls, b.calls, "operations")
+			assert.Equal(t, 3, len(b.pyramids[0]), "levels passed to BuildPyramid")
+			assert.Equal(t, uint(1000), out.OutputWidth, "output width")
+			assert.Equal(t, uint(600), out.OutputHeight, "output height")
+
+			compression := "jpeg:90"
+			if tt.image(rgb).depth > 8 {
+				compression = tt.compression
+			}
+			assert.Equal(t, compression, b.pyramidOpts.Compression.String(), "compression")
+			assert.Equal(t, b.pyramidOpts.Compression, out.Compression, "reported compression")
+
+			bitDepth := tt.bitDepth
+			if bitDepth == 0 {
+				bitDepth = 8
+			}
+			assert.Equal(t, bitDepth, out.BitDepth, "bit depth")
+			if tt.image(rgb).depth > 8 {
+				assert.NotEmpty(t, out.HighBitDepth, "high bit depth policy")
+			}
+		})
+	}
+
+	t.Run("BackendError", func(t *testing.T) {
+		b := newFakeBackend(inFile, rgb)
+		b.fail["Resize"] = fmt.Errorf("disk full")
+		a := NewWithBackend(b)
+
+		_, err := a.Convert(input.Params{
+			InFile:  inFile,
+			OutFile: "/images/out.tif",
+			TempDir: tempDir,
+		})
+		assert.NotNil(t, err, "Convert should fail")
+		assert.NotContains(t, b.calls, "BuildPyramid", "no pyramid after a failed resize")
+	})
+}
+
+func TestEmbeddedProfile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "go-pyramid-agent-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	adobeTIFF := fromRoot("test/resources/images/grayscale-with-adobe-rgb-1998.tif")
+	noProfilePNG := filepath.Join(tempDir, "no-profile.png")
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+	ioutil.WriteFile(noProfilePNG, buf.Bytes(), 0600)
+
+	// The profile read from the file wins over the name the backend reports.
+	tests := []struct {
+		name   string
+		inFile string
+		image  fakeImage
+		calls  []string
+	}{
+		{
+			name:   "GrayAdobeRGB",
+			inFile: adobeTIFF,
+			image:  fakeImage{channels: "gray"},
+			calls:  []string{"ToTIFF", "Probe", "GrayToSRGB"},
+		},
+		{
+			name:   "RGBAdobeRGB",
+			inFile: adobeTIFF,
+			image:  fakeImage{channels: "srgb", profile: "sRGB IEC61966-2.1"},
+			calls:  []string{"ToTIFF", "Probe", "ICCTransform"},
+		},
+		{
+			name:   "NoProfile",
+			inFile: noProfilePNG,
+			image:  fakeImage{channels: "srgb", profile: "Adobe RGB (1998)"},
+			calls:  []string{"ToTIFF", "Probe"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := tt.image
+			img.width, img.height, img.depth = 1000, 600, 8
+			b := newFakeBackend(tt.inFile, img)
+			_, err := NewWithBackend(b).Convert(input.Params{
+				InFile:     tt.inFile,
+				OutFile:    filepath.Join(tempDir, "out.tif"),
+				TempDir:    tempDir,
+				DeleteTemp: true,
+			})
+			assert.Nil(t, err, "Convert")
+			assert.Equal(t, tt.calls, b.calls[:len(tt.calls)], "operations")
+			assert.Equal(t, "Resize", b.calls[len(tt.calls)], "no other colour operation")
+		})
+	}
+}
+
+func TestResampling(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "go-pyramid-agent-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	inFile := "/images/in.tif"
+	rgb := fakeImage{width: 1000, height: 600, channels: "srgb", depth: 8}
+	params := input.Params{InFile: inFile, OutFile: "/images/out.tif", TempDir: tempDir}
+
+	t.Run("Default", func(t *testing.T) {
+		b := newFakeBackend(inFile, rgb)
+		_, err := NewWithBackend(b).Convert(params)
+		assert.Nil(t, err, "Convert")
+		if assert.Equal(t, 3, len(b.resizes), "resizes") {
+			assert.Equal(t, backend.ResizeOptions{}, b.resizes[1].opts, "backend default")
+			assert.Equal(t, "in_0.tif", filepath.Base(b.resizes[1].inFile), "level 1 from level 0")
+			assert.Equal(t, "in_1.tif", filepath.Base(b.resizes[2].inFile), "level 2 from level 1")
+		}
+	})
+
+	t.Run("FromFullResolution", func(t *testing.T) {
+		p := params
+		p.Kernel, p.LinearLight, p.LevelSource, p.Sharpen = "lanczos3", true, "full", 0.5
+		b := newFakeBackend(inFile, rgb)
+		_, err := NewWithBackend(b).Convert(p)
+		assert.Nil(t, err, "Convert")
+		if assert.Equal(t, 3, len(b.resizes), "resizes") {
+			assert.Equal(t, 0.0, b.resizes[0].opts.Sharpen, "full-size level is not sharpened")
+			for i, r := range b.resizes[1:] {
+				assert.Equal(t, b.resizes[0].inFile, r.inFile, "level %d from the full-resolution image", i+1)
+				assert.Equal(t, backend.ResizeOptions{Kernel: "lanczos3", LinearLight: true, Sharpen: 0.5}, r.opts, "options of level %d", i+1)
+			}
+		}
+	})
+
+	t.Run("UnknownKernel", func(t *testing.T) {
+		p := params
+		p.Kernel = "mitchell"
+		_, err := NewWithBackend(newFakeBackend(inFile, rgb)).Convert(p)
+		assert.True(t, errors.Is(err, ErrInvalidParams), "got %v", err)
+	})
+}
+
+func TestTileOutput(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "go-pyramid-agent-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	inFile := "/images/in.tif"
+	params := input.Params{
+		InFile:       inFile,
+		OutFile:      filepath.Join(tempDir, "out"),
+		TempDir:      tempDir,
+		OutputFormat: "iiif",
+		IIIFID:       "https://example.org/iiif/out",
+	}
+
+	t.Run("IIIF", func(t *testing.T) {
+		b := newFakeBackend(inFile, fakeImage{width: 1000, height: 600, channels: "gray", depth: 16, profile: "Dot Gain 20%"})
+		b.realLevels = true
+		out, err := NewWithBackend(b).Convert(params)
+		assert.Nil(t, err, "Convert")
+		assert.Contains(t, b.calls, "ReduceDepth", "high bit depth reduced by default")
+		assert.NotContains(t, b.calls, "BuildPyramid", "no pyramidal TIFF")
+		assert.FileExists(t, filepath.Join(params.OutFile, "info.json"))
+		assert.FileExists(t, filepath.Join(params.OutFile, "0,0,256,256", "256,256", "0", "default.jpg"))
+		if assert.NotNil(t, out) {
+			assert.Equal(t, uint(8), out.BitDepth, "bit depth")
+			assert.Equal(t, "jpeg:90", out.Compression.String(), "compression")
+			assert.Equal(t, 3, len(out.Levels), "levels")
+			assert.Equal(t, 12+4+2, out.TileCount, "tile count")
+		}
+	})
+
+	t.Run("DZI", func(t *testing.T) {
+		p := params
+		p.OutputFormat, p.OutFile = "dzi", filepath.Join(tempDir, "dzi", "out.dzi")
+		p.TileWidth, p.TileHeight, p.TileOverlap, p.TileFormat = 254, 254, 1, "png"
+		b := newFakeBackend(inFile, fakeImage{width: 1000, height: 600, channels: "srgb", depth: 8})
+		b.realLevels = true
+		out, err := NewWithBackend(b).Convert(p)
+		assert.Nil(t, err, "Convert")
+		assert.NotContains(t, b.calls, "BuildPyramid", "no pyramidal TIFF")
+		assert.FileExists(t, p.OutFile)
+		assert.FileExists(t, filepath.Join(tempDir, "dzi", "out_files", "10", "3_2.png"))
+		assert.FileExists(t, filepath.Join(tempDir, "dzi", "out_files", "0", "0_0.png"))
+		if assert.NotNil(t, out) {
+			assert.Equal(t, "deflate", out.Compression.String(), "compression")
+		}
+	})
+
+	t.Run("Zoomify", func(t *testing.T) {
+		p := params
+		p.OutputFormat, p.OutFile = "zoomify", filepath.Join(tempDir, "zoomify")
+		b := newFakeBackend(inFile, fakeImage{width: 1000, height: 600, channels: "srgb", depth: 8})
+		b.realLevels = true
+		out, err := NewWithBackend(b).Convert(p)
+		assert.Nil(t, err, "Convert")
+		assert.FileExists(t, filepath.Join(p.OutFile, "ImageProperties.xml"))
+		assert.FileExists(t, filepath.Join(p.OutFile, "TileGroup0", "2-3-2.jpg"))
+		if assert.NotNil(t, out) {
+			assert.Equal(t, 1+2*2+4*3, out.TileCount, "tile count")
+		}
+	})
+
+	t.Run("NoID", func(t *testing.T) {
+		p := params
+		p.IIIFID = ""
+		_, err := NewWithBackend(newFakeBackend(inFile, fakeImage{})).Convert(p)
+		assert.True(t, errors.Is(err, ErrInvalidParams), "got %v", err)
+	})
+
+	t.Run("KeepHighBitDepth", func(t *testing.T) {
+		p := params
+		p.HighBitDepth = "keep"
+		_, err := NewWithBackend(newFakeBackend(inFile, fakeImage{})).Convert(p)
+		assert.True(t, errors.Is(err, ErrInvalidParams), "got %v", err)
+	})
+}
+
+func TestLevelOrder(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "go-pyramid-agent-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	inFile := "/images/in.tif"
+	params := input.Params{InFile: inFile, OutFile: "/images/out.tif", TempDir: tempDir, DeleteTemp: true}
+	levelNames := func(files []string) []string {
+		var names []string
+		for _, f := range files {
+			names = append(names, filepath.Base(f))
+		}
+		return names
+	}
+
+	t.Run("ElevenLevels", func(t *testing.T) {
+		// 200000 halved 10 times is 195, the last level of at least 128 pixels.
+		b := newFakeBackend(inFile, fakeImage{width: 200000, height: 100000, channels: "srgb", depth: 8})
+		out, err := NewWithBackend(b).Convert(params)
+		assert.Nil(t, err, "Convert")
+		assert.Equal(t, 11, len(out.Levels), "levels")
+		if assert.Equal(t, 1, len(b.pyramids), "BuildPyramid calls") {
+			var want []string
+			for i := 0; i < 11; i++ {
+				want = append(want, fmt.Sprintf("in_%d.tif", i))
+			}
+			assert.Equal(t, want, levelNames(b.pyramids[0]), "levels in order of decreasing size")
+		}
+	})
+
+	t.Run("StaleFiles", func(t *testing.T) {
+		b := newFakeBackend(inFile, fakeImage{width: 1000, height: 600, channels: "srgb", depth: 8})
+		p := params
+		p.Progress = func(e progress.Event) {
+			// Leave the levels of a larger image in the work dir.
+			if e.Stage == progress.StageToTIFF && e.Phase == progress.PhaseStart {
+				for i := 3; i < 12; i++ {
+					ioutil.WriteFile(filepath.Join(filepath.Dir(e.OutFile), fmt.Sprintf("in_%d.tif", i)), nil, 0600)
+				}
+			}
+		}
+		_, err := NewWithBackend(b).Convert(p)
+		assert.Nil(t, err, "Convert")
+		if assert.Equal(t, 1, len(b.pyramids), "BuildPyramid calls") {
+			assert.Equal(t, []string{"in_0.tif", "in_1.tif", "in_2.tif"}, levelNames(b.pyramids[0]), "only the levels made for this image")
+		}
+	})
+}
+
+func TestMetadata(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "go-pyramid-agent-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	inFile := "/images/in.tif"
+	params := input.Params{InFile: inFile, OutFile: filepath.Join(tempDir, "out.tif"), TempDir: tempDir, Metadata: "all"}
+	rgb := fakeImage{width: 1000, height: 600, channels: "srgb", depth: 8}
+	convert := func(p input.Params) (*fakeBackend, error) {
+		b := newFakeBackend(inFile, rgb)
+		b.realLevels = true
+		_, err := NewWithBackend(b).Convert(p)
+		return b, err
+	}
+
+	t.Run("All", func(t *testing.T) {
+		b, err := convert(params)
+		assert.Nil(t, err, "Convert")
+		assert.Equal(t, "CopyMetadata", b.calls[len(b.calls)-1], "metadata copied last")
+		assert.Equal(t, []string{"EXIF:all", "XMP:all", "IPTC:all"}, b.metadataTags, "tags")
+	})
+
+	t.Run("Allowlist", func(t *testing.T) {
+		p := params
+		p.Metadata, p.MetadataTags = "allowlist", []string{"EXIF:DateTimeOriginal", "XMP-dc:Rights"}
+		b, err := convert(p)
+		assert.Nil(t, err, "Convert")
+		assert.Equal(t, p.MetadataTags, b.metadataTags, "tags")
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		p := params
+		p.Metadata = ""
+		b, err := convert(p)
+		assert.Nil(t, err, "Convert")
+		assert.NotContains(t, b.calls, "CopyMetadata", "nothing copied by default")
+	})
+
+	t.Run("Invalidated", func(t *testing.T) {
+		p := params
+		p.Progress = func(e progress.Event) {
+			// Stand in for exiftool rewriting the pyramid as a plain TIFF.
+			if e.Stage == progress.StageMetadata && e.Phase == progress.PhaseFinish {
+				writeGrayTIFF(e.OutFile, 1000, 600)
+			}
+		}
+		_, err := convert(p)
+		if assert.NotNil(t, err, "Convert") {
+			assert.Contains(t, err.Error(), "no longer valid", "error")
+		}
+	})
+
+	t.Run("Tags", func(t *testing.T) {
+		p := params
+		p.Metadata = ""
+		p.Tags = exiftool.TagsInput{
+			CopyrightNotice: "Public domain",
+			ImageCredit:     "Institute of Paragon of Aesthetics",
+			CopyrightStatus: "False",
+		}
+		b := newFakeBackend(inFile, rgb)
+		b.realLevels = true
+		out, err := NewWithBackend(b).Convert(p)
+		assert.Nil(t, err, "Convert")
+		assert.NotContains(t, b.calls, "CopyMetadata", "input metadata dropped")
+		if assert.NotNil(t, out) {
+			assert.Equal(t, []output.Tag{
+				{Name: "MWG:copyright", Value: "Public domain"},
+				{Name: "XMP-photoshop:Credit", Value: "Institute of Paragon of Aesthetics"},
+				{Name: "IPTC:Credit", Value: "Institute of Paragon of Aestheti"},
+				{Name: "XMP-xmpRights:marked", Value: "False"},
+			}, out.Tags, "tags read back")
+			assert.Equal(t, []string{"IPTC:Credit cut to 32 characters"}, out.TagWarnings, "warnings")
+		}
+	})
+
+	t.Run("TagsAfterMetadata", func(t *testing.T) {
+		p := params
+		p.Tags = exiftool.TagsInput{Source: "Museum of Compassion"}
+		b, err := convert(p)
+		assert.Nil(t, err, "Convert")
+		assert.Equal(t, []string{"CopyMetadata", "WriteTags", "ReadTags"}, b.calls[len(b.calls)-3:], "calls")
+	})
+
+	t.Run("TagMissing", func(t *testing.T) {
+		p := params
+		p.Tags = exiftool.TagsInput{Source: "Museum of Compassion"}
+		b := newFakeBackend(inFile, rgb)
+		b.realLevels = true
+		b.ignoreTags = map[string]bool{"iptc:source": true}
+		_, err := NewWithBackend(b).Convert(p)
+		if assert.NotNil(t, err, "Convert") {
+			assert.Contains(t, err.Error(), "iptc:source missing", "error")
+		}
+	})
+
+	t.Run("BigTIFF", func(t *testing.T) {
+		b := newFakeBackend(inFile, fakeImage{width: 60000, height: 40000, channels: "srgb", depth: 8})
+		_, err := NewWithBackend(b).Convert(params)
+		assert.True(t, errors.Is(err, ErrUnsupportedImage), "got %v", err)
+		assert.NotContains(t, b.calls, "BuildPyramid", "fails before building the pyramid")
+	})
+
+	t.Run("TileOutput", func(t *testing.T) {
+		p := params
+		p.OutputFormat, p.OutFile = "zoomify", filepath.Join(tempDir, "zoomify")
+		_, err := NewWithBackend(newFakeBackend(inFile, rgb)).Convert(p)
+		assert.True(t, errors.Is(err, ErrInvalidParams), "got %v", err)
+	})
+}
+
+func TestCMYKProfile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "go-pyramid-agent-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	defaultProfile := config.DefaultCMYKICCProfile
+	config.DefaultCMYKICCProfile = "/profiles/swop.icc"
+	defer func() { config.DefaultCMYKICCProfile = defaultProfile }()
+
+	// A profile that is not a CMYK one is no use for a CMYK image.
+	adobeTIFF := fromRoot("test/resources/images/grayscale-with-adobe-rgb-1998.tif")
+	tests := []struct {
+		name        string
+		inFile      string
+		image       fakeImage
+		cmykProfile string
+	}{
+		{"Embedded", "/images/in.tif", fakeImage{channels: "cmyk", profile: "Coated FOGRA39"}, ""},
+		{"NoProfile", "/images/in.tif", fakeImage{channels: "cmyk"}, "/profiles/swop.icc"},
+		{"RGBProfile", adobeTIFF, fakeImage{channels: "cmyka"}, "/profiles/swop.icc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := tt.image
+			img.width, img.height, img.depth = 1000, 600, 8
+			b := newFakeBackend(tt.inFile, img)
+			_, err := NewWithBackend(b).Convert(input.Params{
+				InFile:           tt.inFile,
+				OutFile:          filepath.Join(tempDir, "out.tif"),
+				TargetICCProfile: "target.icc",
+				TempDir:          tempDir,
+				DeleteTemp:       true,
+			})
+			assert.Nil(t, err, "Convert")
+			assert.Equal(t, "CMYKToRGB", b.calls[2], "operations")
+			assert.Equal(t, tt.cmykProfile, b.cmykProfile, "source profile")
+			assert.NotContains(t, b.calls, "ICCTransform", "operations")
+		})
+	}
+}
+
+func TestConcurrentConvert(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "go-pyramid-agent-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// The same base name in different directories used to share temp files.
+	inFiles := []string{"/a/0001.tif", "/b/0001.tif", "/c/0001.tif", "/d/0001.tif"}
+	b := newFakeBackend(inFiles[0], fakeImage{width: 1000, height: 600, channels: "srgb", depth: 8})
+	for _, f := range inFiles[1:] {
+		b.images[f] = b.images[inFiles[0]]
+	}
+	a := NewWithBackend(b)
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(inFiles)*4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = a.Convert(input.Params{
+				InFile:     inFiles[i%len(inFiles)],
+				OutFile:    fmt.Sprintf("/out/%d.tif", i),
+				TempDir:    tempDir,
+				DeleteTemp: true,
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		assert.Nil(t, err, "Convert %d", i)
+	}
+	assert.Equal(t, len(errs), len(b.pyramids), "number of pyramids")
+
+	dirs := map[string]bool{}
+	for _, levels := range b.pyramids {
+		assert.Equal(t, 3, len(levels), "levels of each pyramid")
+		dir := filepath.Dir(levels[0])
+		assert.False(t, dirs[dir], "work dir %s used by one job only", dir)
+		dirs[dir] = true
+		for _, level := range levels {
+			assert.Equal(t, dir, filepath.Dir(level), "all levels in the job's work dir")
+		}
+	}
+
+	entries, _ := ioutil.ReadDir(tempDir)
+	assert.Equal(t, 0, len(entries), "work dirs removed")
+}
+
+func TestConvertContext(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "go-pyramid-agent-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	inFile := "/images/0001.tif"
+	outFile := filepath.Join(tempDir, "out.tif")
+	rgb := fakeImage{width: 1000, height: 600, channels: "srgb", depth: 8}
+
+	t.Run("Timeout", func(t *testing.T) {
+		b := newFakeBackend(inFile, rgb)
+		b.block["BuildPyramid"] = true
+		a := NewWithBackend(b)
+
+		// An incomplete pyramid from the stuck builder.
+		ioutil.WriteFile(outFile, []byte("partial"), 0600)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := a.ConvertContext(ctx, input.Params{
+			InFile:  inFile,
+			OutFile: outFile,
+			TempDir: tempDir,
+		})
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), "deadline error, got %v", err)
+		assert.False(t, errors.Is(err, context.Canceled), "not a cancellation")
+		var stageErr *StageError
+		if assert.True(t, errors.As(err, &stageErr), "stage error") {
+			assert.Equal(t, progress.StageCombine, stageErr.Stage, "stage given up")
+		}
+
+		_, err = os.Stat(outFile)
+		assert.True(t, os.IsNotExist(err), "incomplete output removed")
+		entries, _ := ioutil.ReadDir(tempDir)
+		assert.Equal(t, 0, len(entries), "work dir removed without DeleteTemp")
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		b := newFakeBackend(inFile, rgb)
+		a := NewWithBackend(b)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := a.ConvertContext(ctx, input.Params{
+			InFile:  inFile,
+			OutFile: outFile,
+			TempDir: tempDir,
+		})
+		assert.True(t, errors.Is(err, context.Canceled), "canceled error, got %v", err)
+		assert.NotContains(t, b.calls, "BuildPyramid", "nothing built")
+	})
+
+	t.Run("OtherError", func(t *testing.T) {
+		b := newFakeBackend(inFile, rgb)
+		b.fail["Resize"] = fmt.Errorf("disk full")
+		a := NewWithBackend(b)
+
+		_, err := a.ConvertContext(context.Background(), input.Params{
+			InFile:  inFile,
+			OutFile: outFile,
+			TempDir: tempDir,
+		})
+		assert.NotNil(t, err, "Convert should fail")
+		assert.False(t, errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded), "not a context error")
+	})
+}
+
+func TestProgress(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "go-pyramid-agent-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	inFile := "/images/0001.tif"
+	b := newFakeBackend(inFile, fakeImage{width: 1000, height: 600, channels: "srgba", depth: 8, profile: "Adobe RGB (1998)"})
+	a := NewWithBackend(b)
+
+	var events []progress.Event
+	_, err = a.Convert(input.Params{
+		InFile:     inFile,
+		OutFile:    "/images/out.tif",
+		TempDir:    tempDir,
+		DeleteTemp: true,
+		Progress:   func(e progress.Event) { events = append(events, e) },
+	})
+	assert.Nil(t, err, "Convert")
+
+	type step struct {
+		stage progress.Stage
+		level int
+	}
+	want := []step{
+		{progress.StageToTIFF, 0},
+		{progress.StageProbe, 0},
+		{progress.StageRemoveAlpha, 0},
+		{progress.StageICCTransform, 0},
+		{progress.StageResize, 0},
+		{progress.StageResize, 1},
+		{progress.StageResize, 2},
+		{progress.StageCombine, 0},
+	}
+	if !assert.Equal(t, 2*len(want), len(events), "a start and a finish per stage") {
+		return
+	}
+	for i, w := range want {
+		start, finish := events[2*i], events[2*i+1]
+		assert.Equal(t, w.stage, start.Stage, "stage %d", i)
+		assert.Equal(t, progress.PhaseStart, start.Phase, "stage %d starts", i)
+		assert.Equal(t, w.stage, finish.Stage, "stage %d", i)
+		assert.Equal(t, progress.PhaseFinish, finish.Phase, "stage %d finishes", i)
+		assert.Equal(t, w.level, finish.Level, "level of stage %d", i)
+		assert.Equal(t, start.Start, finish.Start, "start time of stage %d", i)
+		assert.Nil(t, finish.Err, "error of stage %d", i)
+		if w.stage == progress.StageResize {
+			assert.Equal(t, 3, finish.Levels, "levels")
+		}
+	}
+	assert.Equal(t, []string{inFile}, events[0].InFiles, "input of toTIFF")
+	assert.Equal(t, events[1].OutFile, events[2].InFiles[0], "toTIFF output probed")
+	assert.Equal(t, 3, len(events[len(events)-1].InFiles), "levels combined")
+	assert.Equal(t, "/images/out.tif", events[len(events)-1].OutFile, "output of combine")
+
+	t.Run("Failure", func(t *testing.T) {
+		b := newFakeBackend(inFile, fakeImage{width: 1000, height: 600, channels: "srgb", depth: 8})
+		b.fail["Resize"] = fmt.Errorf("disk full")
+		a := NewWithBackend(b)
+
+		var events []progress.Event
+		a.Convert(input.Params{
+			InFile:   inFile,
+			OutFile:  "/images/out.tif",
+			TempDir:  tempDir,
+			Progress: func(e progress.Event) { events = append(events, e) },
+		})
+		last := events[len(events)-1]
+		assert.Equal(t, progress.StageResize, last.Stage, "last stage")
+		assert.Equal(t, progress.PhaseFinish, last.Phase, "last phase")
+		assert.NotNil(t, last.Err, "error reported")
+	})
+}
+
+func TestConvertErrors(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "go-pyramid-agent-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	inFile := "/images/0001.tif"
+	params := input.Params{InFile: inFile, OutFile: "/images/out.tif", TempDir: tempDir, DeleteTemp: true}
+	rgb := fakeImage{width: 1000, height: 600, channels: "srgb", depth: 8}
+
+	t.Run("InvalidParams", func(t *testing.T) {
+		p := params
+		p.TileWidth = 100
+		_, err := NewWithBackend(newFakeBackend(inFile, rgb)).Convert(p)
+		assert.True(t, errors.Is(err, ErrInvalidParams), "got %v", err)
+	})
+
+	t.Run("UnknownCodec", func(t *testing.T) {
+		p := params
+		p.Compression = "jp2"
+		b := newFakeBackend(inFile, rgb)
+		_, err := NewWithBackend(b).Convert(p)
+		assert.True(t, errors.Is(err, ErrInvalidParams), "got %v", err)
+		assert.Empty(t, b.calls, "rejected before any work")
+	})
+
+	t.Run("WebPGray", func(t *testing.T) {
+		// The ICC transform to the RGB target profile makes the image RGB.
+		gray := rgb
+		gray.channels, gray.profile = "gray", "Dot Gain 20%"
+		p := params
+		p.Compression = "webp"
+		b := newFakeBackend(inFile, gray)
+		_, err := NewWithBackend(b).Convert(p)
+		assert.Nil(t, err, "Convert")
+		assert.Contains(t, b.calls, "BuildPyramid", "pyramid built")
+	})
+
+	t.Run("WebPGrayLevels", func(t *testing.T) {
+		// The check goes by the levels handed to BuildPyramid as the
+		// backend probes them, whatever the image.
+		p := params
+		p.Compression = "webp"
+		b := newFakeBackend(inFile, rgb)
+		b.levelBands = 1
+		_, err := NewWithBackend(b).Convert(p)
+		assert.True(t, errors.Is(err, ErrUnsupportedImage), "got %v", err)
+		assert.NotContains(t, b.calls, "BuildPyramid", "no pyramid")
+	})
+
+	t.Run("BigTIFFGrayToRGB", func(t *testing.T) {
+		// 1.6 gigapixels: 2.1 GB as gray, 6.4 GB once RGB.
+		gray := fakeImage{width: 40000, height: 40000, channels: "gray", depth: 8, profile: "Dot Gain 20%"}
+		b := newFakeBackend(inFile, gray)
+		out, err := NewWithBackend(b).Convert(params)
+		assert.Nil(t, err, "Convert")
+		if assert.NotNil(t, out) {
+			assert.True(t, out.BigTIFF, "BigTIFF for the RGB pyramid")
+		}
+	})
+
+	t.Run("UnsupportedImage", func(t *testing.T) {
+		lab := rgb
+		lab.channels = "lab"
+		_, err := NewWithBackend(newFakeBackend(inFile, lab)).Convert(params)
+		assert.True(t, errors.Is(err, ErrUnsupportedImage), "got %v", err)
+		var stageErr *StageError
+		assert.False(t, errors.As(err, &stageErr), "not a stage error")
+	})
+
+	t.Run("ToolFailed", func(t *testing.T) {
+		b := newFakeBackend(inFile, rgb)
+		b.fail["Resize"] = &util.ExecError{
+			Command:  "vipsthumbnail",
+			ExitCode: 1,
+			Stderr:   "VipsJpeg: Premature end of JPEG file",
+			Err:      fmt.Errorf("exit status 1"),
+		}
+		_, err := NewWithBackend(b).Convert(params)
+
+		var stageErr *StageError
+		if !errors.As(err, &stageErr) {
+			t.Fatalf("not a *StageError - %v", err)
+		}
+		assert.Equal(t, progress.StageResize, stageErr.Stage, "stage")
+		assert.Equal(t, "vipsthumbnail", stageErr.Tool, "tool")
+		assert.Equal(t, 1, stageErr.ExitCode, "exit code")
+		assert.Equal(t, "VipsJpeg: Premature end of JPEG file", stageErr.Stderr, "stderr")
+		assert.Equal(t, stageErr.Stderr, util.GetStderr(err), "GetStderr")
+		assert.False(t, errors.Is(err, ErrCorruptInput), "resize of a converted file is not corrupt input")
+		assert.False(t, errors.Is(err, ErrNoSpace), "not ErrNoSpace")
+	})
+
+	t.Run("CorruptInput", func(t *testing.T) {
+		b := newFakeBackend(inFile, rgb)
+		b.fail["ToTIFF"] = &util.ExecError{
+			Command:  "vips",
+			ExitCode: 1,
+			Stderr:   "VipsJpeg: Premature end of JPEG file",
+			Err:      fmt.Errorf("exit status 1"),
+		}
+		_, err := NewWithBackend(b).Convert(params)
+		assert.True(t, errors.Is(err, ErrCorruptInput), "ErrCorruptInput - %v", err)
+		assert.False(t, errors.Is(err, ErrNoSpace), "not ErrNoSpace")
+
+		var stageErr *StageError
+		assert.True(t, errors.As(err, &stageErr), "still a *StageError")
+	})
+
+	t.Run("NoSpace", func(t *testing.T) {
+		b := newFakeBackend(inFile, rgb)
+		b.fail["Resize"] = &util.ExecError{
+			Command:  "vipsthumbnail",
+			ExitCode: 1,
+			Stderr:   "TIFFAppendToStrip: Write error at scanline 120: No space left on device",
+			Err:      fmt.Errorf("exit status 1"),
+		}
+		_, err := NewWithBackend(b).Convert(params)
+		assert.True(t, errors.Is(err, ErrNoSpace), "ErrNoSpace from stderr - %v", err)
+		assert.False(t, errors.Is(err, ErrCorruptInput), "not ErrCorruptInput")
+
+		b = newFakeBackend(inFile, rgb)
+		b.fail["Resize"] = &os.PathError{Op: "write", Path: "out.tif", Err: syscall.ENOSPC}
+		_, err = NewWithBackend(b).Convert(params)
+		assert.True(t, errors.Is(err, ErrNoSpace), "ErrNoSpace from ENOSPC - %v", err)
+	})
+
+	t.Run("ToolNotFound", func(t *testing.T) {
+		b := newFakeBackend(inFile, rgb)
+		b.fail["ToTIFF"] = &util.ExecError{
+			Command:  "/usr/local/bin/vips",
+			ExitCode: -1,
+			Err:      fmt.Errorf("%w - no such file or directory", util.ErrToolNotFound),
+		}
+		_, err := NewWithBackend(b).Convert(params)
+		assert.True(t, errors.Is(err, util.ErrToolNotFound), "got %v", err)
+
+		var stageErr *StageError
+		if assert.True(t, errors.As(err, &stageErr), "stage error") {
+			assert.Equal(t, progress.StageToTIFF, stageErr.Stage, "stage")
+			assert.Equal(t, -1, stageErr.ExitCode, "exit code")
+		}
+	})
+
+	t.Run("NativeBuilder", func(t *testing.T) {
+		// The native builder reads the levels, which the fake backend
+		// leaves empty.
+		p := params
+		p.PyramidBuilder = "native"
+		p.OutFile = filepath.Join(tempDir, "out.tif")
+		_, err := NewWithBackend(newFakeBackend(inFile, rgb)).Convert(p)
+
+		var stageErr *StageError
+		if assert.True(t, errors.As(err, &stageErr), "stage error") {
+			assert.Equal(t, progress.StageCombine, stageErr.Stage, "stage")
+			assert.Equal(t, "", stageErr.Tool, "no tool")
+		}
+	})
+
+	t.Run("UnknownBuilder", func(t *testing.T) {
+		// Convert validates the builder first; combineSubImages must not
+		// report success to callers that do not.
+		p := params
+		p.PyramidBuilder = "bogus"
+		b := newFakeBackend(inFile, rgb)
+		err := NewWithBackend(b).combineSubImages(context.Background(), pcontext.New(p), []string{"level0.tif"})
+		assert.True(t, errors.Is(err, ErrInvalidParams), "got %v", err)
+		assert.NotContains(t, b.calls, "BuildPyramid", "no pyramid")
+	})
+}
+
 func fromRoot(relPath string) string {
 	return fmt.Sprintf("../../%s", relPath)
 }
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/gigamorph/go-pyramid/pyramid/progress"
+	"github.com/gigamorph/go-pyramid/util"
+)
+
+// Errors wrapped by the errors of Convert, to be tested with errors.Is.
+// ErrNoSpace and ErrCorruptInput are recognised from the failure of a
+// stage. Besides these, a failed stage is reported as a *StageError, a missing
+// program wraps util.ErrToolNotFound and a conversion given up by
+// ConvertContext wraps context.Canceled or context.DeadlineExceeded.
+var (
+	// ErrInvalidParams means input.Params are invalid or inconsistent.
+	ErrInvalidParams = errors.New("invalid parameters")
+
+	// ErrUnsupportedImage means the image is of a kind that cannot be
+	// converted, e.g. its colour model is not supported.
+	ErrUnsupportedImage = errors.New("unsupported image")
+
+	// ErrNoSpace means a stage failed because the disk is full.
+	ErrNoSpace = errors.New("no space left on device")
+
+	// ErrCorruptInput means the input file could not be decoded, e.g. it
+	// is truncated or not an image.
+	ErrCorruptInput = errors.New("corrupt input")
+)
+
+// Messages of the tools that tell the causes apart, in lower case.
+var (
+	noSpaceMessages = []string{"no space left on device", "disk full", "not enough space"}
+	corruptMessages = []string{
+		"premature end", "corrupt", "truncated", "unexpected end of file",
+		"not a known file format", "not a tiff", "not a jpeg file", "improper image header",
+	}
+)
+
+// StageError reports the failure of a stage of the conversion,
+// to be retrieved with errors.As.
+type StageError struct {
+	Stage    progress.Stage
+	Tool     string // program that failed, "" if none was run
+	ExitCode int    // exit status of Tool, -1 if it did not exit on its own or none was run
+	Stderr   string // what Tool printed to stderr
+	Err      error
+	cause    error // ErrNoSpace or ErrCorruptInput, if recognised
+}
+
+func newStageError(stage progress.Stage, err error) *StageError {
+	e := &StageError{Stage: stage, ExitCode: -1, Err: err}
+	var execErr *util.ExecError
+	if errors.As(err, &execErr) {
+		e.Tool = execErr.Command
+		e.ExitCode = execErr.ExitCode
+		e.Stderr = util.GetStderr(execErr)
+	}
+	e.cause = cause(stage, err, strings.ToLower(e.Stderr))
+	return e
+}
+
+// cause recognises ErrNoSpace from err or stderr, and ErrCorruptInput from
+// what the tool reading the input printed to stderr.
+func cause(stage progress.Stage, err error, stderr string) error {
+	if errors.Is(err, syscall.ENOSPC) || containsAny(stderr, noSpaceMessages) {
+		return ErrNoSpace
+	}
+	if (stage == progress.StageToTIFF || stage == progress.StageProbe) && containsAny(stderr, corruptMessages) {
+		return ErrCorruptInput
+	}
+	return nil
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Is tells errors.Is that e is ErrNoSpace or ErrCorruptInput when the
+// failure shows that cause.
+func (e *StageError) Is(target error) bool {
+	return e.cause != nil && target == e.cause
+}
@@ -0,0 +1,300 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/gigamorph/go-pyramid/pyramid/backend"
+	"github.com/gigamorph/go-pyramid/pyramid/ptiff"
+	"github.com/gigamorph/go-pyramid/shellcmds/exiftool"
+)
+
+// fakeImage is what fakeBackend knows about a "file".
+type fakeImage struct {
+	width    uint
+	height   uint
+	channels string
+	depth    uint
+	profile  string
+	bands    uint // samples per pixel as Probe reports them, 0 if unknown
+}
+
+// fakeBackend is an in-memory backend.Backend that records the operations
+// performed on it. Resize also creates an empty file on disk so that the
+// levels can be found in the temp dir, or an 8-bit gray TIFF of the new
+// size if realLevels is set, in which case BuildPyramid also writes the
+// pyramid.
+type fakeBackend struct {
+	mu           sync.Mutex
+	images       map[string]fakeImage
+	calls        []string
+	pyramids     [][]string // inputs of every BuildPyramid call
+	pyramidOpts  backend.PyramidOptions
+	cmykProfile  string // source profile passed to CMYKToRGB
+	resizes      []fakeResize
+	fail         map[string]error // operation name -> error to return
+	block        map[string]bool  // operations that wait until ctx is done
+	realLevels   bool
+	levelBands   uint              // bands of the levels made by Resize, 0 if unknown
+	metadataTags []string          // tags passed to CopyMetadata
+	tags         map[string]string // tags written by WriteTags, cut to their length limit
+	ignoreTags   map[string]bool   // tags WriteTags does not write
+}
+
+// fakeResize records the arguments of a Resize call.
+type fakeResize struct {
+	inFile string
+	opts   backend.ResizeOptions
+}
+
+func newFakeBackend(inFile string, img fakeImage) *fakeBackend {
+	return &fakeBackend{
+		images: map[string]fakeImage{inFile: img},
+		fail:   map[string]error{},
+		block:  map[string]bool{},
+		tags:   map[string]string{},
+	}
+}
+
+func (b *fakeBackend) record(op string) error {
+	b.calls = append(b.calls, op)
+	return b.fail[op]
+}
+
+// wait blocks until ctx is done if op is to block.
+func (b *fakeBackend) wait(ctx context.Context, op string) error {
+	b.mu.Lock()
+	block := b.block[op]
+	b.mu.Unlock()
+	if block {
+		<-ctx.Done()
+	}
+	return ctx.Err()
+}
+
+func (b *fakeBackend) derive(ctx context.Context, op, inFile, outFile string, f func(img *fakeImage)) error {
+	if err := b.wait(ctx, op); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.record(op); err != nil {
+		return err
+	}
+	img, ok := b.images[inFile]
+	if !ok {
+		return fmt.Errorf("fakeBackend#%s no such file %s", op, inFile)
+	}
+	if f != nil {
+		f(&img)
+	}
+	b.images[outFile] = img
+	return nil
+}
+
+func (b *fakeBackend) Probe(ctx context.Context, file string, imTempDir *string) (*backend.ImageInfo, error) {
+	if err := b.wait(ctx, "Probe"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.record("Probe"); err != nil {
+		return nil, err
+	}
+	img, ok := b.images[file]
+	if !ok {
+		return nil, fmt.Errorf("fakeBackend#Probe no such file %s", file)
+	}
+	return &backend.ImageInfo{
+		Format:         "TIFF",
+		Width:          img.width,
+		Height:         img.height,
+		Channels:       img.channels,
+		BitDepth:       img.depth,
+		ICCProfileName: img.profile,
+		Bands:          img.bands,
+	}, nil
+}
+
+func (b *fakeBackend) ToTIFF(ctx context.Context, inFile, outFile string) error {
+	return b.derive(ctx, "ToTIFF", inFile, outFile, nil)
+}
+
+func (b *fakeBackend) RemoveAlpha(ctx context.Context, inFile, outFile string) error {
+	return b.derive(ctx, "RemoveAlpha", inFile, outFile, func(img *fakeImage) {
+		img.channels = "srgb"
+	})
+}
+
+func (b *fakeBackend) RemoveAlphaFromGraya(ctx context.Context, inFile, outFile string) error {
+	return b.derive(ctx, "RemoveAlphaFromGraya", inFile, outFile, func(img *fakeImage) {
+		img.channels = "gray"
+	})
+}
+
+func (b *fakeBackend) ReduceDepth(ctx context.Context, inFile, outFile string, dither bool) error {
+	return b.derive(ctx, "ReduceDepth", inFile, outFile, func(img *fakeImage) {
+		img.depth = 8
+	})
+}
+
+func (b *fakeBackend) CMYKToRGB(ctx context.Context, inFile, outFile, cmykProfile, iccProfile string, depth uint) error {
+	return b.derive(ctx, "CMYKToRGB", inFile, outFile, func(img *fakeImage) {
+		b.cmykProfile = cmykProfile
+		img.channels = "srgb" + strings.TrimPrefix(img.channels, "cmyk")
+		img.profile = iccProfile
+	})
+}
+
+func (b *fakeBackend) FixGray(ctx context.Context, inFile, outFile string, width, height uint) error {
+	return b.derive(ctx, "FixGray", inFile, outFile, func(img *fakeImage) {
+		img.channels = "srgb"
+		img.profile = "sRGB IEC61966-2.1"
+	})
+}
+
+func (b *fakeBackend) GrayToSRGB(ctx context.Context, inFile, outFile string) error {
+	return b.derive(ctx, "GrayToSRGB", inFile, outFile, func(img *fakeImage) {
+		img.channels = "srgb"
+		img.profile = "sRGB IEC61966-2.1"
+	})
+}
+
+func (b *fakeBackend) ICCTransform(ctx context.Context, inFile, outFile, iccProfile string, depth uint) error {
+	return b.derive(ctx, "ICCTransform", inFile, outFile, func(img *fakeImage) {
+		img.profile = iccProfile
+		if img.channels == "gray" {
+			img.channels = "srgb" // target profiles are RGB
+		}
+	})
+}
+
+func (b *fakeBackend) Resize(ctx context.Context, inFile, outFile string, width, height uint, opts backend.ResizeOptions) error {
+	err := b.derive(ctx, "Resize", inFile, outFile, func(img *fakeImage) {
+		b.resizes = append(b.resizes, fakeResize{inFile, opts})
+		img.width = width
+		img.height = height
+		img.bands = b.levelBands
+	})
+	if err != nil {
+		return err
+	}
+	if b.realLevels {
+		return writeGrayTIFF(outFile, int(width), int(height))
+	}
+	return ioutil.WriteFile(outFile, nil, 0600)
+}
+
+// writeGrayTIFF writes an uncompressed 8-bit gray TIFF of w x h pixels
+// in one strip.
+func writeGrayTIFF(path string, w, h int) error {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.WriteString("II")
+	binary.Write(&buf, le, uint16(42))
+	binary.Write(&buf, le, uint32(8+w*h))
+	buf.Write(make([]byte, w*h))
+
+	entries := [][3]uint32{ // tag, type (3 SHORT, 4 LONG), value
+		{uint32(ptiff.TagImageWidth), 4, uint32(w)},
+		{uint32(ptiff.TagImageLength), 4, uint32(h)},
+		{uint32(ptiff.TagBitsPerSample), 3, 8},
+		{uint32(ptiff.TagCompression), 3, uint32(ptiff.CompressionNone)},
+		{uint32(ptiff.TagPhotometricInterpretation), 3, uint32(ptiff.PhotometricMinIsBlack)},
+		{uint32(ptiff.TagStripOffsets), 4, 8},
+		{uint32(ptiff.TagSamplesPerPixel), 3, 1},
+		{uint32(ptiff.TagRowsPerStrip), 4, uint32(h)},
+		{uint32(ptiff.TagStripByteCounts), 4, uint32(w * h)},
+	}
+	binary.Write(&buf, le, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(&buf, le, uint16(e[0]))
+		binary.Write(&buf, le, uint16(e[1]))
+		binary.Write(&buf, le, uint32(1))
+		if e[1] == 3 {
+			binary.Write(&buf, le, uint16(e[2]))
+			binary.Write(&buf, le, uint16(0))
+		} else {
+			binary.Write(&buf, le, e[2])
+		}
+	}
+	binary.Write(&buf, le, uint32(0))
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+func (b *fakeBackend) BuildPyramid(ctx context.Context, inFiles []string, outFile string, opts backend.PyramidOptions) error {
+	if err := b.wait(ctx, "BuildPyramid"); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.record("BuildPyramid"); err != nil {
+		return err
+	}
+	b.pyramids = append(b.pyramids, inFiles)
+	b.pyramidOpts = opts
+	if b.realLevels {
+		return ptiff.BuildPyramid(inFiles, outFile, ptiff.Options{
+			TileWidth:  int(opts.TileWidth),
+			TileHeight: int(opts.TileHeight),
+		})
+	}
+	return nil
+}
+
+func (b *fakeBackend) CopyMetadata(ctx context.Context, srcFile, dstFile string, tags []string) error {
+	if err := b.wait(ctx, "CopyMetadata"); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.record("CopyMetadata"); err != nil {
+		return err
+	}
+	b.metadataTags = tags
+	return nil
+}
+
+func (b *fakeBackend) WriteTags(ctx context.Context, file string, tags exiftool.TagsInput) error {
+	if err := b.wait(ctx, "WriteTags"); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.record("WriteTags"); err != nil {
+		return err
+	}
+	for _, a := range tags.Assignments() {
+		value := a.Value
+		if a.MaxLen > 0 && len(value) > a.MaxLen {
+			value = value[:a.MaxLen]
+		}
+		if !b.ignoreTags[a.ReadTag()] {
+			b.tags[a.ReadTag()] = value
+		}
+	}
+	return nil
+}
+
+func (b *fakeBackend) ReadTags(ctx context.Context, file string, tags []string) (map[string]string, error) {
+	if err := b.wait(ctx, "ReadTags"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.record("ReadTags"); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for _, tag := range tags {
+		if value, ok := b.tags[tag]; ok {
+			values[tag] = value
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,107 @@
+// Package backend defines the image operations the agent relies on,
+// so that the tools performing them can be replaced.
+package backend
+
+import (
+	"context"
+
+	"github.com/gigamorph/go-pyramid/pyramid/compression"
+	"github.com/gigamorph/go-pyramid/shellcmds/exiftool"
+)
+
+// ImageInfo holds what Probe finds out about an image.
+//
+// The fields after ICCProfileName are only known when the header was read
+// natively (see the Probe function); otherwise they are zero.
+type ImageInfo struct {
+	Format         string // e.g. "TIFF", "JPEG"
+	Width          uint
+	Height         uint
+	Channels       string // channels as reported by ImageMagick, e.g. "srgb", "graya"
+	BitDepth       uint   // bits per sample, e.g. 8, 16
+	ICCProfileName string // description of the embedded ICC profile, "" if none
+
+	Bands          uint    // samples per pixel, including alpha
+	SampleFormat   string  // "uint", "int" or "float"
+	Photometric    string  // "gray", "rgb", "palette", "cmyk", "ycbcr", "lab" or "other"
+	Pages          uint    // number of images in the file, not counting reduced-resolution ones
+	Orientation    uint    // TIFF/EXIF orientation, 1 (top-left) if not specified
+	XResolution    float64 // pixels per ResolutionUnit, 0 if not specified
+	YResolution    float64
+	ResolutionUnit string // "inch", "cm" or "" if not specified
+	ICCProfile     []byte // embedded ICC profile, nil if none
+}
+
+// PyramidOptions controls how BuildPyramid assembles the levels.
+type PyramidOptions struct {
+	Compression compression.Option
+	TileWidth   uint
+	TileHeight  uint
+	BigTIFF     bool
+}
+
+// ResizeOptions controls how Resize resamples. The zero value leaves the
+// choice to the backend.
+type ResizeOptions struct {
+	Kernel      string  // "nearest", "linear", "cubic" or "lanczos3", "" for the backend default
+	LinearLight bool    // resample in linear light rather than in gamma-encoded values
+	Sharpen     float64 // sigma of the sharpening applied after resizing, 0 for none
+}
+
+// Backend performs the image operations needed to build a pyramid.
+//
+// File arguments are plain paths; implementations add whatever
+// tool-specific suffixes they need (e.g. "[0]" to select the first page).
+// Every operation stops when ctx is done and then returns an error that
+// wraps ctx.Err().
+type Backend interface {
+	// Probe returns information about the first image in file.
+	Probe(ctx context.Context, file string, imTempDir *string) (*ImageInfo, error)
+
+	// ToTIFF converts the first image of inFile to a single-image TIFF.
+	ToTIFF(ctx context.Context, inFile, outFile string) error
+
+	// RemoveAlpha strips the alpha channel from an RGBA image.
+	RemoveAlpha(ctx context.Context, inFile, outFile string) error
+
+	// RemoveAlphaFromGraya strips the alpha channel from a gray+alpha image.
+	RemoveAlphaFromGraya(ctx context.Context, inFile, outFile string) error
+
+	// ReduceDepth scales the samples of inFile to 8 bits, optionally with
+	// dithering.
+	ReduceDepth(ctx context.Context, inFile, outFile string, dither bool) error
+
+	// CMYKToRGB converts a CMYK or CMYK+alpha image to iccProfile, keeping
+	// the alpha channel. The embedded profile is used as the source profile
+	// unless cmykProfile, the path to another one, is given. depth is the
+	// number of bits per sample of outFile, 8 or 16.
+	CMYKToRGB(ctx context.Context, inFile, outFile, cmykProfile, iccProfile string, depth uint) error
+
+	// FixGray converts a gray image without a usable profile to the target profile.
+	FixGray(ctx context.Context, inFile, outFile string, width, height uint) error
+
+	// GrayToSRGB converts a gray image with an RGB profile to sRGB.
+	GrayToSRGB(ctx context.Context, inFile, outFile string) error
+
+	// ICCTransform converts inFile from its embedded profile to iccProfile.
+	// depth is the number of bits per sample of outFile, 8 or 16.
+	ICCTransform(ctx context.Context, inFile, outFile, iccProfile string, depth uint) error
+
+	// Resize scales inFile to exactly width x height.
+	Resize(ctx context.Context, inFile, outFile string, width, height uint, opts ResizeOptions) error
+
+	// BuildPyramid combines the levels in inFiles, largest first,
+	// into a tiled multi-resolution TIFF.
+	BuildPyramid(ctx context.Context, inFiles []string, outFile string, opts PyramidOptions) error
+
+	// CopyMetadata copies tags, exiftool tag names such as "EXIF:Artist"
+	// or "XMP:all", from srcFile to dstFile, rewriting dstFile in place.
+	CopyMetadata(ctx context.Context, srcFile, dstFile string, tags []string) error
+
+	// WriteTags writes the rights metadata in tags into file in place.
+	WriteTags(ctx context.Context, file string, tags exiftool.TagsInput) error
+
+	// ReadTags reads the values of tags, exiftool tag names, from file.
+	// Tags file does not have are left out of the map.
+	ReadTags(ctx context.Context, file string, tags []string) (map[string]string, error)
+}
@@ -0,0 +1,365 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/gigamorph/go-pyramid/pyramid/icc"
+	"github.com/gigamorph/go-pyramid/pyramid/ptiff"
+)
+
+// ErrUnknownFormat is returned by Probe for files whose header it cannot
+// read, i.e. anything but TIFF, JPEG and PNG.
+var ErrUnknownFormat = errors.New("unknown image format")
+
+// Probe reads the header of the TIFF, JPEG or PNG file at path without
+// running any program. Only the first image of a multi-page file is
+// described.
+func Probe(path string) (*ImageInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("backend.Probe failed to open %s - %w", path, err)
+	}
+	defer f.Close()
+
+	var magic [8]byte
+	n, _ := io.ReadFull(f, magic[:])
+	m := magic[:n]
+
+	var info *ImageInfo
+	switch {
+	case bytes.HasPrefix(m, []byte{0xff, 0xd8}):
+		info, err = probeJPEG(f)
+	case bytes.HasPrefix(m, []byte("\x89PNG\r\n\x1a\n")):
+		info, err = probePNG(f)
+	case bytes.HasPrefix(m, []byte("II")) || bytes.HasPrefix(m, []byte("MM")):
+		info, err = probeTIFF(f)
+	default:
+		return nil, ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, fmt.Errorf("backend.Probe %s - %w", path, err)
+	}
+
+	if info.ICCProfile != nil {
+		if p, err := icc.Parse(info.ICCProfile); err == nil {
+			info.ICCProfileName, _ = p.Description()
+		}
+	}
+	info.Channels = channelsName(info.Photometric, info.Bands)
+	return info, nil
+}
+
+// channelsName returns the ImageMagick name of the channels of an image,
+// e.g. "srgb" or "graya".
+func channelsName(photometric string, bands uint) string {
+	var name string
+	var colorBands uint
+	switch photometric {
+	case "gray":
+		name, colorBands = "gray", 1
+	case "palette":
+		name, colorBands = "srgb", 1
+	case "rgb", "ycbcr":
+		name, colorBands = "srgb", 3
+	case "cmyk":
+		name, colorBands = "cmyk", 4
+	case "lab":
+		name, colorBands = "lab", 3
+	default:
+		return photometric
+	}
+	if bands > colorBands {
+		name += "a"
+	}
+	return name
+}
+
+func probeTIFF(r io.ReaderAt) (*ImageInfo, error) {
+	f, err := ptiff.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.IFDs) == 0 {
+		return nil, fmt.Errorf("no image")
+	}
+	info := &ImageInfo{Format: "TIFF"}
+	for _, d := range f.IFDs {
+		if d.UintOr(ptiff.TagNewSubfileType, 0)&uint64(ptiff.SubfileReducedImage) == 0 {
+			info.Pages++
+		}
+	}
+
+	d := f.IFDs[0]
+	info.Width = uint(d.UintOr(ptiff.TagImageWidth, 0))
+	info.Height = uint(d.UintOr(ptiff.TagImageLength, 0))
+	if info.Width == 0 || info.Height == 0 {
+		return nil, fmt.Errorf("invalid dimensions %dx%d", info.Width, info.Height)
+	}
+	info.Bands = uint(d.UintOr(ptiff.TagSamplesPerPixel, 1))
+	info.BitDepth = uint(d.UintOr(ptiff.TagBitsPerSample, 1))
+
+	switch uint16(d.UintOr(ptiff.TagSampleFormat, uint64(ptiff.SampleFormatUint))) {
+	case ptiff.SampleFormatInt:
+		info.SampleFormat = "int"
+	case ptiff.SampleFormatFloat:
+		info.SampleFormat = "float"
+	default:
+		info.SampleFormat = "uint"
+	}
+
+	switch d.UintOr(ptiff.TagPhotometricInterpretation, uint64(ptiff.PhotometricMinIsBlack)) {
+	case uint64(ptiff.PhotometricMinIsWhite), uint64(ptiff.PhotometricMinIsBlack):
+		info.Photometric = "gray"
+	case uint64(ptiff.PhotometricRGB):
+		info.Photometric = "rgb"
+	case 3:
+		info.Photometric = "palette"
+	case uint64(ptiff.PhotometricSeparated):
+		info.Photometric = "cmyk"
+	case uint64(ptiff.PhotometricYCbCr):
+		info.Photometric = "ycbcr"
+	case 8, 9, 10: // CIELab, ICCLab, ITULab
+		info.Photometric = "lab"
+	default:
+		info.Photometric = "other"
+	}
+
+	readTIFFOrientation(d, info)
+	info.ICCProfile = d.Bytes(ptiff.TagICCProfile)
+	return info, nil
+}
+
+// readTIFFOrientation sets the orientation and resolution of info from
+// the tags of d, which is a TIFF IFD or EXIF IFD0.
+func readTIFFOrientation(d *ptiff.IFD, info *ImageInfo) {
+	info.Orientation = uint(d.UintOr(ptiff.TagOrientation, 1))
+	if info.Orientation < 1 || info.Orientation > 8 {
+		info.Orientation = 1
+	}
+	xNum, xDen, xOK := d.Rational(ptiff.TagXResolution)
+	yNum, yDen, yOK := d.Rational(ptiff.TagYResolution)
+	if !xOK || !yOK || xDen == 0 || yDen == 0 {
+		return
+	}
+	switch d.UintOr(ptiff.TagResolutionUnit, 2) {
+	case 2:
+		info.ResolutionUnit = "inch"
+	case 3:
+		info.ResolutionUnit = "cm"
+	default:
+		return // only the aspect ratio is known
+	}
+	info.XResolution = float64(xNum) / float64(xDen)
+	info.YResolution = float64(yNum) / float64(yDen)
+}
+
+func probeJPEG(f *os.File) (*ImageInfo, error) {
+	if _, err := f.Seek(2, io.SeekStart); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	info := &ImageInfo{Format: "JPEG", Pages: 1, Orientation: 1, SampleFormat: "uint"}
+	adobeTransform := -1
+
+	for {
+		marker, err := nextMarker(br)
+		if err != nil {
+			return nil, err
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd8) {
+			continue // no payload
+		}
+		if marker == 0xd9 || marker == 0xda {
+			return nil, fmt.Errorf("no frame header")
+		}
+
+		var lb [2]byte
+		if _, err := io.ReadFull(br, lb[:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(lb[:])) - 2
+		if length < 0 {
+			return nil, fmt.Errorf("invalid segment length")
+		}
+		seg := make([]byte, length)
+		if _, err := io.ReadFull(br, seg); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case marker == 0xe0 && len(seg) >= 12 && string(seg[:5]) == "JFIF\x00":
+			if info.ResolutionUnit == "" { // EXIF takes precedence
+				readJFIFDensity(seg, info)
+			}
+		case marker == 0xe1 && len(seg) > 6 && string(seg[:6]) == "Exif\x00\x00":
+			if exif, err := ptiff.NewFile(bytes.NewReader(seg[6:])); err == nil && len(exif.IFDs) > 0 {
+				readTIFFOrientation(exif.IFDs[0], info)
+			}
+		case marker == 0xee && len(seg) >= 12 && string(seg[:5]) == "Adobe":
+			adobeTransform = int(seg[11])
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			if len(seg) < 6 {
+				return nil, fmt.Errorf("invalid frame header")
+			}
+			info.BitDepth = uint(seg[0])
+			info.Height = uint(binary.BigEndian.Uint16(seg[1:3]))
+			info.Width = uint(binary.BigEndian.Uint16(seg[3:5]))
+			info.Bands = uint(seg[5])
+			switch info.Bands {
+			case 1:
+				info.Photometric = "gray"
+			case 3:
+				info.Photometric = "ycbcr"
+				if adobeTransform == 0 {
+					info.Photometric = "rgb"
+				}
+			case 4:
+				info.Photometric = "cmyk" // Adobe CMYK or YCCK
+			default:
+				info.Photometric = "other"
+			}
+			if info.Width == 0 || info.Height == 0 {
+				return nil, fmt.Errorf("invalid dimensions %dx%d", info.Width, info.Height)
+			}
+			profile, err := icc.Extract(f)
+			if err != nil {
+				log.Printf("WARNING backend.Probe ignoring invalid ICC profile - %v\n", err)
+			}
+			info.ICCProfile = profile
+			return info, nil
+		}
+	}
+}
+
+// nextMarker skips to the next JPEG marker and returns its code.
+func nextMarker(br *bufio.Reader) (byte, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, fmt.Errorf("marker expected, found 0x%02x", b)
+	}
+	for b == 0xff { // fill bytes
+		if b, err = br.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// readJFIFDensity sets the resolution of info from a JFIF APP0 segment.
+func readJFIFDensity(seg []byte, info *ImageInfo) {
+	x := binary.BigEndian.Uint16(seg[8:10])
+	y := binary.BigEndian.Uint16(seg[10:12])
+	switch seg[7] {
+	case 1:
+		info.ResolutionUnit = "inch"
+	case 2:
+		info.ResolutionUnit = "cm"
+	default:
+		return
+	}
+	info.XResolution, info.YResolution = float64(x), float64(y)
+}
+
+func probePNG(f *os.File) (*ImageInfo, error) {
+	br := bufio.NewReader(f) // positioned after the signature
+	info := &ImageInfo{Format: "PNG", Pages: 1, Orientation: 1, SampleFormat: "uint"}
+	transparency := false
+
+	for first := true; ; first = false {
+		var hdr [8]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint32(hdr[0:4])
+		typ := string(hdr[4:8])
+		if first != (typ == "IHDR") {
+			return nil, fmt.Errorf("IHDR must be the first chunk")
+		}
+		if typ == "IDAT" || typ == "IEND" {
+			break
+		}
+		if length > 1<<20 && typ != "iCCP" {
+			return nil, fmt.Errorf("chunk %q too large", typ)
+		}
+
+		switch typ {
+		case "IHDR", "pHYs", "tRNS", "eXIf":
+			data := make([]byte, length)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return nil, err
+			}
+			if err := readPNGChunk(typ, data, info, &transparency); err != nil {
+				return nil, err
+			}
+			length = 0
+		}
+		if _, err := br.Discard(int(length) + 4); err != nil { // data and CRC
+			return nil, err
+		}
+	}
+
+	if transparency && info.Bands%2 == 1 {
+		info.Bands++ // tRNS adds an alpha channel to gray, RGB and palette images
+	}
+	profile, err := icc.Extract(f)
+	if err != nil {
+		log.Printf("WARNING backend.Probe ignoring invalid ICC profile - %v\n", err)
+	}
+	info.ICCProfile = profile
+	return info, nil
+}
+
+func readPNGChunk(typ string, data []byte, info *ImageInfo, transparency *bool) error {
+	switch typ {
+	case "IHDR":
+		if len(data) < 13 {
+			return fmt.Errorf("invalid IHDR chunk")
+		}
+		info.Width = uint(binary.BigEndian.Uint32(data[0:4]))
+		info.Height = uint(binary.BigEndian.Uint32(data[4:8]))
+		info.BitDepth = uint(data[8])
+		switch data[9] {
+		case 0:
+			info.Photometric, info.Bands = "gray", 1
+		case 2:
+			info.Photometric, info.Bands = "rgb", 3
+		case 3:
+			info.Photometric, info.Bands, info.BitDepth = "palette", 1, 8
+		case 4:
+			info.Photometric, info.Bands = "gray", 2
+		case 6:
+			info.Photometric, info.Bands = "rgb", 4
+		default:
+			return fmt.Errorf("invalid colour type %d", data[9])
+		}
+		if info.Width == 0 || info.Height == 0 {
+			return fmt.Errorf("invalid dimensions %dx%d", info.Width, info.Height)
+		}
+	case "pHYs":
+		if len(data) >= 9 && data[8] == 1 { // pixels per metre
+			info.ResolutionUnit = "cm"
+			info.XResolution = float64(binary.BigEndian.Uint32(data[0:4])) / 100
+			info.YResolution = float64(binary.BigEndian.Uint32(data[4:8])) / 100
+		}
+	case "tRNS":
+		*transparency = true
+	case "eXIf":
+		if exif, err := ptiff.NewFile(bytes.NewReader(data)); err == nil && len(exif.IFDs) > 0 {
+			info.Orientation = uint(exif.IFDs[0].UintOr(ptiff.TagOrientation, 1))
+			if info.Orientation < 1 || info.Orientation > 8 {
+				info.Orientation = 1
+			}
+		}
+	}
+	return nil
+}
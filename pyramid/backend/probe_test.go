@@ -0,0 +1,166 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probe-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	profile, err := ioutil.ReadFile("../../test/resources/sRGBProfile.icc")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Run("TIFF", func(t *testing.T) {
+		info, err := Probe("../../test/resources/images/grayscale-with-adobe-rgb-1998.tif")
+		if err != nil {
+			t.Fatalf("Probe - %v", err)
+		}
+		assert.Equal(t, "TIFF", info.Format)
+		assert.Equal(t, "gray", info.Photometric)
+		assert.Equal(t, "gray", info.Channels)
+		assert.Equal(t, uint(1), info.Bands)
+		assert.Equal(t, uint(8), info.BitDepth)
+		assert.Equal(t, "uint", info.SampleFormat)
+		assert.Equal(t, uint(1), info.Pages)
+		assert.Equal(t, uint(1), info.Orientation)
+		assert.NotZero(t, info.Width)
+		assert.NotZero(t, info.Height)
+		assert.NotEmpty(t, info.ICCProfile)
+		assert.Equal(t, "Adobe RGB (1998)", info.ICCProfileName)
+	})
+
+	t.Run("JPEG", func(t *testing.T) {
+		var buf bytes.Buffer
+		jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30)), nil)
+		b := buf.Bytes()
+
+		jfif := append([]byte("JFIF\x00\x01\x02\x01"), 0, 72, 0, 72, 0, 0)
+		icc := append([]byte("ICC_PROFILE\x00\x01\x01"), profile...)
+		var segs []byte
+		segs = append(segs, segment(0xe0, jfif)...)
+		segs = append(segs, segment(0xe1, append([]byte("Exif\x00\x00"), exifOrientation(6)...))...)
+		segs = append(segs, segment(0xe2, icc)...)
+		file := filepath.Join(dir, "test.jpg")
+		writeFile(file, append(append([]byte{0xff, 0xd8}, segs...), b[2:]...))
+
+		info, err := Probe(file)
+		if err != nil {
+			t.Fatalf("Probe - %v", err)
+		}
+		assert.Equal(t, "JPEG", info.Format)
+		assert.Equal(t, uint(40), info.Width)
+		assert.Equal(t, uint(30), info.Height)
+		assert.Equal(t, uint(3), info.Bands)
+		assert.Equal(t, uint(8), info.BitDepth)
+		assert.Equal(t, "ycbcr", info.Photometric)
+		assert.Equal(t, "srgb", info.Channels)
+		assert.Equal(t, uint(6), info.Orientation)
+		assert.Equal(t, "inch", info.ResolutionUnit)
+		assert.Equal(t, 72.0, info.XResolution)
+		assert.Equal(t, profile, info.ICCProfile)
+		assert.Equal(t, "sRGB IEC61966-2.1", info.ICCProfileName)
+	})
+
+	t.Run("PNG", func(t *testing.T) {
+		img := image.NewGray16(image.Rect(0, 0, 20, 10))
+		img.Set(0, 0, color.Gray16{Y: 1000})
+		var buf bytes.Buffer
+		png.Encode(&buf, img)
+		b := buf.Bytes()
+
+		phys := make([]byte, 9)
+		binary.BigEndian.PutUint32(phys[0:4], 11811) // 300 dpi
+		binary.BigEndian.PutUint32(phys[4:8], 11811)
+		phys[8] = 1
+		ihdrEnd := 8 + 8 + 13 + 4
+		var out []byte
+		out = append(out, b[:ihdrEnd]...)
+		out = append(out, chunk("pHYs", phys)...)
+		out = append(out, chunk("tRNS", []byte{0, 0})...)
+		out = append(out, b[ihdrEnd:]...)
+		file := filepath.Join(dir, "test.png")
+		writeFile(file, out)
+
+		info, err := Probe(file)
+		if err != nil {
+			t.Fatalf("Probe - %v", err)
+		}
+		assert.Equal(t, "PNG", info.Format)
+		assert.Equal(t, uint(20), info.Width)
+		assert.Equal(t, uint(10), info.Height)
+		assert.Equal(t, uint(16), info.BitDepth)
+		assert.Equal(t, uint(2), info.Bands)
+		assert.Equal(t, "graya", info.Channels)
+		assert.Equal(t, "cm", info.ResolutionUnit)
+		assert.InDelta(t, 118.11, info.XResolution, 0.001)
+		assert.Nil(t, info.ICCProfile)
+	})
+
+	t.Run("UnknownFormat", func(t *testing.T) {
+		file := filepath.Join(dir, "test.gif")
+		writeFile(file, []byte("GIF89a"))
+		_, err := Probe(file)
+		assert.True(t, errors.Is(err, ErrUnknownFormat), "got %v", err)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		file := filepath.Join(dir, "truncated.jpg")
+		writeFile(file, []byte{0xff, 0xd8, 0xff, 0xe0, 0x00})
+		_, err := Probe(file)
+		assert.NotNil(t, err)
+		assert.False(t, errors.Is(err, ErrUnknownFormat))
+	})
+}
+
+func writeFile(path string, b []byte) {
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		panic(err)
+	}
+}
+
+// segment returns a JPEG marker segment.
+func segment(marker byte, payload []byte) []byte {
+	b := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(payload)+2))
+	return append(b, payload...)
+}
+
+// chunk returns a PNG chunk.
+func chunk(typ string, data []byte) []byte {
+	b := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(data)))
+	copy(b[4:8], typ)
+	b = append(b, data...)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(b[4:]))
+	return append(b, crc[:]...)
+}
+
+// exifOrientation returns a little-endian TIFF header and IFD0 holding
+// only the Orientation tag.
+func exifOrientation(orientation uint16) []byte {
+	b := []byte("II*\x00\x08\x00\x00\x00")
+	b = append(b, 1, 0)                         // one entry
+	b = append(b, 0x12, 0x01, 3, 0, 1, 0, 0, 0) // Orientation, SHORT, count 1
+	b = append(b, byte(orientation), 0, 0, 0)   // value
+	return append(b, 0, 0, 0, 0)                // no next IFD
+}
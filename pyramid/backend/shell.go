@@ -0,0 +1,196 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gigamorph/go-pyramid/pyramid/compression"
+	"github.com/gigamorph/go-pyramid/shellcmds/combined"
+	"github.com/gigamorph/go-pyramid/shellcmds/exiftool"
+	im "github.com/gigamorph/go-pyramid/shellcmds/imagemagick"
+	"github.com/gigamorph/go-pyramid/shellcmds/tiff"
+	"github.com/gigamorph/go-pyramid/shellcmds/vips"
+)
+
+// Shell is the default Backend. It runs vips, ImageMagick, libtiff and
+// exiftool programs found at the paths configured in package config.
+type Shell struct {
+}
+
+// NewShell returns a new instance of Shell.
+func NewShell() *Shell {
+	return &Shell{}
+}
+
+// firstPage selects the first page/image of a file for vips.
+func firstPage(file string) string {
+	return fmt.Sprintf("%s[0]", file)
+}
+
+// Probe reads the header of file natively (see the Probe function) and
+// falls back to vipsheader and identify for other formats.
+func (s *Shell) Probe(ctx context.Context, file string, imTempDir *string) (*ImageInfo, error) {
+	info, err := Probe(file)
+	if err == nil {
+		return info, nil
+	}
+	if !errors.Is(err, ErrUnknownFormat) {
+		log.Printf("WARNING backend.Shell#Probe falling back to vipsheader and identify - %v\n", err)
+	}
+	return probeShell(ctx, file, imTempDir)
+}
+
+func probeShell(ctx context.Context, file string, imTempDir *string) (*ImageInfo, error) {
+	var err error
+	info := ImageInfo{}
+
+	if info.Width, err = vips.WidthContext(ctx, file); err != nil {
+		return nil, fmt.Errorf("backend.Shell#Probe failed to get width - %w", err)
+	}
+	if info.Height, err = vips.HeightContext(ctx, file); err != nil {
+		return nil, fmt.Errorf("backend.Shell#Probe failed to get height - %w", err)
+	}
+
+	format, channels, depth, iccProfileName, err := im.GetInfoContext(ctx, file, imTempDir)
+	if err != nil {
+		return nil, fmt.Errorf("backend.Shell#Probe failed get info from %s - %w", file, err)
+	}
+	depth64, err := strconv.ParseUint(depth, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("backend.Shell#Probe failed to parse depth - %v", err)
+	}
+
+	info.Format = format
+	info.Channels = strings.TrimSpace(channels)
+	info.BitDepth = uint(depth64)
+	info.ICCProfileName = iccProfileName
+	return &info, nil
+}
+
+// ToTIFF runs vips tiffsave.
+func (s *Shell) ToTIFF(ctx context.Context, inFile, outFile string) error {
+	return vips.ToTiffContext(ctx, firstPage(inFile), outFile)
+}
+
+// RemoveAlpha runs vips im_extract_bands.
+func (s *Shell) RemoveAlpha(ctx context.Context, inFile, outFile string) error {
+	return vips.RemoveAlphaContext(ctx, inFile, outFile)
+}
+
+// RemoveAlphaFromGraya runs vips im_extract_bands.
+func (s *Shell) RemoveAlphaFromGraya(ctx context.Context, inFile, outFile string) error {
+	return vips.RemoveAlphaFromGrayaContext(ctx, inFile, outFile)
+}
+
+// FixGray runs vipsthumbnail.
+func (s *Shell) FixGray(ctx context.Context, inFile, outFile string, width, height uint) error {
+	return vips.FixGraySizeContext(ctx, inFile, outFile, width, height)
+}
+
+// GrayToSRGB runs ImageMagick convert.
+func (s *Shell) GrayToSRGB(ctx context.Context, inFile, outFile string) error {
+	return combined.GrayToSRGBContext(ctx, inFile, outFile)
+}
+
+// ICCTransform runs vips icc_transform.
+func (s *Shell) ICCTransform(ctx context.Context, inFile, outFile, iccProfile string, depth uint) error {
+	return vips.ICCTransformDepthContext(ctx, firstPage(inFile), outFile, iccProfile, depth)
+}
+
+// ReduceDepth runs ImageMagick convert.
+func (s *Shell) ReduceDepth(ctx context.Context, inFile, outFile string, dither bool) error {
+	return im.ReduceDepthContext(ctx, inFile, outFile, dither)
+}
+
+// CMYKToRGB runs vips icc_transform.
+func (s *Shell) CMYKToRGB(ctx context.Context, inFile, outFile, cmykProfile, iccProfile string, depth uint) error {
+	return vips.CMYKToRGBContext(ctx, firstPage(inFile), outFile, cmykProfile, iccProfile, depth)
+}
+
+// Resize runs vipsthumbnail, or vips resize if opts asks for more than
+// the default resampling.
+func (s *Shell) Resize(ctx context.Context, inFile, outFile string, width, height uint, opts ResizeOptions) error {
+	if opts == (ResizeOptions{}) {
+		return vips.ResizeContext(ctx, firstPage(inFile), outFile, width, height)
+	}
+	info, err := Probe(inFile)
+	if err != nil {
+		if info, err = probeShell(ctx, inFile, nil); err != nil {
+			return fmt.Errorf("backend.Shell#Resize failed to get the size of %s - %w", inFile, err)
+		}
+	}
+	bands := info.Bands
+	if bands == 0 && strings.HasPrefix(info.Channels, "gray") { // probed by the shell
+		bands = 1
+	}
+	return vips.ResampleContext(ctx, firstPage(inFile), outFile, info.Width, info.Height, width, height, vips.ResampleOptions{
+		Kernel:      opts.Kernel,
+		LinearLight: opts.LinearLight,
+		Sharpen:     opts.Sharpen,
+		Bands:       bands,
+		Depth:       info.BitDepth,
+	})
+}
+
+// BuildPyramid runs tiffcp.
+func (s *Shell) BuildPyramid(ctx context.Context, inFiles []string, outFile string, opts PyramidOptions) error {
+	return tiff.BuildPyramidContext(ctx, inFiles, outFile, map[string]string{
+		"c": tiffcpCompression(opts.Compression),
+		"8": strconv.FormatBool(opts.BigTIFF),
+		"w": strconv.FormatUint(uint64(opts.TileWidth), 10),
+		"l": strconv.FormatUint(uint64(opts.TileHeight), 10),
+	})
+}
+
+// CopyMetadata runs exiftool -TagsFromFile.
+func (s *Shell) CopyMetadata(ctx context.Context, srcFile, dstFile string, tags []string) error {
+	return exiftool.CopyTagsContext(ctx, srcFile, dstFile, tags...)
+}
+
+// WriteTags runs exiftool to write the tags in place.
+func (s *Shell) WriteTags(ctx context.Context, file string, tags exiftool.TagsInput) error {
+	return exiftool.WriteTagsContext(ctx, file, tags)
+}
+
+// ReadTags runs exiftool once with JSON output for all tags.
+func (s *Shell) ReadTags(ctx context.Context, file string, tags []string) (map[string]string, error) {
+	t, err := exiftool.ReadTagsContext(ctx, file, tags...)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for _, tag := range tags {
+		if v, ok := t.Lookup(tag); ok {
+			values[tag] = strings.TrimSpace(v.Text)
+		}
+	}
+	return values, nil
+}
+
+// tiffcpCompression returns o in the syntax of the -c option of tiffcp,
+// e.g. "jpeg:90" or "zip:2:p9", where 2 selects the horizontal predictor
+// and p the level (or the quality of WebP, which is always lossy).
+func tiffcpCompression(o compression.Option) string {
+	var s string
+	switch o.Codec {
+	case compression.JPEG:
+		return fmt.Sprintf("jpeg:%d", o.Quality)
+	case compression.WebP:
+		return fmt.Sprintf("webp:p%d", o.Quality)
+	case compression.Deflate:
+		s = "zip"
+	default:
+		s = string(o.Codec)
+	}
+	if o.Predictor == compression.PredictorHorizontal {
+		s += ":2"
+	}
+	if o.Level != 0 {
+		s += fmt.Sprintf(":p%d", o.Level)
+	}
+	return s
+}
@@ -0,0 +1,26 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/gigamorph/go-pyramid/pyramid/compression"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTIFFCopyCompression(t *testing.T) {
+	tests := []struct {
+		option compression.Option
+		want   string
+	}{
+		{compression.Option{Codec: compression.None}, "none"},
+		{compression.Option{Codec: compression.JPEG, Quality: 85}, "jpeg:85"},
+		{compression.Option{Codec: compression.Deflate}, "zip"},
+		{compression.Option{Codec: compression.Deflate, Level: 9, Predictor: compression.PredictorHorizontal}, "zip:2:p9"},
+		{compression.Option{Codec: compression.LZW, Predictor: compression.PredictorHorizontal}, "lzw:2"},
+		{compression.Option{Codec: compression.ZSTD, Level: 19}, "zstd:p19"},
+		{compression.Option{Codec: compression.WebP, Quality: 100}, "webp:p100"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tiffcpCompression(tt.option), "%s", tt.option)
+	}
+}
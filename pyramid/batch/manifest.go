@@ -0,0 +1,258 @@
+// Package batch converts many images with a pool of workers.
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gigamorph/go-pyramid/pyramid/input"
+)
+
+// DefaultExtensions are the file extensions picked up by FromDir when
+// none are specified.
+var DefaultExtensions = []string{".tif", ".tiff", ".jpg", ".jpeg", ".png", ".jp2", ".webp"}
+
+// FromDir returns a job for every image file under inDir. The pyramid
+// of inDir/a/b.jpg is written to outDir/a/b.tif, or for the tile output
+// formats of defaults to outDir/a/b.dzi (Deep Zoom) or the directory
+// outDir/a/b (IIIF and Zoomify). Other parameters are taken from
+// defaults. If exts is empty, DefaultExtensions is used. Images that
+// would be written to the same file, such as a.jpg and a.tif, are an
+// error.
+func FromDir(inDir, outDir string, defaults input.Params, exts []string) ([]input.Params, error) {
+	if len(exts) == 0 {
+		exts = DefaultExtensions
+	}
+	wanted := map[string]bool{}
+	for _, ext := range exts {
+		wanted[strings.ToLower(ext)] = true
+	}
+
+	jobs := make([]input.Params, 0, 64)
+	err := filepath.Walk(inDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !wanted[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		rel, err := filepath.Rel(inDir, path)
+		if err != nil {
+			return err
+		}
+		p := defaults.Copy()
+		p.InFile = path
+		p.OutFile = filepath.Join(outDir, strings.TrimSuffix(rel, filepath.Ext(rel))+outExt(p.OutputFormat))
+		jobs = append(jobs, p)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("batch.FromDir failed to walk %s - %v", inDir, err)
+	}
+	if err := checkOutFiles(jobs); err != nil {
+		return nil, fmt.Errorf("batch.FromDir %v", err)
+	}
+	return jobs, nil
+}
+
+// checkOutFiles returns an error if two jobs would write the same output,
+// which they would race on.
+func checkOutFiles(jobs []input.Params) error {
+	inFiles := map[string]string{}
+	for _, p := range jobs {
+		outFile := filepath.Clean(p.OutFile)
+		if other, ok := inFiles[outFile]; ok {
+			return fmt.Errorf("%s and %s would both be written to %s", other, p.InFile, outFile)
+		}
+		inFiles[outFile] = p.InFile
+	}
+	return nil
+}
+
+// outExt returns the extension of the output of format, "" for the
+// formats written to a directory.
+func outExt(format string) string {
+	switch format {
+	case "iiif", "zoomify":
+		return ""
+	case "dzi":
+		return ".dzi"
+	default:
+		return ".tif"
+	}
+}
+
+// FromManifest reads jobs from a CSV or JSON lines manifest file. Jobs
+// that share an output file are refused.
+// The format is chosen by the extension (.csv, .jsonl, .ndjson, .json)
+// or, failing that, by whether the first line starts with "{".
+func FromManifest(path string, defaults input.Params) ([]input.Params, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("batch.FromManifest failed to read %s - %v", path, err)
+	}
+
+	var jobs []input.Params
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		jobs, err = ParseCSV(bytes.NewReader(b), defaults)
+	case ".jsonl", ".ndjson", ".json":
+		jobs, err = ParseJSONLines(bytes.NewReader(b), defaults)
+	default:
+		if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+			jobs, err = ParseJSONLines(bytes.NewReader(b), defaults)
+		} else {
+			jobs, err = ParseCSV(bytes.NewReader(b), defaults)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("batch.FromManifest failed to parse %s - %v", path, err)
+	}
+	if err := checkOutFiles(jobs); err != nil {
+		return nil, fmt.Errorf("batch.FromManifest %s - %v", path, err)
+	}
+	return jobs, nil
+}
+
+// ParseJSONLines reads one job per line. Each line is a JSON object
+// whose keys are input.Params field names (matched case-insensitively),
+// e.g. {"InFile": "a.jpg", "OutFile": "a.tif", "Quality": 80}.
+// Fields not present keep their value from defaults.
+// Empty lines and lines starting with # are skipped.
+func ParseJSONLines(r io.Reader, defaults input.Params) ([]input.Params, error) {
+	jobs := make([]input.Params, 0, 64)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := defaults.Copy()
+		if err := json.Unmarshal([]byte(line), &p); err != nil {
+			return nil, fmt.Errorf("line %d - %v", n, err)
+		}
+		if err := checkJob(p); err != nil {
+			return nil, fmt.Errorf("line %d - %v", n, err)
+		}
+		jobs = append(jobs, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// ParseCSV reads jobs from CSV with a header row. Column names are
+// input.Params field names (matched case-insensitively), e.g.
+//
+//	infile,outfile,quality
+//	a.jpg,a.tif,80
+//
+// Empty cells keep the value from defaults.
+func ParseCSV(r io.Reader, defaults input.Params) ([]input.Params, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header - %v", err)
+	}
+	for _, name := range header {
+		if _, ok := paramsField(name); !ok {
+			return nil, fmt.Errorf("unknown column %s", name)
+		}
+	}
+
+	jobs := make([]input.Params, 0, 64)
+	for n := 2; ; n++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		p := defaults.Copy()
+		for i, value := range record {
+			if value == "" {
+				continue
+			}
+			if err := setParam(&p, header[i], value); err != nil {
+				return nil, fmt.Errorf("record %d - %v", n, err)
+			}
+		}
+		if err := checkJob(p); err != nil {
+			return nil, fmt.Errorf("record %d - %v", n, err)
+		}
+		jobs = append(jobs, p)
+	}
+	return jobs, nil
+}
+
+func checkJob(p input.Params) error {
+	if p.InFile == "" || p.OutFile == "" {
+		return fmt.Errorf("both infile and outfile are required")
+	}
+	return nil
+}
+
+// paramsField finds the settable field of input.Params called name,
+// ignoring case.
+func paramsField(name string) (reflect.StructField, bool) {
+	t := reflect.TypeOf(input.Params{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !strings.EqualFold(f.Name, strings.TrimSpace(name)) {
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.String, reflect.Int, reflect.Uint, reflect.Bool:
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func setParam(p *input.Params, name, value string) error {
+	f, ok := paramsField(name)
+	if !ok {
+		return fmt.Errorf("unknown column %s", name)
+	}
+	v := reflect.ValueOf(p).Elem().FieldByIndex(f.Index)
+	switch f.Type.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s %s", name, value)
+		}
+		v.SetInt(n)
+	case reflect.Uint:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s %s", name, value)
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %s", name, value)
+		}
+		v.SetBool(b)
+	}
+	return nil
+}
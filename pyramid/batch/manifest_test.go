@@ -0,0 +1,129 @@
+package batch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gigamorph/go-pyramid/pyramid/input"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCSV(t *testing.T) {
+	defaults := input.Params{Compression: "jpeg", Quality: 90, TempDir: "/tmp/x"}
+
+	jobs, err := ParseCSV(strings.NewReader(`InFile,outfile,quality,MaxSize,deletetemp
+# comment
+a.jpg,a.tif,80,1000,true
+b.jpg,b.tif,,,
+`), defaults)
+	assert.Nil(t, err, "ParseCSV")
+	assert.Equal(t, 2, len(jobs), "number of jobs")
+	assert.Equal(t, "a.jpg", jobs[0].InFile, "infile")
+	assert.Equal(t, "a.tif", jobs[0].OutFile, "outfile")
+	assert.Equal(t, 80, jobs[0].Quality, "quality")
+	assert.Equal(t, uint(1000), jobs[0].MaxSize, "max size")
+	assert.True(t, jobs[0].DeleteTemp, "delete temp")
+	assert.Equal(t, "/tmp/x", jobs[0].TempDir, "default temp dir")
+	assert.Equal(t, 90, jobs[1].Quality, "default quality")
+
+	_, err = ParseCSV(strings.NewReader("infile,outfile,color\na.jpg,a.tif,red\n"), defaults)
+	assert.NotNil(t, err, "unknown column")
+
+	_, err = ParseCSV(strings.NewReader("infile,outfile,quality\na.jpg,a.tif,high\n"), defaults)
+	assert.NotNil(t, err, "invalid number")
+
+	_, err = ParseCSV(strings.NewReader("infile,quality\na.jpg,80\n"), defaults)
+	assert.NotNil(t, err, "missing outfile")
+}
+
+func TestParseJSONLines(t *testing.T) {
+	defaults := input.Params{Compression: "jpeg", Quality: 90}
+
+	jobs, err := ParseJSONLines(strings.NewReader(`{"InFile": "a.jpg", "OutFile": "a.tif", "quality": 70}
+
+{"infile": "b.png", "outfile": "b.tif", "Compression": "lzw"}
+`), defaults)
+	assert.Nil(t, err, "ParseJSONLines")
+	assert.Equal(t, 2, len(jobs), "number of jobs")
+	assert.Equal(t, 70, jobs[0].Quality, "quality")
+	assert.Equal(t, "jpeg", jobs[0].Compression, "default compression")
+	assert.Equal(t, "b.png", jobs[1].InFile, "infile")
+	assert.Equal(t, "lzw", jobs[1].Compression, "compression")
+	assert.Equal(t, 90, jobs[1].Quality, "default quality")
+
+	_, err = ParseJSONLines(strings.NewReader(`{"InFile": "a.jpg"`), defaults)
+	assert.NotNil(t, err, "invalid JSON")
+}
+
+func TestParseJSONLinesMetadataTags(t *testing.T) {
+	defaults := input.Params{Metadata: "allowlist", MetadataTags: []string{"EXIF:Artist", "XMP-dc:Creator"}}
+
+	jobs, err := ParseJSONLines(strings.NewReader(`{"InFile": "a.jpg", "OutFile": "a.tif", "MetadataTags": ["IPTC:By-line"]}
+{"InFile": "b.jpg", "OutFile": "b.tif"}
+`), defaults)
+	assert.Nil(t, err, "ParseJSONLines")
+	assert.Equal(t, 2, len(jobs), "number of jobs")
+	assert.Equal(t, []string{"IPTC:By-line"}, jobs[0].MetadataTags, "tags of the line")
+	assert.Equal(t, []string{"EXIF:Artist", "XMP-dc:Creator"}, jobs[1].MetadataTags, "default tags")
+	assert.Equal(t, []string{"EXIF:Artist", "XMP-dc:Creator"}, defaults.MetadataTags, "defaults unchanged")
+}
+
+func TestFromManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-pyramid-batch-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := filepath.Join(dir, "jobs.csv")
+	ioutil.WriteFile(manifest, []byte("infile,outfile\na.jpg,out/a.tif\nb.jpg,out/b.tif\n"), 0600)
+	jobs, err := FromManifest(manifest, input.Params{})
+	assert.Nil(t, err, "FromManifest")
+	assert.Equal(t, 2, len(jobs), "number of jobs")
+
+	manifest = filepath.Join(dir, "jobs.jsonl")
+	ioutil.WriteFile(manifest, []byte(`{"InFile": "a.jpg", "OutFile": "out/a.tif"}
+{"InFile": "b.jpg", "OutFile": "./out/a.tif"}
+`), 0600)
+	_, err = FromManifest(manifest, input.Params{})
+	if assert.NotNil(t, err, "a.jpg and b.jpg have the same output") {
+		assert.Contains(t, err.Error(), "out/a.tif", "error")
+	}
+}
+
+func TestFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-pyramid-batch-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"a.jpg", "sub/b.TIF", "sub/notes.txt"} {
+		path := filepath.Join(dir, "in", f)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		ioutil.WriteFile(path, nil, 0600)
+	}
+
+	jobs, err := FromDir(filepath.Join(dir, "in"), filepath.Join(dir, "out"), input.Params{Quality: 75}, nil)
+	assert.Nil(t, err, "FromDir")
+	assert.Equal(t, 2, len(jobs), "number of jobs")
+	assert.Equal(t, filepath.Join(dir, "in", "a.jpg"), jobs[0].InFile, "infile")
+	assert.Equal(t, filepath.Join(dir, "out", "a.tif"), jobs[0].OutFile, "outfile")
+	assert.Equal(t, filepath.Join(dir, "out", "sub", "b.tif"), jobs[1].OutFile, "outfile in sub dir")
+	assert.Equal(t, 75, jobs[1].Quality, "default quality")
+
+	for format, out := range map[string]string{"dzi": "a.dzi", "iiif": "a", "zoomify": "a", "tiff": "a.tif"} {
+		jobs, err := FromDir(filepath.Join(dir, "in"), filepath.Join(dir, "out"), input.Params{OutputFormat: format}, nil)
+		assert.Nil(t, err, "FromDir")
+		assert.Equal(t, filepath.Join(dir, "out", out), jobs[0].OutFile, "outfile for %s", format)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "in", "a.tif"), nil, 0600)
+	_, err = FromDir(filepath.Join(dir, "in"), filepath.Join(dir, "out"), input.Params{}, nil)
+	if assert.NotNil(t, err, "a.jpg and a.tif have the same output") {
+		assert.Contains(t, err.Error(), "a.tif", "error")
+	}
+}
@@ -0,0 +1,125 @@
+package batch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gigamorph/go-pyramid/pyramid/input"
+	"github.com/gigamorph/go-pyramid/pyramid/output"
+)
+
+// Converter converts a single image. *agent.Agent implements it.
+type Converter interface {
+	Convert(p input.Params) (*output.Params, error)
+}
+
+// Result is the outcome of one job. It is written to the result log
+// as one JSON object per line.
+type Result struct {
+	InFile   string
+	OutFile  string
+	Output   *output.Params `json:",omitempty"`
+	Error    string         `json:",omitempty"`
+	Duration float64        // seconds
+}
+
+// Summary counts the outcomes of a batch.
+type Summary struct {
+	Total     int
+	Succeeded int
+	Failed    int
+}
+
+// Runner runs jobs on a pool of workers. A failed job does not stop
+// the others.
+type Runner struct {
+	Converter Converter
+	Workers   int       // number of concurrent conversions (default 1)
+	Log       io.Writer // where results are written as JSON lines; may be nil
+}
+
+// Run converts all jobs and returns once every one of them has finished.
+// The parent directory of each output file is created if needed.
+// The returned error is non-nil only if writing the result log failed.
+func (r *Runner) Run(jobs []input.Params) (Summary, error) {
+	workers := r.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	queue := make(chan input.Params)
+	results := make(chan Result)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				results <- r.convert(p)
+			}
+		}()
+	}
+	go func() {
+		for _, p := range jobs {
+			queue <- p
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	summary := Summary{Total: len(jobs)}
+	var logErr error
+	var enc *json.Encoder
+	if r.Log != nil {
+		enc = json.NewEncoder(r.Log)
+	}
+	for res := range results {
+		if res.Error == "" {
+			summary.Succeeded++
+		} else {
+			summary.Failed++
+			log.Printf("ERROR batch.Runner#Run %s failed - %s\n", res.InFile, res.Error)
+		}
+		if enc != nil && logErr == nil {
+			if err := enc.Encode(res); err != nil {
+				logErr = fmt.Errorf("batch.Runner#Run failed to write result log - %v", err)
+			}
+		}
+	}
+	return summary, logErr
+}
+
+func (r *Runner) convert(p input.Params) Result {
+	start := time.Now()
+	res := Result{InFile: p.InFile, OutFile: p.OutFile}
+
+	out, err := r.safeConvert(p)
+	res.Duration = time.Since(start).Seconds()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Output = out
+	return res
+}
+
+// safeConvert keeps a panic in one conversion from taking down the batch.
+func (r *Runner) safeConvert(p input.Params) (out *output.Params, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic - %v", v)
+		}
+	}()
+	if err = os.MkdirAll(filepath.Dir(p.OutFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory - %v", err)
+	}
+	return r.Converter.Convert(p)
+}
@@ -0,0 +1,89 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gigamorph/go-pyramid/pyramid/input"
+	"github.com/gigamorph/go-pyramid/pyramid/output"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConverter fails for input files containing "bad" and panics for
+// input files containing "panic".
+type fakeConverter struct {
+	running int32
+	maxSeen int32
+}
+
+func (c *fakeConverter) Convert(p input.Params) (*output.Params, error) {
+	n := atomic.AddInt32(&c.running, 1)
+	defer atomic.AddInt32(&c.running, -1)
+	for {
+		max := atomic.LoadInt32(&c.maxSeen)
+		if n <= max || atomic.CompareAndSwapInt32(&c.maxSeen, max, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	switch {
+	case strings.Contains(p.InFile, "bad"):
+		return nil, fmt.Errorf("cannot read %s", p.InFile)
+	case strings.Contains(p.InFile, "panic"):
+		panic("boom")
+	}
+	return &output.Params{InputWidth: 100, InputHeight: 50, OutputWidth: 100, OutputHeight: 50}, nil
+}
+
+func TestRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-pyramid-batch-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{"a", "bad1", "b", "c", "panic", "d", "e", "bad2"}
+	jobs := make([]input.Params, len(names))
+	for i, name := range names {
+		jobs[i] = input.Params{
+			InFile:  name + ".jpg",
+			OutFile: filepath.Join(dir, "out", name+".tif"),
+		}
+	}
+
+	var logBuf bytes.Buffer
+	conv := &fakeConverter{}
+	r := Runner{Converter: conv, Workers: 3, Log: &logBuf}
+
+	summary, err := r.Run(jobs)
+	assert.Nil(t, err, "Run")
+	assert.Equal(t, Summary{Total: 8, Succeeded: 5, Failed: 3}, summary, "summary")
+	assert.Equal(t, int32(3), conv.maxSeen, "number of concurrent conversions")
+
+	_, err = os.Stat(filepath.Join(dir, "out"))
+	assert.Nil(t, err, "output directory created")
+
+	results := map[string]Result{}
+	scanner := bufio.NewScanner(&logBuf)
+	for scanner.Scan() {
+		var res Result
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &res), "result line is JSON")
+		results[res.InFile] = res
+	}
+	assert.Equal(t, len(names), len(results), "one result per job")
+	assert.Equal(t, uint(100), results["a.jpg"].Output.OutputWidth, "output params logged")
+	assert.Equal(t, "", results["a.jpg"].Error, "no error for a good file")
+	assert.Contains(t, results["bad1.jpg"].Error, "cannot read", "error logged")
+	assert.Nil(t, results["bad1.jpg"].Output, "no output for a failed file")
+	assert.Contains(t, results["panic.jpg"].Error, "panic", "panic logged")
+}
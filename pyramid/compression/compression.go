@@ -0,0 +1,91 @@
+// Package compression describes how the tiles of a pyramid are compressed.
+package compression
+
+import (
+	"fmt"
+)
+
+// Codec names a compression scheme.
+type Codec string
+
+// Codecs.
+const (
+	None    Codec = "none"
+	JPEG    Codec = "jpeg"
+	Deflate Codec = "deflate"
+	LZW     Codec = "lzw"
+	ZSTD    Codec = "zstd"
+	WebP    Codec = "webp"
+)
+
+// Predictor names a TIFF predictor, which makes lossless codecs compress
+// continuous-tone images better.
+type Predictor string
+
+// Predictors.
+const (
+	PredictorNone       Predictor = "none"
+	PredictorHorizontal Predictor = "horizontal"
+)
+
+// Option is a codec with its settings.
+type Option struct {
+	Codec     Codec
+	Quality   int       `json:",omitempty"` // JPEG and WebP quality (1-100); WebP is lossy even at 100
+	Level     int       `json:",omitempty"` // Deflate (1-9) or ZSTD (1-22) level, 0 for the codec default
+	Predictor Predictor `json:",omitempty"` // Deflate, LZW and ZSTD only, "" meaning PredictorNone
+}
+
+// Validate checks that the codec is known and that its settings are valid
+// for it.
+func (o Option) Validate() error {
+	switch o.Codec {
+	case None, JPEG, Deflate, LZW, ZSTD, WebP:
+	default:
+		return fmt.Errorf("unknown codec %q", o.Codec)
+	}
+
+	switch o.Codec {
+	case JPEG, WebP:
+		if o.Quality < 1 || o.Quality > 100 {
+			return fmt.Errorf("invalid %s quality %d", o.Codec, o.Quality)
+		}
+	case Deflate:
+		if o.Level < 0 || o.Level > 9 {
+			return fmt.Errorf("invalid deflate level %d", o.Level)
+		}
+	case ZSTD:
+		if o.Level < 0 || o.Level > 22 {
+			return fmt.Errorf("invalid zstd level %d", o.Level)
+		}
+	}
+	if o.Level != 0 && o.Codec != Deflate && o.Codec != ZSTD {
+		return fmt.Errorf("codec %s has no level", o.Codec)
+	}
+
+	switch o.Predictor {
+	case "", PredictorNone:
+	case PredictorHorizontal:
+		if o.Codec != Deflate && o.Codec != LZW && o.Codec != ZSTD {
+			return fmt.Errorf("codec %s cannot use a predictor", o.Codec)
+		}
+	default:
+		return fmt.Errorf("unknown predictor %q", o.Predictor)
+	}
+	return nil
+}
+
+// String returns a short description, e.g. "jpeg:90" or "deflate:6:horizontal".
+func (o Option) String() string {
+	s := string(o.Codec)
+	switch {
+	case o.Codec == JPEG || o.Codec == WebP:
+		s += fmt.Sprintf(":%d", o.Quality)
+	case o.Level != 0:
+		s += fmt.Sprintf(":%d", o.Level)
+	}
+	if o.Predictor == PredictorHorizontal {
+		s += ":" + string(o.Predictor)
+	}
+	return s
+}
@@ -0,0 +1,43 @@
+package compression
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []Option{
+		{Codec: None},
+		{Codec: JPEG, Quality: 90},
+		{Codec: Deflate},
+		{Codec: Deflate, Level: 9, Predictor: PredictorHorizontal},
+		{Codec: LZW, Predictor: PredictorHorizontal},
+		{Codec: ZSTD, Level: 22, Predictor: PredictorNone},
+		{Codec: WebP, Quality: 100},
+	}
+	for _, o := range valid {
+		assert.Nil(t, o.Validate(), "%s", o)
+	}
+
+	invalid := []Option{
+		{Codec: ""},
+		{Codec: "jpeg2000"},
+		{Codec: JPEG},
+		{Codec: JPEG, Quality: 90, Predictor: PredictorHorizontal},
+		{Codec: WebP, Quality: 101},
+		{Codec: Deflate, Level: 10},
+		{Codec: LZW, Level: 1},
+		{Codec: ZSTD, Level: 23},
+		{Codec: Deflate, Predictor: "floating-point"},
+	}
+	for _, o := range invalid {
+		assert.NotNil(t, o.Validate(), "%s", o)
+	}
+}
+
+func TestString(t *testing.T) {
+	assert.Equal(t, "jpeg:90", Option{Codec: JPEG, Quality: 90}.String())
+	assert.Equal(t, "deflate", Option{Codec: Deflate}.String())
+	assert.Equal(t, "zstd:3:horizontal", Option{Codec: ZSTD, Level: 3, Predictor: PredictorHorizontal}.String())
+}
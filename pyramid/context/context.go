@@ -2,36 +2,56 @@ package context
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 
+	"github.com/gigamorph/go-pyramid/pyramid/compression"
 	"github.com/gigamorph/go-pyramid/pyramid/input"
 	"github.com/gigamorph/go-pyramid/pyramid/output"
+	"github.com/gigamorph/go-pyramid/pyramid/ptiff"
 )
 
 // Context holds inforamtion needed to perform conversion.
 type Context struct {
 	Input            input.Params
 	Output           output.Params
+	WorkDir          string // directory holding the temporary files of this job only
 	TmpFilePrefix    string
 	TiffFile         string
+	EightBitFile     string // high-bit-depth input reduced to 8 bits
+	RGBFile          string // CMYK input converted to RGB
 	NoalphaFile      string
 	GrayFixedFile    string
 	ProfileFixedFile string
 	Width            uint // original width
 	Height           uint // original height
 	BitDepth         uint // original bit depth, e.g. 8, 16
+	Bands            uint // number of bands of the image the pyramid is built from
+	OutBitDepth      uint // bits per sample of the levels, known once they are built
+
+	name string // base name of the input file without extension
 }
 
+// tagName matches exiftool tag names with optional group prefixes, e.g.
+// "Artist", "EXIF:Artist" or "XMP:XMP-dc:all", and nothing that exiftool
+// would take as an option or an assignment.
+var tagName = regexp.MustCompile(`^([A-Za-z0-9-]+:)*[A-Za-z0-9_-]+$`)
+
+// classicTIFFLimit is the size above which a pyramid is written as BigTIFF
+// in "auto" mode. It leaves some headroom below 4 GiB for IFDs and tags.
+const classicTIFFLimit = 1<<32 - 1<<26
+
 // New returns a new instance of Context.
 func New(p input.Params) *Context {
 	c := Context{}
 
 	base := path.Base(p.InFile)
 	ext := path.Ext(base)
-	name := strings.TrimSuffix(base, ext)
+	c.name = strings.TrimSuffix(base, ext)
 
 	c.Input = p
 	if c.Input.TempDir == "" {
@@ -41,12 +61,61 @@ func New(p input.Params) *Context {
 		c.Input.Compression = "jpeg"
 		c.Input.Quality = 90
 	}
-	c.TmpFilePrefix = fmt.Sprintf("%s/%s", c.Input.TempDir, name)
+	if c.Input.Quality == 0 {
+		c.Input.Quality = 90
+	}
+	if c.Input.TileWidth == 0 {
+		c.Input.TileWidth = 256
+	}
+	if c.Input.TileHeight == 0 {
+		c.Input.TileHeight = 256
+	}
+	if c.Input.MinLevelSize == 0 {
+		c.Input.MinLevelSize = 128
+	}
+	if c.Input.HighBitDepth == "" {
+		c.Input.HighBitDepth = "keep"
+		if c.WritesTiles() {
+			c.Input.HighBitDepth = "reduce"
+		}
+	}
+	if c.Input.LosslessCompression == "" {
+		c.Input.LosslessCompression = "deflate"
+	}
+	c.setWorkDir(c.Input.TempDir)
+	return &c
+}
+
+// MakeWorkDir creates a directory under TempDir that is unique to this
+// context and places all temporary files in it, so that concurrent jobs,
+// including ones whose input files have the same name, never share files.
+func (c *Context) MakeWorkDir() error {
+	dir, err := ioutil.TempDir(c.Input.TempDir, c.name+"-")
+	if err != nil {
+		return fmt.Errorf("context.Context#MakeWorkDir failed to create work dir in %s - %v", c.Input.TempDir, err)
+	}
+	c.setWorkDir(dir)
+	return nil
+}
+
+// RemoveWorkDir deletes the directory created by MakeWorkDir and all
+// files in it. It does nothing if MakeWorkDir was not called.
+func (c *Context) RemoveWorkDir() error {
+	if c.WorkDir == c.Input.TempDir {
+		return nil
+	}
+	return os.RemoveAll(c.WorkDir)
+}
+
+func (c *Context) setWorkDir(dir string) {
+	c.WorkDir = dir
+	c.TmpFilePrefix = fmt.Sprintf("%s/%s", dir, c.name)
 	c.TiffFile = fmt.Sprintf("%s.tif", c.TmpFilePrefix)
+	c.EightBitFile = fmt.Sprintf("%s.8bit.tif", c.TmpFilePrefix)
+	c.RGBFile = fmt.Sprintf("%s.rgb.tif", c.TmpFilePrefix)
 	c.NoalphaFile = fmt.Sprintf("%s.noalpha.tif", c.TmpFilePrefix)
 	c.GrayFixedFile = fmt.Sprintf("%s.grayfixed.tif", c.TmpFilePrefix)
 	c.ProfileFixedFile = fmt.Sprintf("%s.profilefixed.tif", c.TmpFilePrefix)
-	return &c
 }
 
 // InitialWH calculates the size of the biggest tile in the output pyramidal TIFF
@@ -71,14 +140,267 @@ func (c *Context) InitialWH() (uint, uint) {
 	return w, h
 }
 
-func (c *Context) CompressionOption() string {
-	switch c.Input.Compression {
-	case "jpeg":
-		quality := c.Input.Quality
-		return fmt.Sprintf("jpeg:%d", quality)
-	case "lzw":
-		return "lzw"
+// Validate checks the user-provided parameters that can be checked
+// before any work is done.
+func (c *Context) Validate() error {
+	p := c.Input
+	if !c.WritesTiles() && (p.TileWidth%16 != 0 || p.TileHeight%16 != 0) {
+		return fmt.Errorf("tile size %dx%d is not a multiple of 16", p.TileWidth, p.TileHeight)
+	}
+	if c.WritesTiles() && p.HighBitDepth == "keep" {
+		return fmt.Errorf("%s output cannot keep more than 8 bits per sample", p.OutputFormat)
+	}
+	switch p.OutputFormat {
+	case "", "tiff":
+	case "iiif":
+		if p.IIIFID == "" {
+			return fmt.Errorf("IIIF output needs an id")
+		}
+		switch p.IIIFVersion {
+		case "", "2", "3":
+		default:
+			return fmt.Errorf("unknown IIIF Image API version %s", p.IIIFVersion)
+		}
+	case "dzi":
+		if p.TileWidth != p.TileHeight {
+			return fmt.Errorf("DZI tiles must be square, not %dx%d", p.TileWidth, p.TileHeight)
+		}
+		if p.TileOverlap >= p.TileWidth {
+			return fmt.Errorf("invalid tile overlap %d", p.TileOverlap)
+		}
+		switch p.TileFormat {
+		case "", "jpg", "png":
+		default:
+			return fmt.Errorf("unknown tile format %s", p.TileFormat)
+		}
+	case "zoomify":
+		if p.TileWidth != p.TileHeight {
+			return fmt.Errorf("Zoomify tiles must be square, not %dx%d", p.TileWidth, p.TileHeight)
+		}
+	default:
+		return fmt.Errorf("unknown output format %s", p.OutputFormat)
+	}
+	switch p.Metadata {
+	case "", "drop", "all":
+	case "allowlist":
+		if len(p.MetadataTags) == 0 {
+			return fmt.Errorf("metadata allowlist is empty")
+		}
+		for _, tag := range p.MetadataTags {
+			if !tagName.MatchString(tag) {
+				return fmt.Errorf("invalid metadata tag %q", tag)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid metadata policy %s", p.Metadata)
+	}
+	switch p.Tags.CopyrightStatus {
+	case "", "True", "False":
+	default:
+		return fmt.Errorf("invalid copyright status %s", p.Tags.CopyrightStatus)
+	}
+	if c.WritesMetadata() && c.WritesTiles() {
+		return fmt.Errorf("%s output cannot carry metadata", p.OutputFormat)
+	}
+	if c.WritesMetadata() && p.BigTIFF == "always" {
+		return fmt.Errorf("metadata cannot be written to BigTIFF")
+	}
+	switch p.PyramidBuilder {
+	case "", "tiffcp", "native":
+	default:
+		return fmt.Errorf("unknown pyramid builder %s", p.PyramidBuilder)
+	}
+	switch p.BigTIFF {
+	case "", "auto", "always", "never":
+	default:
+		return fmt.Errorf("invalid BigTIFF option %s", p.BigTIFF)
+	}
+	switch p.Kernel {
+	case "", "nearest", "linear", "cubic", "lanczos3":
+	default:
+		return fmt.Errorf("unknown resampling kernel %s", p.Kernel)
+	}
+	switch p.LevelSource {
+	case "", "previous", "full":
+	default:
+		return fmt.Errorf("invalid level source %s", p.LevelSource)
+	}
+	if p.Sharpen < 0 {
+		return fmt.Errorf("invalid sharpen sigma %g", p.Sharpen)
+	}
+	switch p.HighBitDepth {
+	case "", "keep", "reduce", "fail":
+	default:
+		return fmt.Errorf("invalid HighBitDepth option %s", p.HighBitDepth)
+	}
+	switch p.LosslessCompression {
+	case "", "deflate", "lzw", "zstd":
+	default:
+		return fmt.Errorf("invalid lossless compression %s", p.LosslessCompression)
+	}
+
+	requested := c.RequestedCompression()
+	if err := requested.Validate(); err != nil {
+		return fmt.Errorf("invalid compression - %v", err)
+	}
+	if p.PyramidBuilder == "native" {
+		lossless := compression.Option{Codec: compression.Codec(p.LosslessCompression)}
+		for _, o := range []compression.Option{requested, lossless} {
+			if err := setPTIFFCompression(&ptiff.Options{}, o); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WritesTiles tells whether the output is a tree of tile images rather
+// than a pyramidal TIFF.
+func (c *Context) WritesTiles() bool {
+	return c.Input.OutputFormat != "" && c.Input.OutputFormat != "tiff"
+}
+
+// CopiesMetadata tells whether metadata of the input is to be copied into
+// the output.
+func (c *Context) CopiesMetadata() bool {
+	return c.Input.Metadata == "allowlist" || c.Input.Metadata == "all"
+}
+
+// WritesMetadata tells whether exiftool is to write into the output,
+// either metadata of the input or rights metadata.
+func (c *Context) WritesMetadata() bool {
+	return c.CopiesMetadata() || len(c.Input.Tags.Assignments()) > 0
+}
+
+// MetadataTags returns the exiftool names of the tags to copy from the
+// input into the output.
+func (c *Context) MetadataTags() []string {
+	switch c.Input.Metadata {
+	case "allowlist":
+		return c.Input.MetadataTags
+	case "all":
+		return []string{"EXIF:all", "XMP:all", "IPTC:all"}
+	default:
+		return nil
+	}
+}
+
+// KeepsHighBitDepth tells whether the input has more than 8 bits per
+// sample and the pyramid is to keep them.
+func (c *Context) KeepsHighBitDepth() bool {
+	return c.BitDepth > 8 && c.Input.HighBitDepth == "keep"
+}
+
+// LevelSizes returns the dimensions of every level of the pyramid,
+// starting with the top-level image of w x h. Each level is half the size
+// of the one above, down to the last one whose long edge is at least
+// MinLevelSize, and there are no more than MaxLevels levels.
+func (c *Context) LevelSizes(w, h uint) []output.Level {
+	sizes := []output.Level{{Width: w, Height: h}}
+	min, max := c.Input.MinLevelSize, c.Input.MaxLevels
+	for w, h = w/2, h/2; w > 0 && h > 0 && (w >= min || h >= min); w, h = w/2, h/2 {
+		if max != 0 && uint(len(sizes)) >= max {
+			break
+		}
+		sizes = append(sizes, output.Level{Width: w, Height: h})
+	}
+	return sizes
+}
+
+// EstimatedPyramidBytes estimates the size of the uncompressed pyramid
+// built from the top-level image of w x h, including the padding of
+// the tiles at the right and bottom edges.
+func (c *Context) EstimatedPyramidBytes(w, h uint) uint64 {
+	tileW, tileH := uint64(c.Input.TileWidth), uint64(c.Input.TileHeight)
+
+	bands, depth := c.Bands, c.BitDepth
+	if bands == 0 {
+		bands = 3
+	}
+	if !c.KeepsHighBitDepth() {
+		depth = 8
+	}
+	tileBytes := tileW * tileH * uint64(bands) * uint64((depth+7)/8)
+
+	var total uint64
+	for _, s := range c.LevelSizes(w, h) {
+		across := (uint64(s.Width) + tileW - 1) / tileW
+		down := (uint64(s.Height) + tileH - 1) / tileH
+		total += across * down * tileBytes
+	}
+	return total
+}
+
+// UseBigTIFF tells whether the pyramid with the top-level image of w x h
+// should be written as BigTIFF.
+func (c *Context) UseBigTIFF(w, h uint) (bool, error) {
+	switch c.Input.BigTIFF {
+	case "", "auto":
+		return c.EstimatedPyramidBytes(w, h) > classicTIFFLimit, nil
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid BigTIFF option %s", c.Input.BigTIFF)
+	}
+}
+
+// RequestedCompression returns the compression set in the parameters.
+func (c *Context) RequestedCompression() compression.Option {
+	o := compression.Option{
+		Codec:     compression.Codec(c.Input.Compression),
+		Level:     c.Input.CompressionLevel,
+		Predictor: compression.Predictor(c.Input.Predictor),
+	}
+	if o.Codec == compression.JPEG || o.Codec == compression.WebP {
+		o.Quality = c.Input.Quality
+	}
+	return o
+}
+
+// Compression returns the compression of the tiles. Levels of more than
+// 8 bits per sample are compressed with LosslessCompression and the
+// horizontal predictor instead of the requested compression.
+func (c *Context) Compression() compression.Option {
+	if c.OutBitDepth > 8 {
+		o := compression.Option{
+			Codec:     compression.Codec(c.Input.LosslessCompression),
+			Predictor: compression.PredictorHorizontal,
+		}
+		if o.Codec == compression.Codec(c.Input.Compression) {
+			o.Level = c.Input.CompressionLevel
+		}
+		return o
+	}
+	return c.RequestedCompression()
+}
+
+// PTIFFOptions returns the options for the native pyramid writer.
+func (c *Context) PTIFFOptions() (ptiff.Options, error) {
+	opts := ptiff.Options{
+		TileWidth:  int(c.Input.TileWidth),
+		TileHeight: int(c.Input.TileHeight),
+	}
+	err := setPTIFFCompression(&opts, c.Compression())
+	return opts, err
+}
+
+// setPTIFFCompression sets the compression of opts to o. The native
+// writer has no LZW, ZSTD or WebP encoder.
+func setPTIFFCompression(opts *ptiff.Options, o compression.Option) error {
+	switch o.Codec {
+	case compression.None:
+		opts.Compression = ptiff.CompressionNone
+	case compression.JPEG:
+		opts.Compression, opts.Quality = ptiff.CompressionJPEG, o.Quality
+	case compression.Deflate:
+		opts.Compression, opts.Level = ptiff.CompressionDeflate, o.Level
+		if o.Predictor == compression.PredictorHorizontal {
+			opts.Predictor = ptiff.PredictorHorizontal
+		}
 	default:
-		return ""
+		return fmt.Errorf("compression %s is not supported by the native pyramid builder", o.Codec)
 	}
+	return nil
 }
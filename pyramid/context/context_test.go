@@ -0,0 +1,208 @@
+package context
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gigamorph/go-pyramid/pyramid/compression"
+	"github.com/gigamorph/go-pyramid/pyramid/input"
+	"github.com/gigamorph/go-pyramid/pyramid/output"
+	"github.com/gigamorph/go-pyramid/pyramid/ptiff"
+	"github.com/gigamorph/go-pyramid/shellcmds/exiftool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevelSizes(t *testing.T) {
+	c := New(input.Params{InFile: "a.tif"})
+
+	sizes := c.LevelSizes(1000, 600)
+	assert.Equal(t, []output.Level{level(1000, 600), level(500, 300), level(250, 150)}, sizes, "levels of 1000x600")
+
+	sizes = c.LevelSizes(100, 80)
+	assert.Equal(t, []output.Level{level(100, 80)}, sizes, "small image has a single level")
+
+	c.Input.MinLevelSize = 500
+	sizes = c.LevelSizes(1000, 600)
+	assert.Equal(t, []output.Level{level(1000, 600), level(500, 300)}, sizes, "MinLevelSize")
+
+	c.Input.MinLevelSize = 1
+	c.Input.MaxLevels = 4
+	sizes = c.LevelSizes(1000, 600)
+	assert.Equal(t, 4, len(sizes), "MaxLevels")
+	assert.Equal(t, level(125, 75), sizes[3], "MaxLevels - smallest level")
+}
+
+func TestValidate(t *testing.T) {
+	c := New(input.Params{InFile: "a.tif"})
+	assert.Nil(t, c.Validate(), "defaults are valid")
+	assert.Equal(t, uint(256), c.Input.TileWidth, "default tile width")
+
+	c = New(input.Params{InFile: "a.tif", TileWidth: 500, TileHeight: 512})
+	assert.NotNil(t, c.Validate(), "tile width not a multiple of 16")
+
+	c = New(input.Params{InFile: "a.tif", PyramidBuilder: "magick"})
+	assert.NotNil(t, c.Validate(), "unknown builder")
+
+	c = New(input.Params{InFile: "a.tif", HighBitDepth: "truncate"})
+	assert.NotNil(t, c.Validate(), "unknown HighBitDepth option")
+
+	c = New(input.Params{InFile: "a.tif", LosslessCompression: "jpeg"})
+	assert.NotNil(t, c.Validate(), "lossy LosslessCompression")
+
+	c = New(input.Params{InFile: "a.tif", Compression: "jpeg-xl"})
+	assert.NotNil(t, c.Validate(), "unknown codec")
+
+	c = New(input.Params{InFile: "a.tif", Compression: "jpeg", Predictor: "horizontal"})
+	assert.NotNil(t, c.Validate(), "predictor with JPEG")
+
+	c = New(input.Params{InFile: "a.tif", Compression: "webp", Quality: 80})
+	assert.Nil(t, c.Validate(), "WebP with tiffcp")
+
+	c = New(input.Params{InFile: "a.tif", Compression: "webp", PyramidBuilder: "native"})
+	assert.NotNil(t, c.Validate(), "WebP with the native builder")
+
+	c = New(input.Params{InFile: "a.tif", LosslessCompression: "zstd", PyramidBuilder: "native"})
+	assert.NotNil(t, c.Validate(), "lossless ZSTD with the native builder")
+
+	c = New(input.Params{InFile: "a.tif", OutputFormat: "deepzoom"})
+	assert.NotNil(t, c.Validate(), "unknown output format")
+
+	c = New(input.Params{InFile: "a.tif", OutputFormat: "iiif", IIIFID: "https://example.org/iiif/a"})
+	assert.Nil(t, c.Validate(), "IIIF output")
+	assert.Equal(t, "reduce", c.Input.HighBitDepth, "IIIF output reduces high bit depth by default")
+
+	c = New(input.Params{InFile: "a.tif", OutputFormat: "iiif", IIIFID: "https://example.org/iiif/a", IIIFVersion: "1.1"})
+	assert.NotNil(t, c.Validate(), "unknown IIIF version")
+
+	c = New(input.Params{InFile: "a.tif", OutputFormat: "dzi", TileWidth: 254, TileHeight: 254, TileOverlap: 1})
+	assert.Nil(t, c.Validate(), "DZI tiles need not be multiples of 16")
+
+	c = New(input.Params{InFile: "a.tif", OutputFormat: "dzi", TileWidth: 256, TileHeight: 512})
+	assert.NotNil(t, c.Validate(), "DZI tiles not square")
+
+	c = New(input.Params{InFile: "a.tif", OutputFormat: "dzi", TileFormat: "webp"})
+	assert.NotNil(t, c.Validate(), "unknown DZI tile format")
+
+	c = New(input.Params{InFile: "a.tif", OutputFormat: "zoomify", TileWidth: 256, TileHeight: 128})
+	assert.NotNil(t, c.Validate(), "Zoomify tiles not square")
+
+	c = New(input.Params{InFile: "a.tif", Metadata: "allowlist", MetadataTags: []string{"EXIF:Artist", "XMP-dc:Creator", "IPTC:By-line"}})
+	assert.Nil(t, c.Validate(), "metadata allowlist")
+
+	c = New(input.Params{InFile: "a.tif", Metadata: "allowlist"})
+	assert.NotNil(t, c.Validate(), "empty metadata allowlist")
+
+	c = New(input.Params{InFile: "a.tif", Metadata: "allowlist", MetadataTags: []string{"-all="}})
+	assert.NotNil(t, c.Validate(), "metadata tag that is an exiftool option")
+
+	c = New(input.Params{InFile: "a.tif", Metadata: "some"})
+	assert.NotNil(t, c.Validate(), "unknown metadata policy")
+
+	c = New(input.Params{InFile: "a.tif", Metadata: "all", BigTIFF: "always"})
+	assert.NotNil(t, c.Validate(), "metadata with BigTIFF")
+
+	c = New(input.Params{InFile: "a.tif", Metadata: "all", OutputFormat: "zoomify"})
+	assert.NotNil(t, c.Validate(), "metadata with tile output")
+
+	c = New(input.Params{InFile: "a.tif", Tags: exiftool.TagsInput{CopyrightStatus: "yes"}})
+	assert.NotNil(t, c.Validate(), "invalid copyright status")
+
+	c = New(input.Params{InFile: "a.tif", Tags: exiftool.TagsInput{Source: "Museum"}, OutputFormat: "dzi"})
+	assert.NotNil(t, c.Validate(), "rights metadata with tile output")
+}
+
+func TestCompression(t *testing.T) {
+	c := New(input.Params{InFile: "a.tif", Compression: "deflate", Quality: 80, CompressionLevel: 9, Predictor: "horizontal"})
+	c.OutBitDepth = 8
+	want := compression.Option{Codec: compression.Deflate, Level: 9, Predictor: compression.PredictorHorizontal}
+	assert.Equal(t, want, c.Compression(), "quality is ignored by deflate")
+
+	opts, err := c.PTIFFOptions()
+	assert.Nil(t, err, "native")
+	assert.Equal(t, ptiff.CompressionDeflate, opts.Compression, "native - compression")
+	assert.Equal(t, 9, opts.Level, "native - level")
+	assert.Equal(t, ptiff.PredictorHorizontal, opts.Predictor, "native - predictor")
+
+	c = New(input.Params{InFile: "a.tif", Compression: "webp"})
+	assert.Equal(t, compression.Option{Codec: compression.WebP, Quality: 90}, c.Compression(), "default quality")
+}
+
+func TestHighBitDepthCompression(t *testing.T) {
+	c := New(input.Params{InFile: "a.tif"})
+	c.BitDepth, c.OutBitDepth = 16, 16
+	assert.True(t, c.KeepsHighBitDepth(), "keep is the default")
+	want := compression.Option{Codec: compression.Deflate, Predictor: compression.PredictorHorizontal}
+	assert.Equal(t, want, c.Compression(), "default")
+
+	opts, err := c.PTIFFOptions()
+	assert.Nil(t, err, "native - default")
+	assert.Equal(t, ptiff.CompressionDeflate, opts.Compression, "native - compression")
+	assert.Equal(t, ptiff.PredictorHorizontal, opts.Predictor, "native - predictor")
+
+	c.Input.LosslessCompression = "zstd"
+	assert.Equal(t, compression.ZSTD, c.Compression().Codec, "zstd")
+	_, err = c.PTIFFOptions()
+	assert.NotNil(t, err, "native - zstd is not supported")
+
+	c.Input.HighBitDepth = "reduce"
+	c.OutBitDepth = 8
+	assert.False(t, c.KeepsHighBitDepth(), "reduce")
+	assert.Equal(t, compression.Option{Codec: compression.JPEG, Quality: 90}, c.Compression(), "reduced to 8 bits")
+}
+
+func TestUseBigTIFF(t *testing.T) {
+	c := New(input.Params{InFile: "a.tif"})
+	c.Bands = 3
+	c.BitDepth = 16
+
+	// 20000 x 20000 x 3 x 2 bytes = 2.4 GB, about 3.2 GB with all levels
+	big, err := c.UseBigTIFF(20000, 20000)
+	assert.Nil(t, err, "auto - no error")
+	assert.False(t, big, "auto - 20000x20000 16 bit RGB fits classic TIFF")
+
+	// 30000 x 30000 x 3 x 2 bytes = 5.4 GB
+	big, err = c.UseBigTIFF(30000, 30000)
+	assert.Nil(t, err, "auto - no error")
+	assert.True(t, big, "auto - 30000x30000 16 bit RGB needs BigTIFF")
+
+	c.Input.BigTIFF = "never"
+	big, _ = c.UseBigTIFF(30000, 30000)
+	assert.False(t, big, "never")
+
+	c.Input.BigTIFF = "always"
+	big, _ = c.UseBigTIFF(100, 100)
+	assert.True(t, big, "always")
+
+	c.Input.BigTIFF = "sometimes"
+	_, err = c.UseBigTIFF(100, 100)
+	assert.NotNil(t, err, "invalid option")
+}
+
+func level(w, h uint) output.Level {
+	return output.Level{Width: w, Height: h}
+}
+
+func TestMakeWorkDir(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "go-pyramid-context-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	c1 := New(input.Params{InFile: "/a/0001.tif", TempDir: tempDir})
+	c2 := New(input.Params{InFile: "/b/0001.tif", TempDir: tempDir})
+	assert.Nil(t, c1.MakeWorkDir(), "MakeWorkDir 1")
+	assert.Nil(t, c2.MakeWorkDir(), "MakeWorkDir 2")
+
+	assert.NotEqual(t, c1.WorkDir, c2.WorkDir, "work dirs are unique")
+	assert.NotEqual(t, c1.TiffFile, c2.TiffFile, "temp files are unique")
+	assert.Equal(t, c1.WorkDir, filepath.Dir(c1.TiffFile), "temp files are in the work dir")
+
+	assert.Nil(t, c1.RemoveWorkDir(), "RemoveWorkDir")
+	_, err = os.Stat(c1.WorkDir)
+	assert.True(t, os.IsNotExist(err), "work dir 1 removed")
+	_, err = os.Stat(c2.WorkDir)
+	assert.Nil(t, err, "work dir 2 kept")
+}
@@ -0,0 +1,266 @@
+package icc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/gigamorph/go-pyramid/pyramid/ptiff"
+)
+
+// maxProfileSize limits the size of the profiles read by the Extract
+// functions, so that a corrupt file cannot exhaust memory.
+const maxProfileSize = 64 << 20
+
+// ErrUnknownFormat is returned by Extract for files that are not JPEG,
+// TIFF, PNG or WebP.
+var ErrUnknownFormat = errors.New("unknown image format")
+
+// ExtractFile returns the ICC profile embedded in the image file at path,
+// or nil if there is none.
+func ExtractFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("icc.ExtractFile failed to open %s - %w", path, err)
+	}
+	defer f.Close()
+	b, err := Extract(f)
+	if err != nil {
+		return nil, fmt.Errorf("icc.ExtractFile %s - %w", path, err)
+	}
+	return b, nil
+}
+
+// Extract returns the ICC profile embedded in the JPEG, TIFF, PNG or WebP
+// image read from r, or nil if there is none. Only the metadata in front
+// of the image data is read.
+func Extract(r io.ReaderAt) ([]byte, error) {
+	var magic [12]byte
+	n, err := r.ReadAt(magic[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	m := magic[:n]
+	stream := io.NewSectionReader(r, 0, math.MaxInt64)
+
+	switch {
+	case bytes.HasPrefix(m, []byte{0xff, 0xd8}):
+		return ExtractJPEG(stream)
+	case bytes.HasPrefix(m, []byte("\x89PNG\r\n\x1a\n")):
+		return ExtractPNG(stream)
+	case len(m) == 12 && string(m[0:4]) == "RIFF" && string(m[8:12]) == "WEBP":
+		return ExtractWebP(stream)
+	case bytes.HasPrefix(m, []byte("II")) || bytes.HasPrefix(m, []byte("MM")):
+		return ExtractTIFF(r)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// ExtractJPEG returns the profile carried by the APP2 "ICC_PROFILE"
+// segments of a JPEG file, joining the chunks of a profile split over
+// several segments.
+func ExtractJPEG(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, fmt.Errorf("icc.ExtractJPEG not a JPEG file")
+	}
+
+	iccMarker := []byte("ICC_PROFILE\x00")
+	var chunks [][]byte // by sequence number - 1
+	for {
+		marker, err := nextJPEGMarker(br)
+		if err != nil {
+			return nil, fmt.Errorf("icc.ExtractJPEG - %w", err)
+		}
+		switch {
+		case marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			continue // no payload
+		case marker == 0xda || marker == 0xd9:
+			return joinJPEGChunks(chunks) // start of scan or end of image
+		}
+
+		var lb [2]byte
+		if _, err := io.ReadFull(br, lb[:]); err != nil {
+			return nil, fmt.Errorf("icc.ExtractJPEG truncated segment - %w", err)
+		}
+		length := int(binary.BigEndian.Uint16(lb[:]))
+		if length < 2 {
+			return nil, fmt.Errorf("icc.ExtractJPEG invalid segment length %d", length)
+		}
+		if marker != 0xe2 {
+			if _, err := br.Discard(length - 2); err != nil {
+				return nil, fmt.Errorf("icc.ExtractJPEG truncated segment - %w", err)
+			}
+			continue
+		}
+
+		data := make([]byte, length-2)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("icc.ExtractJPEG truncated segment - %w", err)
+		}
+		if len(data) < len(iccMarker)+2 || !bytes.Equal(data[:len(iccMarker)], iccMarker) {
+			continue // some other APP2 segment, e.g. FlashPix
+		}
+		seq, count := int(data[len(iccMarker)]), int(data[len(iccMarker)+1])
+		if chunks == nil {
+			chunks = make([][]byte, count)
+		}
+		if count != len(chunks) || seq < 1 || seq > count || chunks[seq-1] != nil {
+			return nil, fmt.Errorf("icc.ExtractJPEG invalid ICC_PROFILE chunk %d of %d", seq, count)
+		}
+		chunks[seq-1] = data[len(iccMarker)+2:]
+	}
+}
+
+// nextJPEGMarker skips to the next marker and returns its code.
+func nextJPEGMarker(br *bufio.Reader) (byte, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, fmt.Errorf("marker expected, found 0x%02x", b)
+	}
+	for b == 0xff { // fill bytes
+		if b, err = br.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+func joinJPEGChunks(chunks [][]byte) ([]byte, error) {
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	var profile []byte
+	for i, c := range chunks {
+		if c == nil {
+			return nil, fmt.Errorf("icc.ExtractJPEG ICC_PROFILE chunk %d of %d missing", i+1, len(chunks))
+		}
+		profile = append(profile, c...)
+	}
+	return profile, nil
+}
+
+// ExtractTIFF returns the profile in the ICC tag (34675) of the first
+// image of a TIFF file.
+func ExtractTIFF(r io.ReaderAt) ([]byte, error) {
+	f, err := ptiff.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("icc.ExtractTIFF - %w", err)
+	}
+	if len(f.IFDs) == 0 {
+		return nil, fmt.Errorf("icc.ExtractTIFF no image")
+	}
+	return f.IFDs[0].Bytes(ptiff.TagICCProfile), nil
+}
+
+// ExtractPNG returns the profile in the iCCP chunk of a PNG file.
+func ExtractPNG(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	var sig [8]byte
+	if _, err := io.ReadFull(br, sig[:]); err != nil || string(sig[:]) != "\x89PNG\r\n\x1a\n" {
+		return nil, fmt.Errorf("icc.ExtractPNG not a PNG file")
+	}
+
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return nil, fmt.Errorf("icc.ExtractPNG truncated chunk - %w", err)
+		}
+		length := binary.BigEndian.Uint32(hdr[0:4])
+		typ := string(hdr[4:8])
+		if length > 1<<31-1 {
+			return nil, fmt.Errorf("icc.ExtractPNG invalid length of chunk %q", typ)
+		}
+
+		switch typ {
+		case "IDAT", "IEND":
+			return nil, nil // iCCP must come before the image data
+		case "iCCP":
+			if length > maxProfileSize {
+				return nil, fmt.Errorf("icc.ExtractPNG iCCP chunk too large")
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return nil, fmt.Errorf("icc.ExtractPNG truncated iCCP chunk - %w", err)
+			}
+			return inflateICCP(data)
+		}
+		if _, err := io.CopyN(ioutil.Discard, br, int64(length)+4); err != nil { // data and CRC
+			return nil, fmt.Errorf("icc.ExtractPNG truncated chunk %q - %w", typ, err)
+		}
+	}
+}
+
+// inflateICCP decodes iCCP chunk data: a profile name, a NUL, the
+// compression method (0, zlib) and the compressed profile.
+func inflateICCP(data []byte) ([]byte, error) {
+	nul := bytes.IndexByte(data, 0)
+	if nul < 1 || nul > 79 || nul+1 >= len(data) {
+		return nil, fmt.Errorf("icc.ExtractPNG invalid iCCP profile name")
+	}
+	if method := data[nul+1]; method != 0 {
+		return nil, fmt.Errorf("icc.ExtractPNG unsupported iCCP compression method %d", method)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data[nul+2:]))
+	if err != nil {
+		return nil, fmt.Errorf("icc.ExtractPNG invalid iCCP data - %w", err)
+	}
+	defer zr.Close()
+	profile, err := ioutil.ReadAll(io.LimitReader(zr, maxProfileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("icc.ExtractPNG invalid iCCP data - %w", err)
+	}
+	if len(profile) > maxProfileSize {
+		return nil, fmt.Errorf("icc.ExtractPNG iCCP profile too large")
+	}
+	return profile, nil
+}
+
+// ExtractWebP returns the profile in the ICCP chunk of a WebP file.
+func ExtractWebP(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	var hdr [12]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil || string(hdr[0:4]) != "RIFF" || string(hdr[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("icc.ExtractWebP not a WebP file")
+	}
+
+	for {
+		var ch [8]byte
+		if _, err := io.ReadFull(br, ch[:]); err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("icc.ExtractWebP truncated chunk - %w", err)
+		}
+		fourCC := string(ch[0:4])
+		size := binary.LittleEndian.Uint32(ch[4:8])
+
+		if fourCC == "ICCP" {
+			if size > maxProfileSize {
+				return nil, fmt.Errorf("icc.ExtractWebP ICCP chunk too large")
+			}
+			profile := make([]byte, size)
+			if _, err := io.ReadFull(br, profile); err != nil {
+				return nil, fmt.Errorf("icc.ExtractWebP truncated ICCP chunk - %w", err)
+			}
+			return profile, nil
+		}
+		if fourCC == "VP8 " || fourCC == "VP8L" {
+			return nil, nil // simple format, or ICCP would have come first
+		}
+		skip := int64(size) + int64(size&1) // chunks are padded to an even size
+		if _, err := io.CopyN(ioutil.Discard, br, skip); err != nil {
+			return nil, fmt.Errorf("icc.ExtractWebP truncated chunk %q - %w", fourCC, err)
+		}
+	}
+}
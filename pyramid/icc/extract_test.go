@@ -0,0 +1,193 @@
+package icc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtract(t *testing.T) {
+	profile, err := ioutil.ReadFile("../../test/resources/sRGBProfile.icc")
+	if err != nil {
+		panic(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"JPEG", jpegWithProfile(profile, 60000), profile},
+		{"JPEGMultiChunk", jpegWithProfile(profile, 1000), profile},
+		{"JPEGNoProfile", jpegWithProfile(nil, 0), nil},
+		{"PNG", pngWithProfile(profile), profile},
+		{"PNGNoProfile", pngWithProfile(nil), nil},
+		{"WebP", webpWithProfile(profile), profile},
+		{"WebPNoProfile", webpWithProfile(nil), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Extract(bytes.NewReader(tt.data))
+			assert.Nil(t, err, "Extract")
+			assert.Equal(t, tt.want, got, "profile")
+		})
+	}
+
+	t.Run("TIFF", func(t *testing.T) {
+		got, err := ExtractFile("../../test/resources/images/grayscale-with-adobe-rgb-1998.tif")
+		assert.Nil(t, err, "ExtractFile")
+		assert.Equal(t, "Adobe RGB (1998)", description(t, got), "profile")
+	})
+
+	t.Run("File", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "icc-test")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "a.jpg")
+		ioutil.WriteFile(path, jpegWithProfile(profile, 2000), 0600)
+
+		got, err := ExtractFile(path)
+		assert.Nil(t, err, "ExtractFile")
+		assert.Equal(t, profile, got, "profile")
+	})
+}
+
+func TestExtractMalformed(t *testing.T) {
+	profile, err := ioutil.ReadFile("../../test/resources/sRGBProfile.icc")
+	if err != nil {
+		panic(err)
+	}
+	multi := jpegWithProfile(profile, 1000)
+	app2 := bytes.Index(multi, []byte("ICC_PROFILE"))
+	secondChunk := app2 + bytes.Index(multi[app2+1:], []byte("ICC_PROFILE")) + 1
+
+	missingChunk := append([]byte(nil), multi...)
+	missingChunk[secondChunk+12] = 9 // sequence number out of range
+	duplicateChunk := append([]byte(nil), multi...)
+	duplicateChunk[secondChunk+12] = 1
+
+	pngData := pngWithProfile(profile)
+	iccp := bytes.Index(pngData, []byte("iCCP"))
+	badMethod := append([]byte(nil), pngData...)
+	badMethod[iccp+4+len("icc")+1] = 1
+
+	tests := map[string][]byte{
+		"Unknown":          []byte("GIF89a"),
+		"Empty":            nil,
+		"JPEGTruncated":    multi[:app2+500],
+		"JPEGMissingChunk": missingChunk,
+		"JPEGDuplicate":    duplicateChunk,
+		"PNGTruncated":     pngData[:iccp+20],
+		"PNGMethod":        badMethod,
+		"WebPTruncated":    webpWithProfile(profile)[:100],
+		"TIFFTruncated":    []byte("II*\x00\xff\xff\x00\x00"),
+	}
+	for name, data := range tests {
+		_, err := Extract(bytes.NewReader(data))
+		assert.NotNil(t, err, "%s should fail", name)
+	}
+}
+
+// description parses profile and returns its description.
+func description(t *testing.T, profile []byte) string {
+	p, err := Parse(profile)
+	if err != nil {
+		t.Fatalf("Parse - %v", err)
+	}
+	desc, _ := p.Description()
+	return desc
+}
+
+// jpegWithProfile returns a small JPEG image with profile split in
+// APP2 segments of at most chunkSize bytes.
+func jpegWithProfile(profile []byte, chunkSize int) []byte {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)), nil)
+	img := buf.Bytes()
+	if profile == nil {
+		return img
+	}
+
+	var segments []byte
+	count := (len(profile) + chunkSize - 1) / chunkSize
+	for i := 0; i < count; i++ {
+		chunk := profile[i*chunkSize:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		seg := []byte{0xff, 0xe2, 0, 0}
+		seg = append(seg, "ICC_PROFILE\x00"...)
+		seg = append(seg, byte(i+1), byte(count))
+		seg = append(seg, chunk...)
+		binary.BigEndian.PutUint16(seg[2:4], uint16(len(seg)-2))
+		segments = append(segments, seg...)
+	}
+	// After SOI and before the other segments.
+	return append(append(append([]byte(nil), img[:2]...), segments...), img[2:]...)
+}
+
+// pngWithProfile returns a small PNG image with profile in an iCCP chunk.
+func pngWithProfile(profile []byte) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)))
+	img := buf.Bytes()
+	if profile == nil {
+		return img
+	}
+
+	var data bytes.Buffer
+	data.WriteString("icc\x00\x00")
+	zw := zlib.NewWriter(&data)
+	zw.Write(profile)
+	zw.Close()
+
+	chunk := make([]byte, 8, 12+data.Len())
+	binary.BigEndian.PutUint32(chunk[0:4], uint32(data.Len()))
+	copy(chunk[4:8], "iCCP")
+	chunk = append(chunk, data.Bytes()...)
+	chunk = append(chunk, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(chunk[len(chunk)-4:], crc32.ChecksumIEEE(chunk[4:len(chunk)-4]))
+
+	ihdrEnd := 8 + 8 + 13 + 4
+	return append(append(append([]byte(nil), img[:ihdrEnd]...), chunk...), img[ihdrEnd:]...)
+}
+
+// webpWithProfile returns the chunks of an extended WebP file with profile
+// in an ICCP chunk, followed by a dummy image chunk.
+func webpWithProfile(profile []byte) []byte {
+	chunk := func(fourCC string, data []byte) []byte {
+		c := make([]byte, 8, 8+len(data)+1)
+		copy(c, fourCC)
+		binary.LittleEndian.PutUint32(c[4:8], uint32(len(data)))
+		c = append(c, data...)
+		if len(data)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+
+	body := []byte("WEBP")
+	body = append(body, chunk("VP8X", make([]byte, 10))...)
+	body = append(body, chunk("EXIF", []byte("odd"))...)
+	if profile != nil {
+		body = append(body, chunk("ICCP", profile)...)
+	}
+	body = append(body, chunk("VP8L", make([]byte, 20))...)
+
+	riff := make([]byte, 8, 8+len(body))
+	copy(riff, "RIFF")
+	binary.LittleEndian.PutUint32(riff[4:8], uint32(len(body)))
+	return append(riff, body...)
+}
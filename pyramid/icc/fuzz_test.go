@@ -0,0 +1,61 @@
+//go:build go1.18
+// +build go1.18
+
+package icc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// FuzzParse checks that no input makes Parse or the tag decoders panic.
+//
+//	go test -fuzz=FuzzParse ./pyramid/icc
+func FuzzParse(f *testing.F) {
+	for _, path := range []string{
+		"../../test/resources/sRGBProfile.icc",
+		"../../test/resources/AdobeRGB1998.icc",
+	} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatalf("ReadFile - %v", err)
+		}
+		f.Add(b)
+	}
+	f.Add(buildProfile(4, ClassOutput, ColorSpaceCMYK, map[Signature][]byte{
+		TagDescription: mluc(map[string]string{"enUS": "Coated", "deDE": "Gestrichen"}),
+		TagCopyright:   mluc(map[string]string{"enUS": "No copyright"}),
+	}))
+	f.Add(buildProfile(2, ClassInput, ColorSpaceGray, map[Signature][]byte{
+		TagDescription: textDescription("Gray"),
+	}))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, err := Parse(b)
+		if err != nil {
+			return
+		}
+		p.Description()
+		p.Copyright()
+		for _, tag := range p.Tags {
+			p.TagData(tag.Signature)
+		}
+	})
+}
+
+// FuzzExtract checks that no input makes Extract panic.
+func FuzzExtract(f *testing.F) {
+	profile, err := ioutil.ReadFile("../../test/resources/sRGBProfile.icc")
+	if err != nil {
+		f.Fatalf("ReadFile - %v", err)
+	}
+	f.Add(jpegWithProfile(profile, 1000))
+	f.Add(pngWithProfile(profile))
+	f.Add(webpWithProfile(profile))
+	f.Add([]byte("II*\x00\x08\x00\x00\x00\x00\x00"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		Extract(bytes.NewReader(b))
+	})
+}
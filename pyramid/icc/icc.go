@@ -0,0 +1,272 @@
+// Package icc parses ICC colour profiles (ICC.1 versions 2 and 4).
+//
+// Parse checks every offset and length against the profile data, so
+// malformed or truncated profiles produce errors instead of panics.
+package icc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	headerSize   = 128
+	tagEntrySize = 12
+)
+
+// Signature is a four-character code, e.g. a tag or a colour space.
+type Signature uint32
+
+// String returns the four characters of s, without trailing spaces.
+func (s Signature) String() string {
+	b := []byte{byte(s >> 24), byte(s >> 16), byte(s >> 8), byte(s)}
+	return strings.TrimRight(string(b), " \x00")
+}
+
+// Profile/device classes.
+const (
+	ClassInput      Signature = 0x73636E72 // 'scnr'
+	ClassDisplay    Signature = 0x6D6E7472 // 'mntr'
+	ClassOutput     Signature = 0x70727472 // 'prtr'
+	ClassLink       Signature = 0x6C696E6B // 'link'
+	ClassColorSpace Signature = 0x73706163 // 'spac'
+	ClassAbstract   Signature = 0x61627374 // 'abst'
+	ClassNamedColor Signature = 0x6E6D636C // 'nmcl'
+)
+
+// Colour spaces, of the data and of the profile connection space (PCS).
+const (
+	ColorSpaceXYZ  Signature = 0x58595A20 // 'XYZ '
+	ColorSpaceLab  Signature = 0x4C616220 // 'Lab '
+	ColorSpaceRGB  Signature = 0x52474220 // 'RGB '
+	ColorSpaceGray Signature = 0x47524159 // 'GRAY'
+	ColorSpaceCMYK Signature = 0x434D594B // 'CMYK'
+	ColorSpaceCMY  Signature = 0x434D5920 // 'CMY '
+	ColorSpaceYCbr Signature = 0x59436272 // 'YCbr'
+)
+
+// Tag signatures.
+const (
+	TagDescription Signature = 0x64657363 // 'desc'
+	TagCopyright   Signature = 0x63707274 // 'cprt'
+)
+
+// Tag types.
+const (
+	typeTextDescription  Signature = 0x64657363 // 'desc', v2
+	typeMultiLocalized   Signature = 0x6D6C7563 // 'mluc', v4
+	typeText             Signature = 0x74657874 // 'text'
+	profileFileSignature Signature = 0x61637370 // 'acsp'
+)
+
+// RenderingIntent is the rendering intent of the header.
+type RenderingIntent uint32
+
+// Rendering intents.
+const (
+	IntentPerceptual           RenderingIntent = 0
+	IntentRelativeColorimetric RenderingIntent = 1
+	IntentSaturation           RenderingIntent = 2
+	IntentAbsoluteColorimetric RenderingIntent = 3
+)
+
+// Version is the version of the ICC specification a profile follows.
+type Version struct {
+	Major, Minor, Bugfix uint8
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Bugfix)
+}
+
+// Tag is an entry of the tag table.
+type Tag struct {
+	Signature Signature
+	Offset    uint32 // from the start of the profile
+	Size      uint32
+}
+
+// Profile is a parsed ICC profile.
+type Profile struct {
+	Size            uint32 // size declared in the header
+	Version         Version
+	Class           Signature
+	ColorSpace      Signature
+	PCS             Signature
+	RenderingIntent RenderingIntent
+	ID              [16]byte // MD5 profile ID, zero if not computed (always in v2)
+	Tags            []Tag
+
+	data []byte
+}
+
+// Parse parses the header and the tag table of the profile in b.
+// The profile keeps a reference to b.
+func Parse(b []byte) (*Profile, error) {
+	if len(b) < headerSize+4 {
+		return nil, fmt.Errorf("icc.Parse profile too short (%d bytes)", len(b))
+	}
+	be := binary.BigEndian
+	if Signature(be.Uint32(b[36:40])) != profileFileSignature {
+		return nil, fmt.Errorf("icc.Parse not an ICC profile")
+	}
+
+	p := &Profile{
+		Size: be.Uint32(b[0:4]),
+		Version: Version{
+			Major:  b[8],
+			Minor:  b[9] >> 4,
+			Bugfix: b[9] & 0x0f,
+		},
+		Class:           Signature(be.Uint32(b[12:16])),
+		ColorSpace:      Signature(be.Uint32(b[16:20])),
+		PCS:             Signature(be.Uint32(b[20:24])),
+		RenderingIntent: RenderingIntent(be.Uint32(b[64:68]) & 0xffff),
+		data:            b,
+	}
+	copy(p.ID[:], b[84:100])
+
+	// Some writers get the declared size wrong; trust it only to drop
+	// trailing bytes.
+	if uint64(p.Size) >= headerSize+4 && uint64(p.Size) < uint64(len(b)) {
+		p.data = b[:p.Size]
+	}
+
+	n := be.Uint32(p.data[headerSize : headerSize+4])
+	if uint64(n) > uint64(len(p.data)-headerSize-4)/tagEntrySize {
+		return nil, fmt.Errorf("icc.Parse tag count %d exceeds the profile size", n)
+	}
+	p.Tags = make([]Tag, n)
+	for i := range p.Tags {
+		e := p.data[headerSize+4+i*tagEntrySize:]
+		p.Tags[i] = Tag{
+			Signature: Signature(be.Uint32(e[0:4])),
+			Offset:    be.Uint32(e[4:8]),
+			Size:      be.Uint32(e[8:12]),
+		}
+	}
+	return p, nil
+}
+
+// TagData returns the data of the first tag with signature sig.
+func (p *Profile) TagData(sig Signature) ([]byte, error) {
+	for _, t := range p.Tags {
+		if t.Signature != sig {
+			continue
+		}
+		end := uint64(t.Offset) + uint64(t.Size)
+		if end > uint64(len(p.data)) {
+			return nil, fmt.Errorf("icc.Profile#TagData tag %s out of bounds", sig)
+		}
+		return p.data[t.Offset:end], nil
+	}
+	return nil, fmt.Errorf("icc.Profile#TagData no tag %s", sig)
+}
+
+// Description returns the profile description ('desc' tag).
+func (p *Profile) Description() (string, error) {
+	return p.text(TagDescription)
+}
+
+// Copyright returns the copyright notice ('cprt' tag).
+func (p *Profile) Copyright() (string, error) {
+	return p.text(TagCopyright)
+}
+
+// text decodes a tag of textDescriptionType (v2), multiLocalizedUnicodeType
+// (v4) or textType.
+func (p *Profile) text(sig Signature) (string, error) {
+	data, err := p.TagData(sig)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < 8 {
+		return "", fmt.Errorf("icc.Profile#text tag %s too short", sig)
+	}
+	switch typ := Signature(binary.BigEndian.Uint32(data[0:4])); typ {
+	case typeTextDescription:
+		return decodeTextDescription(data)
+	case typeMultiLocalized:
+		return decodeMultiLocalized(data)
+	case typeText:
+		return cString(data[8:]), nil
+	default:
+		return "", fmt.Errorf("icc.Profile#text tag %s has unsupported type %s", sig, typ)
+	}
+}
+
+// decodeTextDescription decodes the ASCII part of a textDescriptionType.
+func decodeTextDescription(data []byte) (string, error) {
+	if len(data) < 12 {
+		return "", fmt.Errorf("icc.decodeTextDescription tag too short")
+	}
+	n := binary.BigEndian.Uint32(data[8:12])
+	if uint64(n) > uint64(len(data)-12) {
+		return "", fmt.Errorf("icc.decodeTextDescription ASCII length %d out of bounds", n)
+	}
+	return cString(data[12 : 12+n]), nil
+}
+
+// decodeMultiLocalized decodes a multiLocalizedUnicodeType, preferring
+// US English, then any English, then the first record.
+func decodeMultiLocalized(data []byte) (string, error) {
+	if len(data) < 16 {
+		return "", fmt.Errorf("icc.decodeMultiLocalized tag too short")
+	}
+	be := binary.BigEndian
+	n := be.Uint32(data[8:12])
+	recSize := be.Uint32(data[12:16])
+	if n == 0 {
+		return "", fmt.Errorf("icc.decodeMultiLocalized no records")
+	}
+	if recSize < 12 || uint64(n)*uint64(recSize) > uint64(len(data)-16) {
+		return "", fmt.Errorf("icc.decodeMultiLocalized invalid record table")
+	}
+
+	best, bestScore := 0, -1
+	for i := 0; i < int(n); i++ {
+		rec := data[16+uint32(i)*recSize:]
+		score := 0
+		if string(rec[0:2]) == "en" {
+			score = 1
+			if string(rec[2:4]) == "US" {
+				score = 2
+			}
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	rec := data[16+uint32(best)*recSize:]
+	length, offset := be.Uint32(rec[4:8]), be.Uint32(rec[8:12])
+	if uint64(offset)+uint64(length) > uint64(len(data)) {
+		return "", fmt.Errorf("icc.decodeMultiLocalized string out of bounds")
+	}
+	return decodeUTF16BE(data[offset : offset+length]), nil
+}
+
+// decodeUTF16BE decodes big-endian UTF-16, stopping at a NUL.
+func decodeUTF16BE(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		u := binary.BigEndian.Uint16(b[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return string(utf16.Decode(units))
+}
+
+// cString returns b up to the first NUL.
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
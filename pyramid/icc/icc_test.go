@@ -0,0 +1,206 @@
+package icc
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"sort"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	t.Run("SRGB", func(t *testing.T) {
+		p := parseFile(t, "../../test/resources/sRGBProfile.icc")
+		assert.Equal(t, Version{2, 1, 0}, p.Version, "version")
+		assert.Equal(t, "2.1.0", p.Version.String(), "version string")
+		assert.Equal(t, ClassDisplay, p.Class, "class")
+		assert.Equal(t, ColorSpaceRGB, p.ColorSpace, "colour space")
+		assert.Equal(t, "RGB", p.ColorSpace.String(), "colour space string")
+		assert.Equal(t, ColorSpaceXYZ, p.PCS, "PCS")
+		assert.Equal(t, IntentPerceptual, p.RenderingIntent, "rendering intent")
+		assert.Equal(t, [16]byte{}, p.ID, "no profile ID in v2")
+
+		desc, err := p.Description()
+		assert.Nil(t, err, "Description")
+		assert.Equal(t, "sRGB IEC61966-2.1", desc, "description without length or NULs")
+		cprt, err := p.Copyright()
+		assert.Nil(t, err, "Copyright")
+		assert.Equal(t, "Copyright (c) 1998 Hewlett-Packard Company", cprt, "copyright")
+	})
+
+	t.Run("AdobeRGB", func(t *testing.T) {
+		p := parseFile(t, "../../test/resources/AdobeRGB1998.icc")
+		desc, err := p.Description()
+		assert.Nil(t, err, "Description")
+		assert.Equal(t, "Adobe RGB (1998)", desc, "description")
+	})
+
+	t.Run("V4", func(t *testing.T) {
+		b := buildProfile(4, ClassOutput, ColorSpaceCMYK, map[Signature][]byte{
+			TagDescription: mluc(map[string]string{"deDE": "Beschichtet", "enUS": "Coated FOGRA39", "frFR": "Couché"}),
+		})
+		copy(b[84:100], "0123456789abcdef")
+		binary.BigEndian.PutUint32(b[64:68], uint32(IntentRelativeColorimetric))
+
+		p, err := Parse(b)
+		if err != nil {
+			t.Fatalf("Parse - %v", err)
+		}
+		assert.Equal(t, Version{4, 3, 0}, p.Version, "version")
+		assert.Equal(t, ClassOutput, p.Class, "class")
+		assert.Equal(t, ColorSpaceCMYK, p.ColorSpace, "colour space")
+		assert.Equal(t, IntentRelativeColorimetric, p.RenderingIntent, "rendering intent")
+		assert.Equal(t, "0123456789abcdef", string(p.ID[:]), "profile ID")
+		desc, err := p.Description()
+		assert.Nil(t, err, "Description")
+		assert.Equal(t, "Coated FOGRA39", desc, "US English record")
+	})
+
+	t.Run("V4NoEnglish", func(t *testing.T) {
+		b := buildProfile(4, ClassDisplay, ColorSpaceRGB, map[Signature][]byte{
+			TagDescription: mluc(map[string]string{"jaJP": "モニター"}),
+		})
+		p, _ := Parse(b)
+		desc, err := p.Description()
+		assert.Nil(t, err, "Description")
+		assert.Equal(t, "モニター", desc, "first record")
+	})
+}
+
+func TestParseMalformed(t *testing.T) {
+	good := buildProfile(2, ClassDisplay, ColorSpaceRGB, map[Signature][]byte{
+		TagDescription: textDescription("Display"),
+	})
+	be := binary.BigEndian
+	mutate := func(f func(b []byte) []byte) []byte {
+		b := append([]byte(nil), good...)
+		return f(b)
+	}
+
+	parseErrors := map[string][]byte{
+		"Empty":     nil,
+		"Short":     good[:100],
+		"NoMagic":   mutate(func(b []byte) []byte { copy(b[36:40], "xxxx"); return b }),
+		"TagCount":  mutate(func(b []byte) []byte { be.PutUint32(b[128:132], 0xffffffff); return b }),
+		"TagTable":  mutate(func(b []byte) []byte { return b[:140] }),
+		"SizeInHdr": mutate(func(b []byte) []byte { be.PutUint32(b[0:4], 133); return b }),
+	}
+	for name, b := range parseErrors {
+		_, err := Parse(b)
+		assert.NotNil(t, err, "%s should not parse", name)
+	}
+
+	descErrors := map[string][]byte{
+		"TagOffset": mutate(func(b []byte) []byte { be.PutUint32(b[136:140], 0xfffffff0); return b }),
+		"TagSize":   mutate(func(b []byte) []byte { be.PutUint32(b[140:144], 0xffffffff); return b }),
+		"ASCIILen":  mutate(func(b []byte) []byte { be.PutUint32(b[144+8:144+12], 0xffffffff); return b }),
+		"Type":      mutate(func(b []byte) []byte { copy(b[144:148], "curv"); return b }),
+		"NoTag":     mutate(func(b []byte) []byte { copy(b[132:136], "cprt"); return b }),
+	}
+	for name, b := range descErrors {
+		p, err := Parse(b)
+		if !assert.Nil(t, err, "%s should parse", name) {
+			continue
+		}
+		_, err = p.Description()
+		assert.NotNil(t, err, "%s should have no description", name)
+	}
+
+	mlucErrors := map[string]func(d []byte){
+		"NoRecords":  func(d []byte) { be.PutUint32(d[8:12], 0) },
+		"Records":    func(d []byte) { be.PutUint32(d[8:12], 0x10000000) },
+		"RecordSize": func(d []byte) { be.PutUint32(d[12:16], 4) },
+		"String":     func(d []byte) { be.PutUint32(d[16+8:16+12], 0xffffffff) },
+	}
+	for name, f := range mlucErrors {
+		d := mluc(map[string]string{"enUS": "Display"})
+		f(d)
+		p, err := Parse(buildProfile(4, ClassDisplay, ColorSpaceRGB, map[Signature][]byte{TagDescription: d}))
+		if !assert.Nil(t, err, "%s should parse", name) {
+			continue
+		}
+		_, err = p.Description()
+		assert.NotNil(t, err, "%s should have no description", name)
+	}
+}
+
+func parseFile(t *testing.T, path string) *Profile {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile - %v", err)
+	}
+	p, err := Parse(b)
+	if err != nil {
+		t.Fatalf("Parse %s - %v", path, err)
+	}
+	return p
+}
+
+// buildProfile returns a profile with a header and the given tags, the
+// data of each tag following the tag table in signature order.
+func buildProfile(major byte, class, colorSpace Signature, tags map[Signature][]byte) []byte {
+	be := binary.BigEndian
+	sigs := make([]Signature, 0, len(tags))
+	for sig := range tags {
+		sigs = append(sigs, sig)
+	}
+	sort.Slice(sigs, func(i, j int) bool { return sigs[i] < sigs[j] })
+
+	b := make([]byte, headerSize+4+tagEntrySize*len(tags))
+	b[8], b[9] = major, 0x30
+	be.PutUint32(b[12:16], uint32(class))
+	be.PutUint32(b[16:20], uint32(colorSpace))
+	be.PutUint32(b[20:24], uint32(ColorSpaceLab))
+	be.PutUint32(b[36:40], uint32(profileFileSignature))
+	be.PutUint32(b[128:132], uint32(len(tags)))
+	for i, sig := range sigs {
+		e := b[headerSize+4+i*tagEntrySize:]
+		be.PutUint32(e[0:4], uint32(sig))
+		be.PutUint32(e[4:8], uint32(len(b)))
+		be.PutUint32(e[8:12], uint32(len(tags[sig])))
+		b = append(b, tags[sig]...)
+	}
+	be.PutUint32(b[0:4], uint32(len(b)))
+	return b
+}
+
+// textDescription encodes s as a v2 textDescriptionType.
+func textDescription(s string) []byte {
+	d := make([]byte, 12, 12+len(s)+1+8+3+67)
+	copy(d, "desc")
+	binary.BigEndian.PutUint32(d[8:12], uint32(len(s)+1))
+	d = append(d, s...)
+	d = append(d, 0)
+	d = append(d, make([]byte, 8+3+67)...) // empty Unicode and ScriptCode parts
+	return d
+}
+
+// mluc encodes a multiLocalizedUnicodeType with a record per
+// language+country key (e.g. "enUS"), in key order.
+func mluc(records map[string]string) []byte {
+	be := binary.BigEndian
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	d := make([]byte, 16+12*len(keys))
+	copy(d, "mluc")
+	be.PutUint32(d[8:12], uint32(len(keys)))
+	be.PutUint32(d[12:16], 12)
+	for i, k := range keys {
+		rec := d[16+12*i:]
+		copy(rec[0:4], k)
+		offset := len(d)
+		for _, u := range utf16.Encode([]rune(records[k])) {
+			d = append(d, byte(u>>8), byte(u))
+		}
+		rec = d[16+12*i:]
+		be.PutUint32(rec[4:8], uint32(len(d)-offset))
+		be.PutUint32(rec[8:12], uint32(offset))
+	}
+	return d
+}
@@ -1,12 +1,19 @@
 package input
 
+import (
+	"github.com/gigamorph/go-pyramid/pyramid/progress"
+	"github.com/gigamorph/go-pyramid/shellcmds/exiftool"
+)
+
 // Params holds user-provided parameters.
 type Params struct {
 	InFile           string
 	OutFile          string
 	MaxSize          uint   // max outfile size (long-edge)
-	Compression      string // compression method ("jpeg", "lzw", "")
-	Quality          int    // JPEG quality (1-100)
+	Compression      string // codec of the tiles: "jpeg" (default), "deflate", "lzw", "zstd", "webp" or "none"
+	Quality          int    // JPEG and WebP quality (1-100, default 90); WebP tiles are lossy even at 100
+	CompressionLevel int    // Deflate (1-9) or ZSTD (1-22) level, 0 for the codec default
+	Predictor        string // "none" (default) or "horizontal", for Deflate, LZW and ZSTD
 	TargetICCProfile string // file path of the profile
 	TempDir          string // path of directory where temporary files will be stored
 
@@ -14,5 +21,82 @@ type Params struct {
 	// If nil, default will be used.
 	IMTempDir *string
 
-	DeleteTemp bool // delete temp dir after conversion is done
+	DeleteTemp bool // delete the temp files of this conversion when it is done
+
+	// What to write: "tiff" (default), a pyramidal TIFF at OutFile;
+	// "iiif", IIIF Image API level-0 static tiles and info.json in the
+	// directory OutFile, which must not exist or be empty; or "dzi", the
+	// Deep Zoom descriptor OutFile, e.g. "image.dzi", and its tiles in
+	// "image_files", which must not exist or be empty; or "zoomify",
+	// ImageProperties.xml and the TileGroup folders in the directory
+	// OutFile, which must not exist or be empty.
+	OutputFormat string
+	IIIFID       string // URI of the image service in info.json, required for "iiif"
+	IIIFVersion  string // Image API version of the "iiif" output: "3" (3.0, default) or "2" (2.1)
+	TileOverlap  uint   // pixels shared by adjacent "dzi" tiles
+	TileFormat   string // format of the "dzi" tiles: "jpg" (default) or "png"
+
+	// Tool used to assemble the levels into the pyramid:
+	// "tiffcp" (default) or "native" (built-in writer, no external program).
+	PyramidBuilder string
+
+	// Whether to write BigTIFF instead of classic TIFF, which is limited to 4 GiB:
+	// "auto" (default, when the uncompressed pyramid would exceed the limit),
+	// "always" or "never".
+	BigTIFF string
+
+	TileWidth    uint // tile width in pixels, multiple of 16 for TIFF output (default 256)
+	TileHeight   uint // tile height in pixels, multiple of 16 for TIFF output, equal to TileWidth for DZI and Zoomify (default 256)
+	MinLevelSize uint // smallest allowed long edge of a reduced level (default 128)
+	MaxLevels    uint // maximum number of levels including the full-size one (0: no limit)
+
+	// Resampling of the levels. Kernel is "nearest", "linear", "cubic" or
+	// "lanczos3"; if it, LinearLight and Sharpen are all unset, the backend
+	// default is used. Each reduced level is made from the level above it
+	// ("previous", default) or from the full-resolution image ("full"),
+	// which avoids the softening that builds up down the pyramid.
+	Kernel      string
+	LinearLight bool    // resample in linear light rather than in gamma-encoded values
+	LevelSource string  // "previous" (default) or "full"
+	Sharpen     float64 // sigma of the sharpening applied after resizing, 0 for none
+
+	// What to do with input of more than 8 bits per sample:
+	// "keep" (default for TIFF output) keeps the bit depth and compresses the tiles losslessly
+	// with LosslessCompression and the horizontal predictor, "reduce" scales
+	// the samples to 8 bits so that Compression applies as to 8-bit input,
+	// and "fail" rejects the image. Tile outputs, whose tiles are JPEG,
+	// default to "reduce" and do not allow "keep".
+	HighBitDepth        string
+	Dither              bool   // dither when HighBitDepth is "reduce"
+	LosslessCompression string // "deflate" (default), "lzw" or "zstd", used when HighBitDepth is "keep"
+
+	// Metadata of InFile to copy into the pyramidal TIFF with exiftool once
+	// it is built: "drop" (default) copies nothing, "allowlist" the tags in
+	// MetadataTags and "all" every EXIF, XMP and IPTC tag. The pyramid is
+	// verified to still be a valid tiled pyramid afterwards. Not available
+	// for BigTIFF, which exiftool cannot write, or for tile outputs.
+	Metadata     string
+	MetadataTags []string // exiftool tag names, e.g. "EXIF:DateTimeOriginal", "XMP-dc:Creator" or "IPTC:By-line"
+
+	// Rights metadata written into the pyramidal TIFF once it is built,
+	// after Metadata is copied, and read back to check it. Empty fields are
+	// not written. Same restrictions as Metadata.
+	Tags exiftool.TagsInput
+
+	// If not nil, called at the start and the end of each stage of the
+	// conversion (see package progress).
+	Progress progress.Func `json:"-"`
+}
+
+// Copy returns a copy of p that shares no slice or pointer with it, so
+// that decoding JSON into the copy leaves p unchanged.
+func (p Params) Copy() Params {
+	if p.IMTempDir != nil {
+		dir := *p.IMTempDir
+		p.IMTempDir = &dir
+	}
+	if p.MetadataTags != nil {
+		p.MetadataTags = append([]string(nil), p.MetadataTags...)
+	}
+	return p
 }
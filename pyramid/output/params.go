@@ -1,9 +1,35 @@
 package output
 
+import (
+	"github.com/gigamorph/go-pyramid/pyramid/compression"
+)
+
 // Params holds output values from the image conversion
 type Params struct {
 	InputWidth   uint
 	InputHeight  uint
 	OutputWidth  uint
 	OutputHeight uint
+	BigTIFF      bool               // whether the pyramid was written as BigTIFF
+	TileWidth    uint               // tile width of the pyramid
+	TileHeight   uint               // tile height of the pyramid
+	Levels       []Level            // levels of the pyramid, from the full-size one down
+	BitDepth     uint               // bits per sample of the pyramid
+	Compression  compression.Option // compression of the tiles
+	HighBitDepth string             // policy applied to input of more than 8 bits per sample, "" for 8-bit input
+	TileCount    int                // number of tile images written by tile outputs, 0 for TIFF
+	Tags         []Tag              // rights metadata of input.Params.Tags as read back from the pyramid
+	TagWarnings  []string           // values the pyramid holds only in part, e.g. IPTC Credit cut to 32 bytes
+}
+
+// Tag is the value of a tag written to the pyramid.
+type Tag struct {
+	Name  string // exiftool tag name
+	Value string
+}
+
+// Level is the size of one level of the pyramid.
+type Level struct {
+	Width  uint
+	Height uint
 }
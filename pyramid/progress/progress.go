@@ -0,0 +1,58 @@
+// Package progress defines the events a conversion reports while it runs.
+package progress
+
+import (
+	"time"
+)
+
+// Stage names a step of the conversion pipeline.
+type Stage string
+
+// Stages, in the order they run. Stages that an image does not need
+// (e.g. RemoveAlpha for an image without alpha) are skipped.
+const (
+	StageToTIFF       Stage = "toTIFF"       // convert the input to a single-image TIFF
+	StageProbe        Stage = "probe"        // read size, channels, depth and profile
+	StageReduceDepth  Stage = "reduceDepth"  // more than 8 bits per sample to 8 bits
+	StageCMYKToRGB    Stage = "cmykToRGB"    // CMYK or CMYK+alpha to the target profile
+	StageRemoveAlpha  Stage = "removeAlpha"  // flatten RGBA or gray+alpha
+	StageFixGray      Stage = "fixGray"      // gray without a usable profile to the target profile
+	StageGrayToSRGB   Stage = "grayToSRGB"   // gray with an RGB profile to sRGB
+	StageICCTransform Stage = "iccTransform" // embedded profile to the target profile
+	StageResize       Stage = "resize"       // one level of the pyramid, see Event.Level
+	StageCombine      Stage = "combine"      // assemble the levels into the output file or tiles
+	StageMetadata     Stage = "metadata"     // copy the metadata of the input into the output file
+	StageTags         Stage = "tags"         // write the rights metadata into the output file
+)
+
+// Phase tells whether an Event marks the start or the end of a stage.
+type Phase string
+
+// Phases.
+const (
+	PhaseStart  Phase = "start"
+	PhaseFinish Phase = "finish"
+)
+
+// Event reports the start or the end of a stage.
+type Event struct {
+	Stage Stage
+	Phase Phase
+
+	// Level is the level built by StageResize, 0 being the full-size one,
+	// and Levels the number of levels of the pyramid. Both are 0 for the
+	// other stages.
+	Level  int
+	Levels int
+
+	InFiles []string
+	OutFile string
+
+	Start    time.Time     // when the stage started
+	Duration time.Duration // how long the stage took, 0 for PhaseStart
+	Err      error         `json:"-"` // why the stage failed, nil for PhaseStart and on success
+}
+
+// Func receives the events of a conversion. It is called synchronously
+// from the goroutine running the conversion, so it should return quickly.
+type Func func(Event)
@@ -0,0 +1,589 @@
+package ptiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Limits that keep a malformed file from making the reader allocate
+// unbounded amounts of memory or loop forever.
+const (
+	maxIFDs       = 4096
+	maxEntries    = 4096
+	maxEntryBytes = 256 << 20
+)
+
+// File is a parsed TIFF (or BigTIFF) file.
+type File struct {
+	IFDs    []*IFD
+	BigTIFF bool
+	Order   binary.ByteOrder
+
+	r      io.ReaderAt
+	closer io.Closer
+}
+
+// IFD is one image file directory.
+type IFD struct {
+	Offset  int64
+	Entries map[uint16]*Entry
+
+	order binary.ByteOrder
+}
+
+// Entry is a single IFD entry with its values read into memory.
+type Entry struct {
+	Tag   uint16
+	Type  uint16
+	Count uint64
+	Data  []byte // raw value bytes, in the byte order of the file
+}
+
+// Open opens and parses the TIFF file at path.
+// The caller must call Close when done with the returned File.
+func Open(path string) (*File, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ptiff.Open failed to open %s - %v", path, err)
+	}
+	f, err := NewFile(fp)
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("ptiff.Open failed to parse %s - %v", path, err)
+	}
+	f.closer = fp
+	return f, nil
+}
+
+// NewFile parses the TIFF structure available through r.
+func NewFile(r io.ReaderAt) (*File, error) {
+	var hdr [16]byte
+	if _, err := r.ReadAt(hdr[:8], 0); err != nil {
+		return nil, fmt.Errorf("failed to read header - %v", err)
+	}
+
+	f := &File{r: r}
+	switch string(hdr[:2]) {
+	case "II":
+		f.Order = binary.LittleEndian
+	case "MM":
+		f.Order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+
+	var offset uint64
+	switch f.Order.Uint16(hdr[2:4]) {
+	case 42:
+		offset = uint64(f.Order.Uint32(hdr[4:8]))
+	case 43:
+		f.BigTIFF = true
+		if _, err := r.ReadAt(hdr[8:16], 8); err != nil {
+			return nil, fmt.Errorf("failed to read BigTIFF header - %v", err)
+		}
+		if f.Order.Uint16(hdr[4:6]) != 8 {
+			return nil, fmt.Errorf("unsupported BigTIFF offset size %d", f.Order.Uint16(hdr[4:6]))
+		}
+		offset = f.Order.Uint64(hdr[8:16])
+	default:
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+
+	seen := map[uint64]bool{}
+	for offset != 0 {
+		if seen[offset] {
+			return nil, fmt.Errorf("IFD loop at offset %d", offset)
+		}
+		if len(f.IFDs) >= maxIFDs {
+			return nil, fmt.Errorf("too many IFDs")
+		}
+		seen[offset] = true
+
+		ifd, next, err := f.readIFD(offset)
+		if err != nil {
+			return nil, err
+		}
+		f.IFDs = append(f.IFDs, ifd)
+		offset = next
+	}
+	if len(f.IFDs) == 0 {
+		return nil, fmt.Errorf("no IFD found")
+	}
+	return f, nil
+}
+
+// Close closes the underlying file if the File was created by Open.
+func (f *File) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
+
+func (f *File) readIFD(offset uint64) (*IFD, uint64, error) {
+	if offset > 1<<62 {
+		return nil, 0, fmt.Errorf("invalid IFD offset %d", offset)
+	}
+	countSize, entrySize, valueSize := 2, 12, 4
+	if f.BigTIFF {
+		countSize, entrySize, valueSize = 8, 20, 8
+	}
+
+	buf := make([]byte, countSize)
+	if _, err := f.r.ReadAt(buf, int64(offset)); err != nil {
+		return nil, 0, fmt.Errorf("failed to read IFD entry count at %d - %v", offset, err)
+	}
+	var n uint64
+	if f.BigTIFF {
+		n = f.Order.Uint64(buf)
+	} else {
+		n = uint64(f.Order.Uint16(buf))
+	}
+	if n > maxEntries {
+		return nil, 0, fmt.Errorf("IFD at %d has too many entries (%d)", offset, n)
+	}
+
+	buf = make([]byte, int(n)*entrySize+valueSize)
+	if _, err := f.r.ReadAt(buf, int64(offset)+int64(countSize)); err != nil {
+		return nil, 0, fmt.Errorf("failed to read IFD at %d - %v", offset, err)
+	}
+
+	ifd := &IFD{
+		Offset:  int64(offset),
+		Entries: make(map[uint16]*Entry, n),
+		order:   f.Order,
+	}
+	for i := 0; i < int(n); i++ {
+		e := buf[i*entrySize : (i+1)*entrySize]
+		entry := &Entry{
+			Tag:  f.Order.Uint16(e[0:2]),
+			Type: f.Order.Uint16(e[2:4]),
+		}
+		var value []byte
+		if f.BigTIFF {
+			entry.Count = f.Order.Uint64(e[4:12])
+			value = e[12:20]
+		} else {
+			entry.Count = uint64(f.Order.Uint32(e[4:8]))
+			value = e[8:12]
+		}
+
+		size, ok := typeSizes[entry.Type]
+		if !ok {
+			continue // unknown types are skipped as the spec requires
+		}
+		if entry.Count > maxEntryBytes/uint64(size) {
+			return nil, 0, fmt.Errorf("tag %d has too many values (%d)", entry.Tag, entry.Count)
+		}
+		nbytes := int(entry.Count) * size
+		if nbytes <= valueSize {
+			entry.Data = append([]byte(nil), value[:nbytes]...)
+		} else {
+			var dataOffset uint64
+			if f.BigTIFF {
+				dataOffset = f.Order.Uint64(value)
+			} else {
+				dataOffset = uint64(f.Order.Uint32(value))
+			}
+			if dataOffset > 1<<62 {
+				return nil, 0, fmt.Errorf("tag %d has invalid offset %d", entry.Tag, dataOffset)
+			}
+			entry.Data = make([]byte, nbytes)
+			if _, err := f.r.ReadAt(entry.Data, int64(dataOffset)); err != nil {
+				return nil, 0, fmt.Errorf("failed to read values of tag %d - %v", entry.Tag, err)
+			}
+		}
+		ifd.Entries[entry.Tag] = entry
+	}
+
+	tail := buf[int(n)*entrySize:]
+	var next uint64
+	if f.BigTIFF {
+		next = f.Order.Uint64(tail)
+	} else {
+		next = uint64(f.Order.Uint32(tail))
+	}
+	return ifd, next, nil
+}
+
+// Has reports whether the IFD contains tag.
+func (d *IFD) Has(tag uint16) bool {
+	_, ok := d.Entries[tag]
+	return ok
+}
+
+// Uints returns the values of an integer-typed tag, or nil if the tag
+// is absent or is not of an integer type.
+func (d *IFD) Uints(tag uint16) []uint64 {
+	e, ok := d.Entries[tag]
+	if !ok {
+		return nil
+	}
+	size := typeSizes[e.Type]
+	values := make([]uint64, 0, e.Count)
+	for i := 0; i < int(e.Count); i++ {
+		b := e.Data[i*size : (i+1)*size]
+		switch e.Type {
+		case typeByte, typeUndefined, typeSByte:
+			values = append(values, uint64(b[0]))
+		case typeShort, typeSShort:
+			values = append(values, uint64(d.order.Uint16(b)))
+		case typeLong, typeSLong, typeIFD:
+			values = append(values, uint64(d.order.Uint32(b)))
+		case typeLong8, typeSLong8, typeIFD8:
+			values = append(values, d.order.Uint64(b))
+		default:
+			return nil
+		}
+	}
+	return values
+}
+
+// Uint returns the first value of an integer-typed tag.
+func (d *IFD) Uint(tag uint16) (uint64, bool) {
+	values := d.Uints(tag)
+	if len(values) == 0 {
+		return 0, false
+	}
+	return values[0], true
+}
+
+// UintOr returns the first value of an integer-typed tag, or def
+// if it is absent.
+func (d *IFD) UintOr(tag uint16, def uint64) uint64 {
+	if v, ok := d.Uint(tag); ok {
+		return v
+	}
+	return def
+}
+
+// Bytes returns the raw value bytes of tag.
+func (d *IFD) Bytes(tag uint16) []byte {
+	e, ok := d.Entries[tag]
+	if !ok {
+		return nil
+	}
+	return e.Data
+}
+
+// ASCII returns the value of an ASCII tag without the trailing NUL.
+func (d *IFD) ASCII(tag uint16) string {
+	b := d.Bytes(tag)
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// Rational returns the first value of a RATIONAL tag.
+func (d *IFD) Rational(tag uint16) (num, den uint32, ok bool) {
+	e, found := d.Entries[tag]
+	if !found || e.Type != typeRational || e.Count < 1 {
+		return 0, 0, false
+	}
+	return d.order.Uint32(e.Data[0:4]), d.order.Uint32(e.Data[4:8]), true
+}
+
+// Image gives access to the pixel data of one IFD.
+//
+// Only chunky (PlanarConfiguration=1) images with whole-byte samples
+// that are uncompressed, Deflate or PackBits compressed can be read.
+// Multi-byte samples are returned in little-endian order regardless of
+// the byte order of the file.
+type Image struct {
+	IFD *IFD
+
+	Width           int
+	Height          int
+	SamplesPerPixel int
+	BitsPerSample   int
+	SampleFormat    uint16
+	Photometric     uint16
+	Compression     uint16
+	Predictor       uint16
+	ExtraSamples    []uint16
+
+	f        *File
+	tiled    bool
+	chunkW   int
+	chunkH   int
+	offsets  []uint64
+	counts   []uint64
+	cacheRow int
+	cache    [][]byte
+}
+
+// Image returns the image stored in the i-th IFD.
+func (f *File) Image(i int) (*Image, error) {
+	if i < 0 || i >= len(f.IFDs) {
+		return nil, fmt.Errorf("ptiff.File#Image IFD %d out of range", i)
+	}
+	d := f.IFDs[i]
+
+	im := &Image{
+		IFD:             d,
+		Width:           int(d.UintOr(TagImageWidth, 0)),
+		Height:          int(d.UintOr(TagImageLength, 0)),
+		SamplesPerPixel: int(d.UintOr(TagSamplesPerPixel, 1)),
+		BitsPerSample:   int(d.UintOr(TagBitsPerSample, 1)),
+		SampleFormat:    uint16(d.UintOr(TagSampleFormat, uint64(SampleFormatUint))),
+		Photometric:     uint16(d.UintOr(TagPhotometricInterpretation, uint64(PhotometricMinIsBlack))),
+		Compression:     uint16(d.UintOr(TagCompression, uint64(CompressionNone))),
+		Predictor:       uint16(d.UintOr(TagPredictor, uint64(PredictorNone))),
+		f:               f,
+		cacheRow:        -1,
+	}
+	for _, v := range d.Uints(TagExtraSamples) {
+		im.ExtraSamples = append(im.ExtraSamples, uint16(v))
+	}
+
+	if im.Width <= 0 || im.Height <= 0 || im.Width > 1<<24 || im.Height > 1<<24 {
+		return nil, fmt.Errorf("ptiff.File#Image invalid dimensions %dx%d", im.Width, im.Height)
+	}
+	if im.SamplesPerPixel < 1 || im.SamplesPerPixel > 16 {
+		return nil, fmt.Errorf("ptiff.File#Image invalid samples per pixel %d", im.SamplesPerPixel)
+	}
+	for _, bps := range d.Uints(TagBitsPerSample) {
+		if int(bps) != im.BitsPerSample {
+			return nil, fmt.Errorf("ptiff.File#Image mixed bits per sample not supported")
+		}
+	}
+	switch im.BitsPerSample {
+	case 8, 16, 32, 64:
+	default:
+		return nil, fmt.Errorf("ptiff.File#Image %d bits per sample not supported", im.BitsPerSample)
+	}
+	if d.UintOr(TagPlanarConfiguration, 1) != 1 {
+		return nil, fmt.Errorf("ptiff.File#Image planar configuration not supported")
+	}
+
+	if d.Has(TagTileOffsets) {
+		im.tiled = true
+		im.chunkW = int(d.UintOr(TagTileWidth, 0))
+		im.chunkH = int(d.UintOr(TagTileLength, 0))
+		im.offsets = d.Uints(TagTileOffsets)
+		im.counts = d.Uints(TagTileByteCounts)
+	} else {
+		im.chunkW = im.Width
+		im.chunkH = int(d.UintOr(TagRowsPerStrip, uint64(im.Height)))
+		if im.chunkH > im.Height {
+			im.chunkH = im.Height
+		}
+		im.offsets = d.Uints(TagStripOffsets)
+		im.counts = d.Uints(TagStripByteCounts)
+	}
+	if im.chunkW <= 0 || im.chunkH <= 0 || im.chunkW > 1<<24 || im.chunkH > 1<<24 {
+		return nil, fmt.Errorf("ptiff.File#Image invalid chunk size %dx%d", im.chunkW, im.chunkH)
+	}
+	if len(im.offsets) != im.chunksAcross()*im.chunksDown() || len(im.counts) != len(im.offsets) {
+		return nil, fmt.Errorf("ptiff.File#Image expected %d chunks, found %d offsets and %d byte counts",
+			im.chunksAcross()*im.chunksDown(), len(im.offsets), len(im.counts))
+	}
+	return im, nil
+}
+
+// Tiled reports whether the image is organized in tiles rather than strips.
+func (im *Image) Tiled() bool {
+	return im.tiled
+}
+
+// ChunkSize returns the size of a tile, or the width and rows per strip
+// of a stripped image.
+func (im *Image) ChunkSize() (w, h int) {
+	return im.chunkW, im.chunkH
+}
+
+// PixelBytes returns the number of bytes used by one pixel.
+func (im *Image) PixelBytes() int {
+	return im.SamplesPerPixel * im.BitsPerSample / 8
+}
+
+// RowBytes returns the number of bytes of one row of the image
+// as returned by ReadRows.
+func (im *Image) RowBytes() int {
+	return im.Width * im.PixelBytes()
+}
+
+func (im *Image) chunksAcross() int {
+	return (im.Width + im.chunkW - 1) / im.chunkW
+}
+
+func (im *Image) chunksDown() int {
+	return (im.Height + im.chunkH - 1) / im.chunkH
+}
+
+// ReadRows reads n rows starting at row y into dst, which must hold at
+// least n*RowBytes() bytes.
+func (im *Image) ReadRows(y, n int, dst []byte) error {
+	if y < 0 || n < 0 || y+n > im.Height {
+		return fmt.Errorf("ptiff.Image#ReadRows rows %d-%d out of range", y, y+n)
+	}
+	rowBytes := im.RowBytes()
+	if len(dst) < n*rowBytes {
+		return fmt.Errorf("ptiff.Image#ReadRows buffer too small")
+	}
+	pb := im.PixelBytes()
+	chunkRowBytes := im.chunkW * pb
+
+	for r := y; r < y+n; r++ {
+		cr := r / im.chunkH
+		if cr != im.cacheRow {
+			if err := im.loadChunkRow(cr); err != nil {
+				return err
+			}
+		}
+		out := dst[(r-y)*rowBytes : (r-y+1)*rowBytes]
+		line := r % im.chunkH
+		for i, chunk := range im.cache {
+			x0 := i * im.chunkW
+			w := im.chunkW
+			if x0+w > im.Width {
+				w = im.Width - x0
+			}
+			copy(out[x0*pb:(x0+w)*pb], chunk[line*chunkRowBytes:line*chunkRowBytes+w*pb])
+		}
+	}
+	return nil
+}
+
+func (im *Image) loadChunkRow(cr int) error {
+	across := im.chunksAcross()
+	rows := im.chunkH
+	if !im.tiled && (cr+1)*im.chunkH > im.Height {
+		rows = im.Height - cr*im.chunkH
+	}
+	size := im.chunkW * rows * im.PixelBytes()
+
+	chunks := make([][]byte, across)
+	for i := 0; i < across; i++ {
+		idx := cr*across + i
+		buf, err := im.readChunk(idx, size)
+		if err != nil {
+			return fmt.Errorf("ptiff.Image#ReadRows failed to read chunk %d - %v", idx, err)
+		}
+		chunks[i] = buf
+	}
+	im.cache = chunks
+	im.cacheRow = cr
+	return nil
+}
+
+func (im *Image) readChunk(idx, size int) ([]byte, error) {
+	count := im.counts[idx]
+	if count > maxEntryBytes*4 {
+		return nil, fmt.Errorf("chunk too large (%d bytes)", count)
+	}
+	raw := make([]byte, count)
+	if count > 0 {
+		if _, err := im.f.r.ReadAt(raw, int64(im.offsets[idx])); err != nil {
+			return nil, err
+		}
+	}
+
+	var data []byte
+	switch im.Compression {
+	case CompressionNone:
+		data = raw
+	case CompressionDeflate, CompressionDeflateOld:
+		zr, err := zlib.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(zr, int64(size)))
+		if err != nil {
+			return nil, err
+		}
+	case CompressionPackBits:
+		data = unpackBits(raw, size)
+	default:
+		return nil, fmt.Errorf("compression %d not supported", im.Compression)
+	}
+
+	// Be lenient with writers that leave the last chunk short.
+	if len(data) < size {
+		data = append(data, make([]byte, size-len(data))...)
+	}
+	data = data[:size]
+
+	switch im.Predictor {
+	case PredictorNone:
+	case PredictorHorizontal:
+		undoHorizontalPredictor(data, im.chunkW, im.SamplesPerPixel, im.BitsPerSample, im.f.Order)
+	default:
+		return nil, fmt.Errorf("predictor %d not supported", im.Predictor)
+	}
+	if im.f.Order == binary.BigEndian {
+		swapSamples(data, im.BitsPerSample)
+	}
+	return data, nil
+}
+
+// unpackBits decodes PackBits data, producing at most size bytes.
+func unpackBits(src []byte, size int) []byte {
+	dst := make([]byte, 0, size)
+	for i := 0; i < len(src) && len(dst) < size; {
+		n := int(int8(src[i]))
+		i++
+		switch {
+		case n >= 0:
+			end := i + n + 1
+			if end > len(src) {
+				end = len(src)
+			}
+			dst = append(dst, src[i:end]...)
+			i = end
+		case n != -128:
+			if i < len(src) {
+				for j := 0; j < 1-n; j++ {
+					dst = append(dst, src[i])
+				}
+				i++
+			}
+		}
+	}
+	return dst
+}
+
+// undoHorizontalPredictor reverses horizontal differencing in place.
+// Samples are interpreted in the byte order of the file.
+func undoHorizontalPredictor(data []byte, width, spp, bps int, order binary.ByteOrder) {
+	bytesPerSample := bps / 8
+	rowBytes := width * spp * bytesPerSample
+	for row := 0; row+rowBytes <= len(data); row += rowBytes {
+		line := data[row : row+rowBytes]
+		switch bps {
+		case 8:
+			for i := spp; i < len(line); i++ {
+				line[i] += line[i-spp]
+			}
+		case 16:
+			for i := spp; i < len(line)/2; i++ {
+				v := order.Uint16(line[2*i:]) + order.Uint16(line[2*(i-spp):])
+				order.PutUint16(line[2*i:], v)
+			}
+		case 32:
+			for i := spp; i < len(line)/4; i++ {
+				v := order.Uint32(line[4*i:]) + order.Uint32(line[4*(i-spp):])
+				order.PutUint32(line[4*i:], v)
+			}
+		}
+	}
+}
+
+// swapSamples converts big-endian multi-byte samples to little-endian in place.
+func swapSamples(data []byte, bps int) {
+	n := bps / 8
+	if n < 2 {
+		return
+	}
+	for i := 0; i+n <= len(data); i += n {
+		for a, b := i, i+n-1; a < b; a, b = a+1, b-1 {
+			data[a], data[b] = data[b], data[a]
+		}
+	}
+}
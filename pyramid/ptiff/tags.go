@@ -0,0 +1,112 @@
+// Package ptiff reads and writes tiled, multi-resolution (pyramidal) TIFF
+// files without depending on external programs.
+package ptiff
+
+// TIFF tag numbers used by this package.
+const (
+	TagNewSubfileType            uint16 = 254
+	TagImageWidth                uint16 = 256
+	TagImageLength               uint16 = 257
+	TagBitsPerSample             uint16 = 258
+	TagCompression               uint16 = 259
+	TagPhotometricInterpretation uint16 = 262
+	TagStripOffsets              uint16 = 273
+	TagOrientation               uint16 = 274
+	TagSamplesPerPixel           uint16 = 277
+	TagRowsPerStrip              uint16 = 278
+	TagStripByteCounts           uint16 = 279
+	TagXResolution               uint16 = 282
+	TagYResolution               uint16 = 283
+	TagPlanarConfiguration       uint16 = 284
+	TagResolutionUnit            uint16 = 296
+	TagSoftware                  uint16 = 305
+	TagPredictor                 uint16 = 317
+	TagTileWidth                 uint16 = 322
+	TagTileLength                uint16 = 323
+	TagTileOffsets               uint16 = 324
+	TagTileByteCounts            uint16 = 325
+	TagExtraSamples              uint16 = 338
+	TagSampleFormat              uint16 = 339
+	TagJPEGTables                uint16 = 347
+	TagYCbCrSubSampling          uint16 = 530
+	TagReferenceBlackWhite       uint16 = 532
+	TagICCProfile                uint16 = 34675
+)
+
+// Field types.
+const (
+	typeByte      uint16 = 1
+	typeASCII     uint16 = 2
+	typeShort     uint16 = 3
+	typeLong      uint16 = 4
+	typeRational  uint16 = 5
+	typeSByte     uint16 = 6
+	typeUndefined uint16 = 7
+	typeSShort    uint16 = 8
+	typeSLong     uint16 = 9
+	typeSRational uint16 = 10
+	typeFloat     uint16 = 11
+	typeDouble    uint16 = 12
+	typeIFD       uint16 = 13
+	typeLong8     uint16 = 16
+	typeSLong8    uint16 = 17
+	typeIFD8      uint16 = 18
+)
+
+// typeSizes maps a field type to the size in bytes of a single value.
+var typeSizes = map[uint16]int{
+	typeByte:      1,
+	typeASCII:     1,
+	typeShort:     2,
+	typeLong:      4,
+	typeRational:  8,
+	typeSByte:     1,
+	typeUndefined: 1,
+	typeSShort:    2,
+	typeSLong:     4,
+	typeSRational: 8,
+	typeFloat:     4,
+	typeDouble:    8,
+	typeIFD:       4,
+	typeLong8:     8,
+	typeSLong8:    8,
+	typeIFD8:      8,
+}
+
+// Compression schemes (values of TagCompression).
+const (
+	CompressionNone       uint16 = 1
+	CompressionLZW        uint16 = 5
+	CompressionJPEG       uint16 = 7
+	CompressionDeflate    uint16 = 8
+	CompressionPackBits   uint16 = 32773
+	CompressionDeflateOld uint16 = 32946
+	CompressionZSTD       uint16 = 50000 // read and written by libtiff only
+	CompressionWebP       uint16 = 50001 // read and written by libtiff only
+)
+
+// Photometric interpretations (values of TagPhotometricInterpretation).
+const (
+	PhotometricMinIsWhite uint16 = 0
+	PhotometricMinIsBlack uint16 = 1
+	PhotometricRGB        uint16 = 2
+	PhotometricSeparated  uint16 = 5
+	PhotometricYCbCr      uint16 = 6
+)
+
+// Sample formats (values of TagSampleFormat).
+const (
+	SampleFormatUint  uint16 = 1
+	SampleFormatInt   uint16 = 2
+	SampleFormatFloat uint16 = 3
+)
+
+// Predictors (values of TagPredictor).
+const (
+	PredictorNone       uint16 = 1
+	PredictorHorizontal uint16 = 2
+)
+
+// SubfileReducedImage is the NewSubfileType bit that marks an IFD as
+// a reduced-resolution version of another image in the file.
+const SubfileReducedImage uint32 = 1
@@ -0,0 +1,593 @@
+package ptiff
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+)
+
+// Options controls the layout and encoding of the pyramid written by
+// BuildPyramid and Writer.
+type Options struct {
+	TileWidth   int    // tile width in pixels, multiple of 16 (default 256)
+	TileHeight  int    // tile height in pixels, multiple of 16 (default 256)
+	Compression uint16 // CompressionNone (default), CompressionDeflate or CompressionJPEG
+	Quality     int    // JPEG quality (1-100, default 90)
+	Predictor   uint16 // PredictorNone (default) or PredictorHorizontal, Deflate only
+	Level       int    // Deflate level (1-9, 0 for the zlib default)
+	BigTIFF     bool   // write BigTIFF (64-bit offsets) instead of classic TIFF
+}
+
+func (o Options) withDefaults() Options {
+	if o.TileWidth == 0 {
+		o.TileWidth = 256
+	}
+	if o.TileHeight == 0 {
+		o.TileHeight = 256
+	}
+	if o.Compression == 0 {
+		o.Compression = CompressionNone
+	}
+	if o.Quality == 0 {
+		o.Quality = 90
+	}
+	if o.Predictor == 0 {
+		o.Predictor = PredictorNone
+	}
+	return o
+}
+
+func (o Options) validate() error {
+	if o.TileWidth <= 0 || o.TileWidth%16 != 0 || o.TileHeight <= 0 || o.TileHeight%16 != 0 {
+		return fmt.Errorf("tile size %dx%d is not a positive multiple of 16", o.TileWidth, o.TileHeight)
+	}
+	switch o.Compression {
+	case CompressionNone:
+	case CompressionDeflate:
+		if o.Level < 0 || o.Level > 9 {
+			return fmt.Errorf("invalid Deflate level %d", o.Level)
+		}
+	case CompressionJPEG:
+		if o.Quality < 1 || o.Quality > 100 {
+			return fmt.Errorf("invalid JPEG quality %d", o.Quality)
+		}
+	default:
+		return fmt.Errorf("compression %d not supported", o.Compression)
+	}
+	switch o.Predictor {
+	case PredictorNone:
+	case PredictorHorizontal:
+		if o.Compression != CompressionDeflate {
+			return fmt.Errorf("predictor %d requires Deflate compression", o.Predictor)
+		}
+	default:
+		return fmt.Errorf("predictor %d not supported", o.Predictor)
+	}
+	return nil
+}
+
+// BuildPyramid writes the images in inFiles, ordered from the largest
+// (full resolution) to the smallest level, as a single tiled TIFF with
+// one IFD per level. All levels after the first are marked as
+// reduced-resolution images.
+func BuildPyramid(inFiles []string, outFile string, opts Options) (err error) {
+	if len(inFiles) == 0 {
+		return fmt.Errorf("ptiff.BuildPyramid no input files")
+	}
+
+	out, err := os.Create(outFile)
+	if err != nil {
+		return fmt.Errorf("ptiff.BuildPyramid failed to create %s - %v", outFile, err)
+	}
+	defer func() {
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("ptiff.BuildPyramid failed to close %s - %v", outFile, cerr)
+		}
+		if err != nil {
+			os.Remove(outFile)
+		}
+	}()
+
+	w, err := NewWriter(out, opts)
+	if err != nil {
+		return fmt.Errorf("ptiff.BuildPyramid failed to create writer - %v", err)
+	}
+
+	for i, inFile := range inFiles {
+		if err = writeLevel(w, inFile, i > 0); err != nil {
+			return fmt.Errorf("ptiff.BuildPyramid failed to write level %d (%s) - %v", i, inFile, err)
+		}
+	}
+	return w.Close()
+}
+
+func writeLevel(w *Writer, inFile string, reduced bool) error {
+	f, err := Open(inFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	im, err := f.Image(0)
+	if err != nil {
+		return err
+	}
+	return w.WriteImage(im, reduced)
+}
+
+// WriterAtWriter is the destination of a Writer. *os.File implements it.
+type WriterAtWriter interface {
+	io.Writer
+	io.WriterAt
+}
+
+// Writer writes a multi-IFD tiled TIFF, one image at a time.
+type Writer struct {
+	opts    Options
+	dst     WriterAtWriter
+	bw      *bufio.Writer
+	pos     int64 // offset of the next byte to be written
+	nextPtr int64 // offset of the pointer to the next IFD
+	order   binary.ByteOrder
+	images  int
+	first   *Image // used to check that all levels are compatible
+	scratch []byte // tile after horizontal differencing
+}
+
+// NewWriter writes the TIFF header to dst and returns a Writer.
+func NewWriter(dst WriterAtWriter, opts Options) (*Writer, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		opts:  opts,
+		dst:   dst,
+		bw:    bufio.NewWriterSize(dst, 1<<20),
+		order: binary.LittleEndian,
+	}
+
+	// The offset of the first IFD is patched in when it is written.
+	var hdr []byte
+	if opts.BigTIFF {
+		hdr = make([]byte, 16)
+		w.order.PutUint16(hdr[2:], 43)
+		w.order.PutUint16(hdr[4:], 8) // size of offsets
+		w.nextPtr = 8
+	} else {
+		hdr = make([]byte, 8)
+		w.order.PutUint16(hdr[2:], 42)
+		w.nextPtr = 4
+	}
+	copy(hdr, "II")
+	if err := w.write(hdr); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Close flushes buffered data. It does not close the destination.
+func (w *Writer) Close() error {
+	if w.images == 0 {
+		return fmt.Errorf("ptiff.Writer#Close no image written")
+	}
+	return w.bw.Flush()
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.bw.Write(b)
+	w.pos += int64(n)
+	return err
+}
+
+// WriteImage appends im as a new tiled IFD. reduced marks it as a
+// reduced-resolution version of the first image.
+func (w *Writer) WriteImage(im *Image, reduced bool) error {
+	if err := w.checkCompatible(im); err != nil {
+		return err
+	}
+	photometric, err := w.outputPhotometric(im)
+	if err != nil {
+		return err
+	}
+
+	tw, th := w.opts.TileWidth, w.opts.TileHeight
+	across := (im.Width + tw - 1) / tw
+	down := (im.Height + th - 1) / th
+	offsets := make([]uint64, 0, across*down)
+	counts := make([]uint64, 0, across*down)
+
+	pb := im.PixelBytes()
+	rowBytes := im.RowBytes()
+	rows := make([]byte, th*rowBytes)
+	tile := make([]byte, tw*th*pb)
+
+	for ty := 0; ty < down; ty++ {
+		y0 := ty * th
+		n := th
+		if y0+n > im.Height {
+			n = im.Height - y0
+		}
+		if err := im.ReadRows(y0, n, rows); err != nil {
+			return err
+		}
+		for tx := 0; tx < across; tx++ {
+			extractTile(tile, rows, n, rowBytes, tx*tw, im.Width, tw, th, pb)
+			data, err := w.encodeTile(tile, im)
+			if err != nil {
+				return fmt.Errorf("ptiff.Writer#WriteImage failed to encode tile %d,%d - %v", tx, ty, err)
+			}
+			offsets = append(offsets, uint64(w.pos))
+			counts = append(counts, uint64(len(data)))
+			if err := w.write(data); err != nil {
+				return err
+			}
+		}
+	}
+
+	fields := w.imageFields(im, photometric, reduced)
+	fields = append(fields,
+		w.offsetsField(TagTileOffsets, offsets),
+		w.offsetsField(TagTileByteCounts, counts),
+	)
+	if err := w.writeIFD(fields); err != nil {
+		return err
+	}
+	w.images++
+	if w.first == nil {
+		w.first = im
+	}
+	return nil
+}
+
+func (w *Writer) checkCompatible(im *Image) error {
+	if im.SampleFormat == SampleFormatFloat && w.opts.Compression == CompressionJPEG {
+		return fmt.Errorf("ptiff.Writer#WriteImage JPEG cannot store floating point samples")
+	}
+	if w.opts.Compression == CompressionJPEG && im.BitsPerSample != 8 {
+		return fmt.Errorf("ptiff.Writer#WriteImage JPEG cannot store %d-bit samples", im.BitsPerSample)
+	}
+	if w.opts.Predictor == PredictorHorizontal && (im.SampleFormat == SampleFormatFloat || im.BitsPerSample > 32) {
+		return fmt.Errorf("ptiff.Writer#WriteImage the horizontal predictor supports only integer samples of up to 32 bits")
+	}
+	if w.first == nil {
+		return nil
+	}
+	if im.SamplesPerPixel != w.first.SamplesPerPixel || im.BitsPerSample != w.first.BitsPerSample ||
+		im.Photometric != w.first.Photometric || im.SampleFormat != w.first.SampleFormat {
+		return fmt.Errorf("ptiff.Writer#WriteImage image layout differs from the first image")
+	}
+	return nil
+}
+
+func (w *Writer) outputPhotometric(im *Image) (uint16, error) {
+	switch im.Photometric {
+	case PhotometricMinIsWhite, PhotometricMinIsBlack, PhotometricRGB, PhotometricSeparated:
+	default:
+		return 0, fmt.Errorf("ptiff.Writer#WriteImage photometric interpretation %d not supported", im.Photometric)
+	}
+	if w.opts.Compression != CompressionJPEG {
+		return im.Photometric, nil
+	}
+	switch {
+	case im.Photometric == PhotometricMinIsBlack && im.SamplesPerPixel == 1:
+		return PhotometricMinIsBlack, nil
+	case im.Photometric == PhotometricRGB && im.SamplesPerPixel == 3:
+		// image/jpeg always stores color as YCbCr with 2x2 chroma subsampling.
+		return PhotometricYCbCr, nil
+	default:
+		return 0, fmt.Errorf("ptiff.Writer#WriteImage JPEG supports only 1-band gray and 3-band RGB images")
+	}
+}
+
+// extractTile copies the tile starting at column x0 out of rows, which
+// holds n rows of the image. Pixels outside of the image are filled by
+// repeating the last column and row.
+func extractTile(tile, rows []byte, n, rowBytes, x0, width, tw, th, pb int) {
+	w := tw
+	if x0+w > width {
+		w = width - x0
+	}
+	tileRowBytes := tw * pb
+	for y := 0; y < th; y++ {
+		srcY := y
+		if srcY >= n {
+			srcY = n - 1
+		}
+		src := rows[srcY*rowBytes+x0*pb : srcY*rowBytes+(x0+w)*pb]
+		dst := tile[y*tileRowBytes : (y+1)*tileRowBytes]
+		copy(dst, src)
+		last := src[len(src)-pb:]
+		for x := w; x < tw; x++ {
+			copy(dst[x*pb:(x+1)*pb], last)
+		}
+	}
+}
+
+func (w *Writer) encodeTile(tile []byte, im *Image) ([]byte, error) {
+	tw, th := w.opts.TileWidth, w.opts.TileHeight
+
+	switch w.opts.Compression {
+	case CompressionNone:
+		return tile, nil
+	case CompressionDeflate:
+		if w.opts.Predictor == PredictorHorizontal {
+			if w.scratch == nil {
+				w.scratch = make([]byte, len(tile))
+			}
+			copy(w.scratch, tile)
+			tile = w.scratch
+			applyHorizontalPredictor(tile, tw, im.SamplesPerPixel, im.BitsPerSample, w.order)
+		}
+		level := zlib.DefaultCompression
+		if w.opts.Level != 0 {
+			level = w.opts.Level
+		}
+		var buf bytes.Buffer
+		zw, err := zlib.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(tile); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionJPEG:
+		var img image.Image
+		rect := image.Rect(0, 0, tw, th)
+		if im.SamplesPerPixel == 1 {
+			img = &image.Gray{Pix: tile, Stride: tw, Rect: rect}
+		} else {
+			rgba := image.NewRGBA(rect)
+			for i, j := 0, 0; i < len(tile); i, j = i+3, j+4 {
+				rgba.Pix[j] = tile[i]
+				rgba.Pix[j+1] = tile[i+1]
+				rgba.Pix[j+2] = tile[i+2]
+				rgba.Pix[j+3] = 0xff
+			}
+			img = rgba
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: w.opts.Quality}); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("compression %d not supported", w.opts.Compression)
+}
+
+// applyHorizontalPredictor replaces every sample of data, which holds rows
+// of width pixels, with its difference to the same sample of the pixel on
+// its left. It is the inverse of undoHorizontalPredictor.
+func applyHorizontalPredictor(data []byte, width, spp, bps int, order binary.ByteOrder) {
+	bytesPerSample := bps / 8
+	rowBytes := width * spp * bytesPerSample
+	for row := 0; row+rowBytes <= len(data); row += rowBytes {
+		line := data[row : row+rowBytes]
+		switch bps {
+		case 8:
+			for i := len(line) - 1; i >= spp; i-- {
+				line[i] -= line[i-spp]
+			}
+		case 16:
+			for i := len(line)/2 - 1; i >= spp; i-- {
+				v := order.Uint16(line[2*i:]) - order.Uint16(line[2*(i-spp):])
+				order.PutUint16(line[2*i:], v)
+			}
+		case 32:
+			for i := len(line)/4 - 1; i >= spp; i-- {
+				v := order.Uint32(line[4*i:]) - order.Uint32(line[4*(i-spp):])
+				order.PutUint32(line[4*i:], v)
+			}
+		}
+	}
+}
+
+// field is an IFD entry to be written.
+type field struct {
+	tag   uint16
+	typ   uint16
+	count uint64
+	data  []byte
+}
+
+func (w *Writer) shortField(tag uint16, values ...uint16) field {
+	data := make([]byte, 2*len(values))
+	for i, v := range values {
+		w.order.PutUint16(data[2*i:], v)
+	}
+	return field{tag, typeShort, uint64(len(values)), data}
+}
+
+func (w *Writer) longField(tag uint16, values ...uint32) field {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		w.order.PutUint32(data[4*i:], v)
+	}
+	return field{tag, typeLong, uint64(len(values)), data}
+}
+
+func (w *Writer) rationalField(tag uint16, num, den uint32) field {
+	data := make([]byte, 8)
+	w.order.PutUint32(data, num)
+	w.order.PutUint32(data[4:], den)
+	return field{tag, typeRational, 1, data}
+}
+
+func (w *Writer) offsetsField(tag uint16, values []uint64) field {
+	if w.opts.BigTIFF {
+		data := make([]byte, 8*len(values))
+		for i, v := range values {
+			w.order.PutUint64(data[8*i:], v)
+		}
+		return field{tag, typeLong8, uint64(len(values)), data}
+	}
+	v32 := make([]uint32, len(values))
+	for i, v := range values {
+		v32[i] = uint32(v)
+	}
+	return w.longField(tag, v32...)
+}
+
+func (w *Writer) imageFields(im *Image, photometric uint16, reduced bool) []field {
+	spp := im.SamplesPerPixel
+	bps := make([]uint16, spp)
+	for i := range bps {
+		bps[i] = uint16(im.BitsPerSample)
+	}
+
+	var subfileType uint32
+	if reduced {
+		subfileType = SubfileReducedImage
+	}
+
+	fields := []field{
+		w.longField(TagNewSubfileType, subfileType),
+		w.longField(TagImageWidth, uint32(im.Width)),
+		w.longField(TagImageLength, uint32(im.Height)),
+		w.shortField(TagBitsPerSample, bps...),
+		w.shortField(TagCompression, w.opts.Compression),
+		w.shortField(TagPhotometricInterpretation, photometric),
+		w.shortField(TagSamplesPerPixel, uint16(spp)),
+		w.shortField(TagPlanarConfiguration, 1),
+		w.longField(TagTileWidth, uint32(w.opts.TileWidth)),
+		w.longField(TagTileLength, uint32(w.opts.TileHeight)),
+	}
+	if w.opts.Predictor != PredictorNone {
+		fields = append(fields, w.shortField(TagPredictor, w.opts.Predictor))
+	}
+
+	xNum, xDen, ok := im.IFD.Rational(TagXResolution)
+	yNum, yDen, ok2 := im.IFD.Rational(TagYResolution)
+	if ok && ok2 && xDen != 0 && yDen != 0 {
+		fields = append(fields,
+			w.rationalField(TagXResolution, xNum, xDen),
+			w.rationalField(TagYResolution, yNum, yDen),
+			w.shortField(TagResolutionUnit, uint16(im.IFD.UintOr(TagResolutionUnit, 2))),
+		)
+	} else {
+		fields = append(fields,
+			w.rationalField(TagXResolution, 72, 1),
+			w.rationalField(TagYResolution, 72, 1),
+			w.shortField(TagResolutionUnit, 2), // inch
+		)
+	}
+
+	if len(im.ExtraSamples) > 0 {
+		fields = append(fields, w.shortField(TagExtraSamples, im.ExtraSamples...))
+	}
+	if im.SampleFormat != SampleFormatUint {
+		formats := make([]uint16, spp)
+		for i := range formats {
+			formats[i] = im.SampleFormat
+		}
+		fields = append(fields, w.shortField(TagSampleFormat, formats...))
+	}
+	if photometric == PhotometricYCbCr {
+		fields = append(fields, w.shortField(TagYCbCrSubSampling, 2, 2))
+		rbw := make([]byte, 48)
+		for i, v := range []uint32{0, 1, 255, 1, 128, 1, 255, 1, 128, 1, 255, 1} {
+			w.order.PutUint32(rbw[4*i:], v)
+		}
+		fields = append(fields, field{TagReferenceBlackWhite, typeRational, 6, rbw})
+	}
+	if icc := im.IFD.Bytes(TagICCProfile); len(icc) > 0 {
+		fields = append(fields, field{TagICCProfile, typeUndefined, uint64(len(icc)), icc})
+	} else if !reduced {
+		log.Printf("WARNING ptiff.Writer#WriteImage no ICC profile to embed\n")
+	}
+	return fields
+}
+
+// writeIFD writes an IFD made of fields followed by the values that do
+// not fit in the entries, and links it from the previous IFD.
+func (w *Writer) writeIFD(fields []field) error {
+	sort.Slice(fields, func(i, j int) bool { return fields[i].tag < fields[j].tag })
+
+	if w.pos%2 != 0 {
+		if err := w.write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	ifdPos := w.pos
+
+	// Classic TIFF and BigTIFF differ in the size of the entry count,
+	// of the entries, and of the offsets.
+	countSize, entrySize, valueSize := 2, 12, 4
+	if w.opts.BigTIFF {
+		countSize, entrySize, valueSize = 8, 20, 8
+	}
+	ifdSize := int64(countSize + entrySize*len(fields) + valueSize)
+
+	buf := make([]byte, ifdSize)
+	if w.opts.BigTIFF {
+		w.order.PutUint64(buf, uint64(len(fields)))
+	} else {
+		w.order.PutUint16(buf, uint16(len(fields)))
+	}
+	var extra []byte
+	for i, f := range fields {
+		e := buf[countSize+entrySize*i : countSize+entrySize*(i+1)]
+		w.order.PutUint16(e[0:], f.tag)
+		w.order.PutUint16(e[2:], f.typ)
+		value := e[8:]
+		if w.opts.BigTIFF {
+			w.order.PutUint64(e[4:], f.count)
+			value = e[12:]
+		} else {
+			w.order.PutUint32(e[4:], uint32(f.count))
+		}
+		if len(f.data) <= valueSize {
+			copy(value, f.data)
+			continue
+		}
+		w.putOffset(value, uint64(ifdPos+ifdSize+int64(len(extra))))
+		extra = append(extra, f.data...)
+		if len(extra)%2 != 0 {
+			extra = append(extra, 0)
+		}
+	}
+	if !w.opts.BigTIFF && ifdPos+ifdSize+int64(len(extra)) > math.MaxUint32 {
+		return fmt.Errorf("ptiff.Writer output exceeds the 4 GiB limit of classic TIFF, use BigTIFF")
+	}
+	// The pointer to the next IFD is left at zero and patched in later.
+	if err := w.write(buf); err != nil {
+		return err
+	}
+	if err := w.write(extra); err != nil {
+		return err
+	}
+
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	ptr := make([]byte, valueSize)
+	w.putOffset(ptr, uint64(ifdPos))
+	if _, err := w.dst.WriteAt(ptr, w.nextPtr); err != nil {
+		return err
+	}
+	w.nextPtr = ifdPos + ifdSize - int64(valueSize)
+	return nil
+}
+
+// putOffset stores a file offset in b using the offset size of the format.
+func (w *Writer) putOffset(b []byte, offset uint64) {
+	if w.opts.BigTIFF {
+		w.order.PutUint64(b, offset)
+	} else {
+		w.order.PutUint32(b, uint32(offset))
+	}
+}
@@ -0,0 +1,316 @@
+package ptiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildPyramid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ptiff-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	icc, err := ioutil.ReadFile("../../test/resources/sRGBProfile.icc")
+	if err != nil {
+		panic(err)
+	}
+
+	sizes := [][2]int{{600, 400}, {300, 200}, {150, 100}}
+	levels := make([]string, len(sizes))
+	pixels := make([][]byte, len(sizes))
+	for i, s := range sizes {
+		levels[i] = filepath.Join(dir, fmt.Sprintf("level_%d.tif", i))
+		pixels[i] = testPattern(s[0], s[1], 3, 8)
+		writeStripTIFF(levels[i], s[0], s[1], 3, 8, binary.LittleEndian, pixels[i], icc)
+	}
+
+	for _, compression := range []uint16{CompressionNone, CompressionDeflate} {
+		t.Run(fmt.Sprintf("Compression%d", compression), func(t *testing.T) {
+			outFile := filepath.Join(dir, fmt.Sprintf("out-%d.tif", compression))
+			err := BuildPyramid(levels, outFile, Options{Compression: compression})
+			assert.Nil(t, err, "BuildPyramid")
+
+			f, err := Open(outFile)
+			if err != nil {
+				t.Fatalf("Open - %v", err)
+			}
+			defer f.Close()
+
+			assert.Equal(t, len(sizes), len(f.IFDs), "number of IFDs")
+			for i, s := range sizes {
+				im, err := f.Image(i)
+				if err != nil {
+					t.Fatalf("Image %d - %v", i, err)
+				}
+				assert.Equal(t, s[0], im.Width, "width of level %d", i)
+				assert.Equal(t, s[1], im.Height, "height of level %d", i)
+				assert.True(t, im.Tiled(), "level %d is tiled", i)
+				tw, th := im.ChunkSize()
+				assert.Equal(t, 256, tw, "tile width of level %d", i)
+				assert.Equal(t, 256, th, "tile height of level %d", i)
+				assert.Equal(t, compression, im.Compression, "compression of level %d", i)
+				subfileType, _ := im.IFD.Uint(TagNewSubfileType)
+				assert.Equal(t, i > 0, subfileType&uint64(SubfileReducedImage) != 0, "NewSubfileType of level %d", i)
+				assert.Equal(t, icc, im.IFD.Bytes(TagICCProfile), "ICC profile of level %d", i)
+				num, den, ok := im.IFD.Rational(TagXResolution)
+				assert.True(t, ok && num == 300 && den == 1, "resolution of level %d", i)
+
+				got := make([]byte, im.Height*im.RowBytes())
+				assert.Nil(t, im.ReadRows(0, im.Height, got), "ReadRows of level %d", i)
+				assert.True(t, bytes.Equal(pixels[i], got), "pixels of level %d", i)
+			}
+		})
+	}
+
+	t.Run("BigTIFF", func(t *testing.T) {
+		outFile := filepath.Join(dir, "out-bigtiff.tif")
+		err := BuildPyramid(levels, outFile, Options{Compression: CompressionDeflate, BigTIFF: true})
+		assert.Nil(t, err, "BuildPyramid")
+
+		f, err := Open(outFile)
+		if err != nil {
+			t.Fatalf("Open - %v", err)
+		}
+		defer f.Close()
+
+		assert.True(t, f.BigTIFF, "BigTIFF header")
+		assert.Equal(t, len(sizes), len(f.IFDs), "number of IFDs")
+		for i := range sizes {
+			im, err := f.Image(i)
+			if err != nil {
+				t.Fatalf("Image %d - %v", i, err)
+			}
+			assert.Equal(t, typeLong8, im.IFD.Entries[TagTileOffsets].Type, "type of tile offsets of level %d", i)
+			assert.Equal(t, icc, im.IFD.Bytes(TagICCProfile), "ICC profile of level %d", i)
+			got := make([]byte, im.Height*im.RowBytes())
+			assert.Nil(t, im.ReadRows(0, im.Height, got), "ReadRows of level %d", i)
+			assert.True(t, bytes.Equal(pixels[i], got), "pixels of level %d", i)
+		}
+	})
+
+	t.Run("JPEG", func(t *testing.T) {
+		outFile := filepath.Join(dir, "out-jpeg.tif")
+		err := BuildPyramid(levels, outFile, Options{Compression: CompressionJPEG, Quality: 80})
+		assert.Nil(t, err, "BuildPyramid")
+
+		f, err := Open(outFile)
+		if err != nil {
+			t.Fatalf("Open - %v", err)
+		}
+		defer f.Close()
+
+		assert.Equal(t, len(sizes), len(f.IFDs), "number of IFDs")
+		d := f.IFDs[0]
+		assert.Equal(t, uint64(PhotometricYCbCr), d.UintOr(TagPhotometricInterpretation, 0), "photometric")
+		assert.Equal(t, []uint64{2, 2}, d.Uints(TagYCbCrSubSampling), "subsampling")
+
+		offsets, counts := d.Uints(TagTileOffsets), d.Uints(TagTileByteCounts)
+		assert.Equal(t, 6, len(offsets), "tiles in level 0")
+		tile := make([]byte, counts[0])
+		fp, _ := os.Open(outFile)
+		defer fp.Close()
+		fp.ReadAt(tile, int64(offsets[0]))
+		img, err := jpeg.Decode(bytes.NewReader(tile))
+		assert.Nil(t, err, "decode first tile")
+		if err == nil {
+			assert.Equal(t, 256, img.Bounds().Dx(), "decoded tile width")
+		}
+	})
+
+	t.Run("BigEndian16Bit", func(t *testing.T) {
+		inFile := filepath.Join(dir, "be16.tif")
+		outFile := filepath.Join(dir, "out-be16.tif")
+		src := testPattern(70, 50, 1, 16)
+		writeStripTIFF(inFile, 70, 50, 1, 16, binary.BigEndian, src, nil)
+
+		err := BuildPyramid([]string{inFile}, outFile, Options{Compression: CompressionDeflate})
+		assert.Nil(t, err, "BuildPyramid")
+
+		f, err := Open(outFile)
+		if err != nil {
+			t.Fatalf("Open - %v", err)
+		}
+		defer f.Close()
+		im, _ := f.Image(0)
+		got := make([]byte, im.Height*im.RowBytes())
+		assert.Nil(t, im.ReadRows(0, im.Height, got), "ReadRows")
+
+		swapSamples(src, 16) // ReadRows returns little-endian samples
+		assert.True(t, bytes.Equal(src, got), "pixels")
+	})
+
+	t.Run("Predictor16Bit", func(t *testing.T) {
+		inFile := filepath.Join(dir, "rgb16.tif")
+		outFile := filepath.Join(dir, "out-predictor.tif")
+		src := testPattern(300, 70, 3, 16)
+		writeStripTIFF(inFile, 300, 70, 3, 16, binary.LittleEndian, src, nil)
+
+		opts := Options{Compression: CompressionDeflate, Predictor: PredictorHorizontal, Level: 9}
+		err := BuildPyramid([]string{inFile}, outFile, opts)
+		assert.Nil(t, err, "BuildPyramid")
+
+		f, err := Open(outFile)
+		if err != nil {
+			t.Fatalf("Open - %v", err)
+		}
+		defer f.Close()
+		im, _ := f.Image(0)
+		assert.Equal(t, PredictorHorizontal, im.Predictor, "predictor")
+		got := make([]byte, im.Height*im.RowBytes())
+		assert.Nil(t, im.ReadRows(0, im.Height, got), "ReadRows")
+		assert.True(t, bytes.Equal(src, got), "pixels")
+
+		opts.Compression = CompressionJPEG
+		err = BuildPyramid([]string{inFile}, filepath.Join(dir, "fail.tif"), opts)
+		assert.NotNil(t, err, "predictor with JPEG should fail")
+	})
+
+	t.Run("RejectJPEG16Bit", func(t *testing.T) {
+		inFile := filepath.Join(dir, "le16.tif")
+		writeStripTIFF(inFile, 40, 40, 3, 16, binary.LittleEndian, testPattern(40, 40, 3, 16), nil)
+		err := BuildPyramid([]string{inFile}, filepath.Join(dir, "fail.tif"), Options{Compression: CompressionJPEG})
+		assert.NotNil(t, err, "16-bit JPEG should fail")
+	})
+}
+
+func TestReadExistingFile(t *testing.T) {
+	f, err := Open("../../test/resources/images/grayscale-with-adobe-rgb-1998.tif")
+	if err != nil {
+		t.Fatalf("Open - %v", err)
+	}
+	defer f.Close()
+
+	im, err := f.Image(0)
+	if err != nil {
+		t.Fatalf("Image - %v", err)
+	}
+	buf := make([]byte, im.Height*im.RowBytes())
+	assert.Nil(t, im.ReadRows(0, im.Height, buf), "ReadRows")
+	assert.NotEmpty(t, im.IFD.Bytes(TagICCProfile), "ICC profile")
+}
+
+// testPattern returns deterministic pixel data for a w x h image.
+func testPattern(w, h, spp, bps int) []byte {
+	n := w * h * spp * bps / 8
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte((i*7 + i/(w*spp)*13) % 251)
+	}
+	return b
+}
+
+// writeStripTIFF writes an uncompressed single-image TIFF with 16 rows
+// per strip, like the intermediate files produced by vips.
+func writeStripTIFF(path string, w, h, spp, bps int, order binary.ByteOrder, pix, icc []byte) {
+	var buf bytes.Buffer
+	put16 := func(v uint16) { binary.Write(&buf, order, v) }
+	put32 := func(v uint32) { binary.Write(&buf, order, v) }
+
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	put16(42)
+	put32(8 + uint32(len(pix)))
+	buf.Write(pix)
+
+	rowsPerStrip := 16
+	rowBytes := w * spp * bps / 8
+	var offsets, counts []uint32
+	for y := 0; y < h; y += rowsPerStrip {
+		n := rowsPerStrip
+		if y+n > h {
+			n = h - y
+		}
+		offsets = append(offsets, uint32(8+y*rowBytes))
+		counts = append(counts, uint32(n*rowBytes))
+	}
+
+	photometric := PhotometricRGB
+	if spp == 1 {
+		photometric = PhotometricMinIsBlack
+	}
+	type entry struct {
+		tag, typ uint16
+		values   []uint32
+		raw      []byte
+	}
+	entries := []entry{
+		{TagImageWidth, typeLong, []uint32{uint32(w)}, nil},
+		{TagImageLength, typeLong, []uint32{uint32(h)}, nil},
+		{TagBitsPerSample, typeShort, repeat(uint32(bps), spp), nil},
+		{TagCompression, typeShort, []uint32{1}, nil},
+		{TagPhotometricInterpretation, typeShort, []uint32{uint32(photometric)}, nil},
+		{TagStripOffsets, typeLong, offsets, nil},
+		{TagSamplesPerPixel, typeShort, []uint32{uint32(spp)}, nil},
+		{TagRowsPerStrip, typeLong, []uint32{uint32(rowsPerStrip)}, nil},
+		{TagStripByteCounts, typeLong, counts, nil},
+		{TagXResolution, typeRational, []uint32{300, 1}, nil},
+		{TagYResolution, typeRational, []uint32{300, 1}, nil},
+		{TagResolutionUnit, typeShort, []uint32{2}, nil},
+	}
+	if icc != nil {
+		entries = append(entries, entry{TagICCProfile, typeUndefined, nil, icc})
+	}
+
+	ifdPos := buf.Len()
+	dataPos := ifdPos + 2 + 12*len(entries) + 4
+	var data bytes.Buffer
+	put16(uint16(len(entries)))
+	for _, e := range entries {
+		var value bytes.Buffer
+		count := uint32(len(e.values))
+		switch {
+		case e.raw != nil:
+			value.Write(e.raw)
+			count = uint32(len(e.raw))
+		case e.typ == typeShort:
+			for _, v := range e.values {
+				binary.Write(&value, order, uint16(v))
+			}
+		default:
+			for _, v := range e.values {
+				binary.Write(&value, order, v)
+			}
+		}
+		if e.typ == typeRational {
+			count /= 2
+		}
+		put16(e.tag)
+		put16(e.typ)
+		put32(count)
+		if value.Len() <= 4 {
+			b := make([]byte, 4)
+			copy(b, value.Bytes())
+			buf.Write(b)
+		} else {
+			put32(uint32(dataPos + data.Len()))
+			data.Write(value.Bytes())
+		}
+	}
+	put32(0)
+	buf.Write(data.Bytes())
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		panic(err)
+	}
+}
+
+func repeat(v uint32, n int) []uint32 {
+	values := make([]uint32, n)
+	for i := range values {
+		values[i] = v
+	}
+	return values
+}
@@ -0,0 +1,455 @@
+// Package server exposes image conversion as a JSON HTTP API.
+//
+// Endpoints:
+//
+//	POST /jobs                  submit a job, returns its status (202)
+//	GET  /jobs/{id}             status of a job
+//	GET  /jobs/{id}/output      output.Params of a finished job
+//	GET  /jobs/{id}/pyramid     download the pyramidal TIFF of a finished job
+//	DELETE /jobs/{id}           forget a finished job and delete its pyramid
+//
+// A job is submitted either as a JSON body {"params": {...}} whose
+// params.InFile is a path readable by the server, or as multipart form
+// data with the image in a "file" part and optional JSON params in a
+// "params" part. The server always chooses OutFile and the temp
+// directories itself, under Config.Dir, and deletes the temp files of every
+// job. It writes pyramidal TIFFs only; jobs asking for a tile output format
+// or a TargetICCProfile other than the default one are refused.
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gigamorph/go-pyramid/pyramid/input"
+	"github.com/gigamorph/go-pyramid/pyramid/output"
+	"github.com/gigamorph/go-pyramid/pyramid/progress"
+)
+
+// Converter converts a single image. *agent.Agent implements it.
+type Converter interface {
+	Convert(p input.Params) (*output.Params, error)
+}
+
+// Job states.
+const (
+	StatusQueued  = "queued"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// Status is the JSON representation of a job.
+type Status struct {
+	ID       string
+	Status   string
+	InFile   string
+	Error    string         `json:",omitempty"`
+	Output   *output.Params `json:",omitempty"`
+	Created  time.Time
+	Started  *time.Time `json:",omitempty"`
+	Finished *time.Time `json:",omitempty"`
+
+	// Stage the conversion is in, or the last one it reached once the job
+	// is finished. Level and Levels tell which level the resize stage builds.
+	Stage  progress.Stage `json:",omitempty"`
+	Level  int            `json:",omitempty"`
+	Levels int            `json:",omitempty"`
+}
+
+// Config holds the settings of a Server.
+type Config struct {
+	Dir       string       // directory for uploaded images and pyramids
+	Workers   int          // number of concurrent conversions (default 1)
+	QueueSize int          // jobs waiting beyond the running ones (default 100)
+	Defaults  input.Params // parameters used where a job does not set them
+
+	// How long finished jobs and their pyramids are kept, 0 for until they
+	// are deleted with DELETE /jobs/{id}. Expired jobs are removed when the
+	// next job is submitted.
+	Retention time.Duration
+}
+
+// Server runs submitted jobs on a bounded pool of workers.
+type Server struct {
+	converter Converter
+	config    Config
+	queue     chan *job
+	wg        sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+type job struct {
+	params input.Params
+	upload string // path of the uploaded image, if any
+	status Status
+}
+
+// New creates a Server and starts its workers.
+func New(converter Converter, config Config) (*Server, error) {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.QueueSize < 1 {
+		config.QueueSize = 100
+	}
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("server.New failed to create %s - %v", config.Dir, err)
+	}
+
+	s := &Server{
+		converter: converter,
+		config:    config,
+		queue:     make(chan *job, config.QueueSize),
+		jobs:      map[string]*job{},
+	}
+	for i := 0; i < config.Workers; i++ {
+		s.wg.Add(1)
+		go s.work(s.queue)
+	}
+	return s, nil
+}
+
+// Close stops accepting jobs and waits for the queued ones to finish.
+func (s *Server) Close() {
+	s.mu.Lock()
+	q := s.queue
+	s.queue = nil
+	s.mu.Unlock()
+
+	if q != nil {
+		close(q)
+	}
+	s.wg.Wait()
+}
+
+func (s *Server) work(q <-chan *job) {
+	defer s.wg.Done()
+	for j := range q {
+		s.run(j)
+	}
+}
+
+func (s *Server) run(j *job) {
+	s.mu.Lock()
+	now := time.Now()
+	j.status.Status = StatusRunning
+	j.status.Started = &now
+	p := j.params
+	s.mu.Unlock()
+
+	p.Progress = func(e progress.Event) {
+		if e.Phase != progress.PhaseStart {
+			return
+		}
+		s.mu.Lock()
+		j.status.Stage, j.status.Level, j.status.Levels = e.Stage, e.Level, e.Levels
+		s.mu.Unlock()
+	}
+
+	out, err := s.convert(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now()
+	j.status.Finished = &finished
+	if err != nil {
+		j.status.Status = StatusFailed
+		j.status.Error = err.Error()
+		log.Printf("ERROR server.Server job %s failed - %v\n", j.status.ID, err)
+	} else {
+		j.status.Status = StatusDone
+		j.status.Output = out
+	}
+	if j.upload != "" {
+		os.Remove(j.upload)
+	}
+}
+
+// convert keeps a panic in one conversion from taking down the server.
+func (s *Server) convert(p input.Params) (out *output.Params, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic - %v", v)
+		}
+	}()
+	return s.converter.Convert(p)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "jobs":
+		if r.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, "use POST to submit a job")
+			return
+		}
+		s.submit(w, r)
+	case len(parts) == 2 && parts[0] == "jobs" && r.Method == http.MethodDelete:
+		s.delete(w, parts[1])
+	case len(parts) >= 2 && len(parts) <= 3 && parts[0] == "jobs":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			httpError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		st, ok := s.status(parts[1])
+		if !ok {
+			httpError(w, http.StatusNotFound, "no such job")
+			return
+		}
+		if len(parts) == 2 {
+			writeJSON(w, http.StatusOK, st)
+			return
+		}
+		s.result(w, r, st, parts[2])
+	default:
+		httpError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) result(w http.ResponseWriter, r *http.Request, st Status, what string) {
+	if what != "output" && what != "pyramid" {
+		httpError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch st.Status {
+	case StatusDone:
+	case StatusFailed:
+		httpError(w, http.StatusConflict, "job failed - "+st.Error)
+		return
+	default:
+		httpError(w, http.StatusConflict, "job is "+st.Status)
+		return
+	}
+
+	if what == "output" {
+		writeJSON(w, http.StatusOK, st.Output)
+		return
+	}
+	w.Header().Set("Content-Type", "image/tiff")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tif"`, st.ID))
+	http.ServeFile(w, r, s.outFile(st.ID))
+}
+
+// delete forgets the finished job id and deletes its pyramid.
+func (s *Server) delete(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		httpError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	if j.status.Finished == nil {
+		httpError(w, http.StatusConflict, "job is "+j.status.Status)
+		return
+	}
+	if err := s.remove(id); err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// remove forgets the finished job id and deletes its pyramid. s.mu must
+// be held.
+func (s *Server) remove(id string) error {
+	if err := os.Remove(s.outFile(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete the pyramid of job %s - %v", id, err)
+	}
+	delete(s.jobs, id)
+	return nil
+}
+
+// prune removes the jobs that finished more than Retention ago. s.mu must
+// be held.
+func (s *Server) prune(now time.Time) {
+	if s.config.Retention <= 0 {
+		return
+	}
+	for id, j := range s.jobs {
+		if j.status.Finished != nil && now.Sub(*j.status.Finished) > s.config.Retention {
+			if err := s.remove(id); err != nil {
+				log.Printf("ERROR server.Server#prune - %v\n", err)
+			}
+		}
+	}
+}
+
+func (s *Server) status(id string) (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Status{}, false
+	}
+	return j.status, true
+}
+
+func (s *Server) outFile(id string) string {
+	return filepath.Join(s.config.Dir, id+".tif")
+}
+
+// tempDir is where the jobs keep their temp files, each in its own work
+// directory.
+func (s *Server) tempDir() string {
+	return filepath.Join(s.config.Dir, "temp")
+}
+
+// submitRequest is the JSON body of POST /jobs.
+type submitRequest struct {
+	Params input.Params
+}
+
+func (s *Server) submit(w http.ResponseWriter, r *http.Request) {
+	id, err := newID()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	j := &job{params: s.config.Defaults.Copy()}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err = s.readUpload(r, id, j)
+	} else {
+		req := submitRequest{Params: j.params}
+		err = json.NewDecoder(r.Body).Decode(&req)
+		j.params = req.Params
+	}
+	if err != nil {
+		if j.upload != "" {
+			os.Remove(j.upload)
+		}
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if j.params.InFile == "" {
+		httpError(w, http.StatusBadRequest, "params.InFile or an uploaded file is required")
+		return
+	}
+	if err := s.restrict(&j.params, id); err != nil {
+		if j.upload != "" {
+			os.Remove(j.upload)
+		}
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	j.status = Status{ID: id, Status: StatusQueued, InFile: j.params.InFile, Created: time.Now()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	if s.queue == nil {
+		httpError(w, http.StatusServiceUnavailable, "server is shutting down")
+		return
+	}
+	select {
+	case s.queue <- j:
+	default:
+		if j.upload != "" {
+			os.Remove(j.upload)
+		}
+		httpError(w, http.StatusServiceUnavailable, "too many jobs queued")
+		return
+	}
+	s.jobs[id] = j
+	writeJSON(w, http.StatusAccepted, j.status)
+}
+
+// restrict keeps the files of the job id inside the server directory: it
+// chooses OutFile and the temp directories, makes the job delete its temp
+// files, and refuses tile output formats and a profile other than the
+// default one, which would name files anywhere the server can read.
+func (s *Server) restrict(p *input.Params, id string) error {
+	if f := p.OutputFormat; f != "" && f != "tiff" {
+		return fmt.Errorf("output format %s is not served, only tiff", f)
+	}
+	if p.TargetICCProfile != s.config.Defaults.TargetICCProfile {
+		return fmt.Errorf("params.TargetICCProfile cannot be set")
+	}
+	p.OutFile = s.outFile(id)
+	p.TempDir = s.tempDir()
+	imTempDir := p.TempDir
+	p.IMTempDir = &imTempDir
+	p.DeleteTemp = true
+	return nil
+}
+
+// readUpload stores the "file" part of a multipart request in the server
+// directory and applies the optional "params" part to j. A request with
+// more than one "file" part is refused.
+func (s *Server) readUpload(r *http.Request, id string, j *job) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch part.FormName() {
+		case "params":
+			if err := json.NewDecoder(part).Decode(&j.params); err != nil {
+				return fmt.Errorf("invalid params - %v", err)
+			}
+		case "file":
+			if j.upload != "" {
+				return fmt.Errorf("multipart request with more than one file part")
+			}
+			ext := filepath.Ext(part.FileName())
+			j.upload = filepath.Join(s.config.Dir, id+".upload"+ext)
+			f, err := os.Create(j.upload)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, part)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return fmt.Errorf("failed to store upload - %v", err)
+			}
+		}
+		part.Close()
+	}
+	if j.upload == "" {
+		return fmt.Errorf("multipart request without a file part")
+	}
+	j.params.InFile = j.upload
+	return nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to create job id - %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"Error": msg})
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gigamorph/go-pyramid/pyramid/input"
+	"github.com/gigamorph/go-pyramid/pyramid/output"
+	"github.com/gigamorph/go-pyramid/pyramid/progress"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConverter writes the content of the input file, prefixed, as the
+// pyramid. Input files whose content is "bad" fail. If block is not nil,
+// conversions wait until it is closed.
+type fakeConverter struct {
+	block chan struct{}
+}
+
+func (c *fakeConverter) Convert(p input.Params) (*output.Params, error) {
+	if c.block != nil {
+		<-c.block
+	}
+	b, err := ioutil.ReadFile(p.InFile)
+	if err != nil {
+		return nil, err
+	}
+	if string(b) == "bad" {
+		return nil, fmt.Errorf("cannot decode %s", p.InFile)
+	}
+	if p.Progress != nil {
+		p.Progress(progress.Event{Stage: progress.StageCombine, Phase: progress.PhaseStart})
+	}
+	if err := ioutil.WriteFile(p.OutFile, append([]byte("pyramid:"), b...), 0600); err != nil {
+		return nil, err
+	}
+	return &output.Params{InputWidth: uint(p.Quality), OutputWidth: 10, OutputHeight: 20}, nil
+}
+
+func newTestServer(t *testing.T, conv Converter, queueSize int) (*Server, *httptest.Server, string) {
+	dir, err := ioutil.TempDir("", "go-pyramid-server-test")
+	if err != nil {
+		panic(err)
+	}
+	s, err := New(conv, Config{
+		Dir:       dir,
+		Workers:   2,
+		QueueSize: queueSize,
+		Defaults:  input.Params{Quality: 90},
+	})
+	if err != nil {
+		t.Fatalf("New - %v", err)
+	}
+	return s, httptest.NewServer(s), dir
+}
+
+func submitJSON(t *testing.T, url, body string) (*http.Response, Status) {
+	res, err := http.Post(url+"/jobs", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST /jobs - %v", err)
+	}
+	defer res.Body.Close()
+	var st Status
+	json.NewDecoder(res.Body).Decode(&st)
+	return res, st
+}
+
+func waitFor(t *testing.T, url, id string) Status {
+	for i := 0; i < 200; i++ {
+		res, err := http.Get(url + "/jobs/" + id)
+		if err != nil {
+			t.Fatalf("GET /jobs/%s - %v", id, err)
+		}
+		var st Status
+		json.NewDecoder(res.Body).Decode(&st)
+		res.Body.Close()
+		if st.Status == StatusDone || st.Status == StatusFailed {
+			return st
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return Status{}
+}
+
+func TestServer(t *testing.T) {
+	s, ts, dir := newTestServer(t, &fakeConverter{}, 10)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	defer ts.Close()
+
+	inFile := dir + "/in.jpg"
+	ioutil.WriteFile(inFile, []byte("image"), 0600)
+	badFile := dir + "/bad.jpg"
+	ioutil.WriteFile(badFile, []byte("bad"), 0600)
+
+	t.Run("SubmitPath", func(t *testing.T) {
+		res, st := submitJSON(t, ts.URL, fmt.Sprintf(`{"params": {"InFile": %q, "Quality": 80}}`, inFile))
+		assert.Equal(t, http.StatusAccepted, res.StatusCode, "status code")
+		assert.NotEmpty(t, st.ID, "job id")
+
+		st = waitFor(t, ts.URL, st.ID)
+		assert.Equal(t, StatusDone, st.Status, "job status")
+		assert.Equal(t, uint(80), st.Output.InputWidth, "params passed to converter")
+		assert.Equal(t, progress.StageCombine, st.Stage, "last stage reached")
+
+		res, _ = http.Get(ts.URL + "/jobs/" + st.ID + "/output")
+		var out output.Params
+		json.NewDecoder(res.Body).Decode(&out)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, "output status code")
+		assert.Equal(t, uint(20), out.OutputHeight, "output params")
+
+		res, _ = http.Get(ts.URL + "/jobs/" + st.ID + "/pyramid")
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, "pyramid status code")
+		assert.Equal(t, "image/tiff", res.Header.Get("Content-Type"), "pyramid content type")
+		assert.Equal(t, "pyramid:image", string(b), "pyramid content")
+	})
+
+	t.Run("Upload", func(t *testing.T) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		pw, _ := mw.CreateFormField("params")
+		pw.Write([]byte(`{"Quality": 70}`))
+		fw, _ := mw.CreateFormFile("file", "upload.jpg")
+		fw.Write([]byte("uploaded"))
+		mw.Close()
+
+		res, err := http.Post(ts.URL+"/jobs", mw.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatalf("POST /jobs - %v", err)
+		}
+		var st Status
+		json.NewDecoder(res.Body).Decode(&st)
+		res.Body.Close()
+		assert.Equal(t, http.StatusAccepted, res.StatusCode, "status code")
+
+		st = waitFor(t, ts.URL, st.ID)
+		assert.Equal(t, StatusDone, st.Status, "job status")
+		assert.Equal(t, uint(70), st.Output.InputWidth, "params passed to converter")
+
+		res, _ = http.Get(ts.URL + "/jobs/" + st.ID + "/pyramid")
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "pyramid:uploaded", string(b), "pyramid content")
+
+		_, err = os.Stat(st.InFile)
+		assert.True(t, os.IsNotExist(err), "upload removed after conversion")
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		_, st := submitJSON(t, ts.URL, fmt.Sprintf(`{"params": {"InFile": %q}}`, badFile))
+		st = waitFor(t, ts.URL, st.ID)
+		assert.Equal(t, StatusFailed, st.Status, "job status")
+		assert.Contains(t, st.Error, "cannot decode", "error")
+
+		res, _ := http.Get(ts.URL + "/jobs/" + st.ID + "/pyramid")
+		res.Body.Close()
+		assert.Equal(t, http.StatusConflict, res.StatusCode, "no pyramid for a failed job")
+	})
+
+	t.Run("Restrict", func(t *testing.T) {
+		elsewhere := "/elsewhere"
+		p := input.Params{InFile: inFile, OutFile: "/elsewhere/a.tif", TempDir: elsewhere, IMTempDir: &elsewhere, Quality: 90}
+		assert.Nil(t, s.restrict(&p, "abc"), "restrict")
+		assert.Equal(t, filepath.Join(dir, "abc.tif"), p.OutFile, "out file")
+		assert.Equal(t, filepath.Join(dir, "temp"), p.TempDir, "temp dir")
+		assert.Equal(t, filepath.Join(dir, "temp"), *p.IMTempDir, "ImageMagick temp dir")
+		assert.True(t, p.DeleteTemp, "temp files deleted")
+		assert.Equal(t, "/elsewhere", elsewhere, "client value not written through")
+	})
+
+	t.Run("BadRequests", func(t *testing.T) {
+		res, _ := submitJSON(t, ts.URL, `{"params": `)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, "invalid JSON")
+
+		res, _ = submitJSON(t, ts.URL, `{"params": {"Quality": 80}}`)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, "missing InFile")
+
+		res, _ = submitJSON(t, ts.URL, fmt.Sprintf(`{"params": {"InFile": %q, "OutputFormat": "dzi"}}`, inFile))
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, "tile output format")
+
+		res, _ = submitJSON(t, ts.URL, fmt.Sprintf(`{"params": {"InFile": %q, "TargetICCProfile": "/etc/passwd"}}`, inFile))
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, "target profile")
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "first.jpg")
+		fw.Write([]byte("first"))
+		fw, _ = mw.CreateFormFile("file", "second.png")
+		fw.Write([]byte("second"))
+		mw.Close()
+		res, err := http.Post(ts.URL+"/jobs", mw.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatalf("POST /jobs - %v", err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, "two file parts")
+		uploads, _ := filepath.Glob(filepath.Join(dir, "*.upload*"))
+		assert.Empty(t, uploads, "no upload left behind")
+
+		res, _ = http.Get(ts.URL + "/jobs/nosuchjob")
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotFound, res.StatusCode, "unknown job")
+
+		res, _ = http.Get(ts.URL + "/jobs")
+		res.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode, "GET /jobs")
+	})
+}
+
+func TestServerQueueFull(t *testing.T) {
+	conv := &fakeConverter{block: make(chan struct{})}
+	s, ts, dir := newTestServer(t, conv, 1)
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+
+	inFile := dir + "/in.jpg"
+	ioutil.WriteFile(inFile, []byte("image"), 0600)
+	body := fmt.Sprintf(`{"params": {"InFile": %q}}`, inFile)
+
+	// 2 workers are busy and 1 job waits in the queue; more are refused.
+	codes := map[int]int{}
+	for i := 0; i < 6; i++ {
+		res, _ := submitJSON(t, ts.URL, body)
+		codes[res.StatusCode]++
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 3, codes[http.StatusAccepted], "accepted jobs")
+	assert.Equal(t, 3, codes[http.StatusServiceUnavailable], "refused jobs")
+
+	res, st := submitJSON(t, ts.URL, body)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "still full")
+	assert.Empty(t, st.ID, "no job created")
+
+	close(conv.block)
+	s.Close()
+
+	res, _ = submitJSON(t, ts.URL, body)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "closed server refuses jobs")
+}
+
+func TestServerCloseAtOnce(t *testing.T) {
+	// Close may run before the workers have started.
+	for i := 0; i < 20; i++ {
+		s, ts, dir := newTestServer(t, &fakeConverter{}, 1)
+		done := make(chan struct{})
+		go func() {
+			s.Close()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Close did not return")
+		}
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestServerDelete(t *testing.T) {
+	conv := &fakeConverter{block: make(chan struct{})}
+	s, ts, dir := newTestServer(t, conv, 10)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	defer ts.Close()
+
+	inFile := dir + "/in.jpg"
+	ioutil.WriteFile(inFile, []byte("image"), 0600)
+	body := fmt.Sprintf(`{"params": {"InFile": %q}}`, inFile)
+	del := func(id string) int {
+		req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/jobs/"+id, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("DELETE /jobs/%s - %v", id, err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	_, st := submitJSON(t, ts.URL, body)
+	assert.Equal(t, http.StatusConflict, del(st.ID), "unfinished job")
+	close(conv.block)
+	waitFor(t, ts.URL, st.ID)
+	assert.FileExists(t, s.outFile(st.ID))
+
+	assert.Equal(t, http.StatusNoContent, del(st.ID), "finished job")
+	_, err := os.Stat(s.outFile(st.ID))
+	assert.True(t, os.IsNotExist(err), "pyramid deleted")
+	res, _ := http.Get(ts.URL + "/jobs/" + st.ID)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "job forgotten")
+	assert.Equal(t, http.StatusNotFound, del(st.ID), "deleted twice")
+
+	t.Run("Retention", func(t *testing.T) {
+		s.config.Retention = time.Millisecond
+		_, st := submitJSON(t, ts.URL, body)
+		waitFor(t, ts.URL, st.ID)
+		time.Sleep(10 * time.Millisecond)
+
+		_, next := submitJSON(t, ts.URL, body)
+		res, _ := http.Get(ts.URL + "/jobs/" + st.ID)
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotFound, res.StatusCode, "expired job removed on submit")
+		_, err := os.Stat(s.outFile(st.ID))
+		assert.True(t, os.IsNotExist(err), "expired pyramid deleted")
+		waitFor(t, ts.URL, next.ID)
+	})
+}
@@ -0,0 +1,163 @@
+package tiles
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DZIOptions controls the tiles written by WriteDZI.
+type DZIOptions struct {
+	TileSize int    // width and height of the tiles without the overlap (default 256)
+	Overlap  int    // pixels each tile shares with its neighbours on every side
+	Format   string // "jpg" (default) or "png"
+	Quality  int    // JPEG quality (1-100, default 90)
+}
+
+func (o DZIOptions) withDefaults() DZIOptions {
+	if o.TileSize == 0 {
+		o.TileSize = 256
+	}
+	if o.Format == "" {
+		o.Format = "jpg"
+	}
+	if o.Quality == 0 {
+		o.Quality = 90
+	}
+	return o
+}
+
+func (o DZIOptions) validate() error {
+	if o.TileSize <= 0 {
+		return fmt.Errorf("invalid tile size %d", o.TileSize)
+	}
+	if o.Overlap < 0 || o.Overlap >= o.TileSize {
+		return fmt.Errorf("invalid overlap %d", o.Overlap)
+	}
+	if o.Format != "jpg" && o.Format != "png" {
+		return fmt.Errorf("unknown tile format %s", o.Format)
+	}
+	if o.Quality < 1 || o.Quality > 100 {
+		return fmt.Errorf("invalid JPEG quality %d", o.Quality)
+	}
+	return nil
+}
+
+const dziDescriptor = `<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="%s" Overlap="%d" TileSize="%d">
+  <Size Width="%d" Height="%d"/>
+</Image>
+`
+
+// WriteDZI writes levels as a Deep Zoom image: the descriptor dziFile,
+// e.g. "image.dzi", and the tiles in "image_files/<level>/<col>_<row>.<format>".
+// Deep Zoom level N is the full-resolution image and every level below is
+// half the size of the one above, rounded up, down to 1x1. They are read
+// from levels as described in halvings.
+//
+// The tile directory must not exist or be empty; it and dziFile are
+// removed if WriteDZI fails. WriteDZI returns the number of tiles written.
+func WriteDZI(ctx context.Context, levels []string, dziFile string, opts DZIOptions) (n int, err error) {
+	opts = opts.withDefaults()
+	if err = opts.validate(); err != nil {
+		return 0, fmt.Errorf("tiles.WriteDZI invalid options - %v", err)
+	}
+	if len(levels) == 0 {
+		return 0, fmt.Errorf("tiles.WriteDZI no levels")
+	}
+	dir := strings.TrimSuffix(dziFile, filepath.Ext(dziFile)) + "_files"
+	if err = prepareDir(dir); err != nil {
+		return 0, fmt.Errorf("tiles.WriteDZI failed to create %s - %v", dir, err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+			os.Remove(dziFile)
+		}
+	}()
+
+	h, err := openHalvings(levels)
+	if err != nil {
+		return 0, fmt.Errorf("tiles.WriteDZI - %v", err)
+	}
+	defer h.Close()
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return n, err
+		}
+		w, ht := h.Size()
+		number := dziLevel(h.Width, h.Height, h.K)
+		written, err := writeDZILevel(ctx, h.readBand, w, ht, dir, number, opts)
+		n += written
+		if err != nil {
+			return n, fmt.Errorf("tiles.WriteDZI failed to write level %d - %w", number, err)
+		}
+		if number == 0 {
+			break
+		}
+		if err = h.Next(); err != nil {
+			return n, fmt.Errorf("tiles.WriteDZI - %v", err)
+		}
+	}
+
+	descriptor := fmt.Sprintf(dziDescriptor, opts.Format, opts.Overlap, opts.TileSize, h.Width, h.Height)
+	if err = ioutil.WriteFile(dziFile, []byte(descriptor), 0644); err != nil {
+		return n, fmt.Errorf("tiles.WriteDZI failed to write %s - %v", dziFile, err)
+	}
+	return n, nil
+}
+
+// dziLevel returns the Deep Zoom level number of the image of
+// width x height halved k times: the full-resolution image is level
+// ceil(log2(max(width, height))) and the 1x1 image level 0.
+func dziLevel(width, height, k int) int {
+	max := width
+	if height > max {
+		max = height
+	}
+	top := 0
+	for 1<<uint(top) < max {
+		top++
+	}
+	return top - k
+}
+
+// writeDZILevel writes the tiles of the Deep Zoom level number of w x h
+// pixels, whose rows are read with readBand.
+func writeDZILevel(ctx context.Context, readBand func(y0, y1 int) (*band, error), w, h int, dir string, number int, opts DZIOptions) (n int, err error) {
+	ts, ov := opts.TileSize, opts.Overlap
+	span := func(i, size int) (int, int) {
+		start, end := i*ts-ov, (i+1)*ts+ov
+		if start < 0 {
+			start = 0
+		}
+		if end > size {
+			end = size
+		}
+		return start, end
+	}
+
+	for row := 0; row < ceilDiv(h, ts); row++ {
+		if err = ctx.Err(); err != nil {
+			return n, err
+		}
+		y0, y1 := span(row, h)
+		b, err := readBand(y0, y1)
+		if err != nil {
+			return n, err
+		}
+		for col := 0; col < ceilDiv(w, ts); col++ {
+			x0, x1 := span(col, w)
+			path := filepath.Join(dir, fmt.Sprint(number), fmt.Sprintf("%d_%d.%s", col, row, opts.Format))
+			if err = writeImage(path, b.crop(x0, y0, x1-x0, y1-y0), opts.Format, opts.Quality); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
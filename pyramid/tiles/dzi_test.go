@@ -0,0 +1,85 @@
+package tiles
+
+import (
+	"context"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteDZI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiles-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	levels := writeLevels(dir, 513, 300, 3, 3)
+
+	t.Run("JPEG", func(t *testing.T) {
+		dziFile := filepath.Join(dir, "out", "image.dzi")
+		n, err := WriteDZI(context.Background(), levels, dziFile, DZIOptions{TileSize: 256, Overlap: 1})
+		assert.Nil(t, err, "WriteDZI")
+		assert.Equal(t, 6+2+9, n, "number of tiles")
+
+		b, err := ioutil.ReadFile(dziFile)
+		assert.Nil(t, err, "read descriptor")
+		assert.Contains(t, string(b), `Format="jpg" Overlap="1" TileSize="256"`)
+		assert.Contains(t, string(b), `<Size Width="513" Height="300"/>`)
+
+		files := filepath.Join(dir, "out", "image_files")
+		tiles := map[string][2]int{
+			"10/0_0.jpg": {257, 257}, // full resolution, level ceil(log2(513))
+			"10/1_0.jpg": {258, 257},
+			"10/2_0.jpg": {2, 257},
+			"10/1_1.jpg": {258, 45},
+			"9/0_0.jpg":  {257, 150}, // 257x150, a column more than the 256-wide level file
+			"9/1_0.jpg":  {2, 150},
+			"8/0_0.jpg":  {129, 75},
+			"7/0_0.jpg":  {65, 38}, // made in memory
+			"1/0_0.jpg":  {2, 1},
+			"0/0_0.jpg":  {1, 1},
+		}
+		for p, size := range tiles {
+			assertJPEG(t, filepath.Join(files, p), size[0], size[1])
+		}
+		assertMissing(t, filepath.Join(files, "11"))
+	})
+
+	t.Run("PNG", func(t *testing.T) {
+		gray := writeLevels(filepath.Join(dir, "gray"), 300, 200, 1, 2)
+		dziFile := filepath.Join(dir, "png", "image.dzi")
+		_, err := WriteDZI(context.Background(), gray, dziFile, DZIOptions{TileSize: 254, Format: "png"})
+		assert.Nil(t, err, "WriteDZI")
+
+		f, err := os.Open(filepath.Join(dir, "png", "image_files", "9", "1_0.png"))
+		if assert.Nil(t, err, "open tile") {
+			defer f.Close()
+			cfg, err := png.DecodeConfig(f)
+			assert.Nil(t, err, "decode tile")
+			assert.Equal(t, [2]int{46, 200}, [2]int{cfg.Width, cfg.Height}, "tile size without overlap")
+		}
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		dziFile := filepath.Join(dir, "invalid", "image.dzi")
+		_, err := WriteDZI(context.Background(), levels, dziFile, DZIOptions{Format: "gif"})
+		assert.NotNil(t, err, "unknown format")
+		_, err = WriteDZI(context.Background(), levels, dziFile, DZIOptions{TileSize: 8, Overlap: 8})
+		assert.NotNil(t, err, "overlap as large as the tiles")
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		dziFile := filepath.Join(dir, "canceled", "image.dzi")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := WriteDZI(ctx, levels, dziFile, DZIOptions{})
+		assert.NotNil(t, err, "WriteDZI")
+		assertMissing(t, dziFile)
+		assertMissing(t, filepath.Join(dir, "canceled", "image_files"))
+	})
+}
@@ -0,0 +1,256 @@
+package tiles
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// IIIFOptions controls the tiles and the info.json written by WriteIIIF.
+type IIIFOptions struct {
+	ID         string // URI of the image service, written to info.json
+	Version    string // Image API version: "3" (3.0, default) or "2" (2.1)
+	TileWidth  int    // tile width in pixels (default 256)
+	TileHeight int    // tile height in pixels (default 256)
+	Quality    int    // JPEG quality (1-100, default 90)
+}
+
+func (o IIIFOptions) withDefaults() IIIFOptions {
+	if o.Version == "" {
+		o.Version = "3"
+	}
+	if o.TileWidth == 0 {
+		o.TileWidth = 256
+	}
+	if o.TileHeight == 0 {
+		o.TileHeight = 256
+	}
+	if o.Quality == 0 {
+		o.Quality = 90
+	}
+	return o
+}
+
+func (o IIIFOptions) validate() error {
+	if o.ID == "" {
+		return fmt.Errorf("no IIIF id")
+	}
+	if o.Version != "2" && o.Version != "3" {
+		return fmt.Errorf("unknown IIIF Image API version %s", o.Version)
+	}
+	if o.TileWidth <= 0 || o.TileHeight <= 0 {
+		return fmt.Errorf("invalid tile size %dx%d", o.TileWidth, o.TileHeight)
+	}
+	if o.Quality < 1 || o.Quality > 100 {
+		return fmt.Errorf("invalid JPEG quality %d", o.Quality)
+	}
+	return nil
+}
+
+// IIIFSize is the size of an image in info.json.
+type IIIFSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// IIIFTiles describes the tiles in info.json.
+type IIIFTiles struct {
+	Width        int   `json:"width"`
+	Height       int   `json:"height"`
+	ScaleFactors []int `json:"scaleFactors"`
+}
+
+type iiifInfo3 struct {
+	Context  string      `json:"@context"`
+	ID       string      `json:"id"`
+	Type     string      `json:"type"`
+	Protocol string      `json:"protocol"`
+	Profile  string      `json:"profile"`
+	Width    int         `json:"width"`
+	Height   int         `json:"height"`
+	Sizes    []IIIFSize  `json:"sizes,omitempty"`
+	Tiles    []IIIFTiles `json:"tiles"`
+}
+
+type iiifInfo2 struct {
+	Context  string      `json:"@context"`
+	ID       string      `json:"@id"`
+	Protocol string      `json:"protocol"`
+	Width    int         `json:"width"`
+	Height   int         `json:"height"`
+	Profile  []string    `json:"profile"`
+	Sizes    []IIIFSize  `json:"sizes,omitempty"`
+	Tiles    []IIIFTiles `json:"tiles"`
+}
+
+// WriteIIIF writes levels to dir as IIIF Image API level-0 static tiles:
+// dir/info.json and, for every tile at every scale factor,
+// dir/{region}/{size}/0/default.jpg with the region and size in the
+// canonical form of the API version. Level i is used for scale factor
+// 2^i, so it must be the full-resolution image scaled down by that much,
+// rounded down. Levels that fit in one tile are also written with the
+// "full" region and listed in the sizes of info.json.
+//
+// dir must not exist or be empty; it is removed if WriteIIIF fails.
+// WriteIIIF returns the number of image files written.
+func WriteIIIF(ctx context.Context, levels []string, dir string, opts IIIFOptions) (n int, err error) {
+	opts = opts.withDefaults()
+	if err = opts.validate(); err != nil {
+		return 0, fmt.Errorf("tiles.WriteIIIF invalid options - %v", err)
+	}
+	if len(levels) == 0 {
+		return 0, fmt.Errorf("tiles.WriteIIIF no levels")
+	}
+	if err = prepareDir(dir); err != nil {
+		return 0, fmt.Errorf("tiles.WriteIIIF failed to create %s - %v", dir, err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	var width, height int
+	var sizes []IIIFSize
+	tiles := IIIFTiles{Width: opts.TileWidth, Height: opts.TileHeight}
+	for i, file := range levels {
+		if err = ctx.Err(); err != nil {
+			return n, err
+		}
+		var l *level
+		if l, err = openLevel(file); err != nil {
+			return n, fmt.Errorf("tiles.WriteIIIF failed to open level %d - %v", i, err)
+		}
+		if i == 0 {
+			width, height = l.Width, l.Height
+		}
+		s := 1 << uint(i)
+		if l.Width != width/s || l.Height != height/s {
+			l.Close()
+			return n, fmt.Errorf("tiles.WriteIIIF level %d is %dx%d, expected %dx%d",
+				i, l.Width, l.Height, width/s, height/s)
+		}
+		written, single, werr := writeIIIFLevel(ctx, l, s, width, height, dir, opts)
+		l.Close()
+		n += written
+		if werr != nil {
+			return n, fmt.Errorf("tiles.WriteIIIF failed to write level %d - %w", i, werr)
+		}
+		tiles.ScaleFactors = append(tiles.ScaleFactors, s)
+		if single {
+			sizes = append([]IIIFSize{scaledSize(width, height, s)}, sizes...)
+		}
+	}
+
+	var info interface{}
+	if opts.Version == "2" {
+		info = iiifInfo2{
+			Context:  "http://iiif.io/api/image/2/context.json",
+			ID:       opts.ID,
+			Protocol: "http://iiif.io/api/image",
+			Width:    width,
+			Height:   height,
+			Profile:  []string{"http://iiif.io/api/image/2/level0.json"},
+			Sizes:    sizes,
+			Tiles:    []IIIFTiles{tiles},
+		}
+	} else {
+		info = iiifInfo3{
+			Context:  "http://iiif.io/api/image/3/context.json",
+			ID:       opts.ID,
+			Type:     "ImageService3",
+			Protocol: "http://iiif.io/api/image",
+			Profile:  "level0",
+			Width:    width,
+			Height:   height,
+			Sizes:    sizes,
+			Tiles:    []IIIFTiles{tiles},
+		}
+	}
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return n, fmt.Errorf("tiles.WriteIIIF failed to encode info.json - %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "info.json"), append(b, '\n'), 0644); err != nil {
+		return n, fmt.Errorf("tiles.WriteIIIF failed to write info.json - %v", err)
+	}
+	return n, nil
+}
+
+// scaledSize returns the size of the full image of width x height at scale
+// factor s, as computed by IIIF clients.
+func scaledSize(width, height, s int) IIIFSize {
+	return IIIFSize{Width: ceilDiv(width, s), Height: ceilDiv(height, s)}
+}
+
+// writeIIIFLevel writes the tiles of scale factor s from level l of the
+// image of width x height. It returns the number of files written and
+// whether the level fits in a single tile.
+func writeIIIFLevel(ctx context.Context, l *level, s, width, height int, dir string, opts IIIFOptions) (n int, single bool, err error) {
+	tw, th := opts.TileWidth, opts.TileHeight
+	cols, rows := ceilDiv(width, tw*s), ceilDiv(height, th*s)
+	single = cols == 1 && rows == 1
+
+	for row := 0; row < rows; row++ {
+		if err = ctx.Err(); err != nil {
+			return n, single, err
+		}
+		ry := row * th * s
+		rh := min(th*s, height-ry)
+		sh := ceilDiv(rh, s)
+		b, err := l.readBand(row*th, row*th+sh)
+		if err != nil {
+			return n, single, err
+		}
+
+		for col := 0; col < cols; col++ {
+			rx := col * tw * s
+			rw := min(tw*s, width-rx)
+			sw := ceilDiv(rw, s)
+			img := b.crop(col*tw, row*th, sw, sh)
+
+			size := iiifSize(opts.Version, sw, sh)
+			paths := []string{filepath.Join(fmt.Sprintf("%d,%d,%d,%d", rx, ry, rw, rh), size)}
+			if single {
+				paths = append(paths, filepath.Join("full", size))
+				if s == 1 {
+					paths = append(paths, filepath.Join("full", iiifMaxSize(opts.Version)))
+				}
+			}
+			for _, p := range paths {
+				if err = writeImage(filepath.Join(dir, p, "0", "default.jpg"), img, "jpg", opts.Quality); err != nil {
+					return n, single, err
+				}
+				n++
+			}
+		}
+	}
+	return n, single, nil
+}
+
+// iiifSize returns the canonical size parameter for w x h: "w,h" in 3.0
+// and "w," in 2.1.
+func iiifSize(version string, w, h int) string {
+	if version == "2" {
+		return fmt.Sprintf("%d,", w)
+	}
+	return fmt.Sprintf("%d,%d", w, h)
+}
+
+// iiifMaxSize returns the size parameter for the full-size image.
+func iiifMaxSize(version string) string {
+	if version == "2" {
+		return "full"
+	}
+	return "max"
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,222 @@
+package tiles
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gigamorph/go-pyramid/pyramid/ptiff"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteIIIF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiles-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 513 is one more than two tiles at scale factor 2, so that level 1
+	// (256 wide) has a one-pixel sliver of a column in the IIIF grid.
+	levels := writeLevels(dir, 513, 300, 3, 3)
+
+	t.Run("Version3", func(t *testing.T) {
+		out := filepath.Join(dir, "v3")
+		n, err := WriteIIIF(context.Background(), levels, out, IIIFOptions{ID: "https://example.org/iiif/v3"})
+		assert.Nil(t, err, "WriteIIIF")
+
+		var info map[string]interface{}
+		readJSON(t, filepath.Join(out, "info.json"), &info)
+		assert.Equal(t, "http://iiif.io/api/image/3/context.json", info["@context"])
+		assert.Equal(t, "https://example.org/iiif/v3", info["id"])
+		assert.Equal(t, "ImageService3", info["type"])
+		assert.Equal(t, "level0", info["profile"])
+		assert.Equal(t, 513.0, info["width"])
+		assert.Equal(t, 300.0, info["height"])
+		assert.Equal(t, []interface{}{map[string]interface{}{
+			"width": 256.0, "height": 256.0, "scaleFactors": []interface{}{1.0, 2.0, 4.0},
+		}}, info["tiles"])
+		assert.Equal(t, []interface{}{map[string]interface{}{"width": 129.0, "height": 75.0}}, info["sizes"])
+
+		tiles := map[string][2]int{
+			// scale factor 1: 3 x 2 tiles
+			"0,0,256,256/256,256":   {256, 256},
+			"256,0,256,256/256,256": {256, 256},
+			"512,0,1,256/1,256":     {1, 256},
+			"0,256,256,44/256,44":   {256, 44},
+			"512,256,1,44/1,44":     {1, 44},
+			"0,0,512,300/256,150":   {256, 150}, // scale factor 2
+			"512,0,1,300/1,150":     {1, 150},
+			"0,0,513,300/129,75":    {129, 75}, // scale factor 4
+			"full/129,75":           {129, 75},
+		}
+		for p, size := range tiles {
+			assertJPEG(t, filepath.Join(out, p, "0", "default.jpg"), size[0], size[1])
+		}
+		assert.Equal(t, 6+2+2, n, "number of files")
+		assertMissing(t, filepath.Join(out, "full", "max"))
+	})
+
+	t.Run("Version2", func(t *testing.T) {
+		out := filepath.Join(dir, "v2")
+		_, err := WriteIIIF(context.Background(), levels, out, IIIFOptions{
+			ID:        "https://example.org/iiif/v2",
+			Version:   "2",
+			TileWidth: 512,
+		})
+		assert.Nil(t, err, "WriteIIIF")
+
+		var info map[string]interface{}
+		readJSON(t, filepath.Join(out, "info.json"), &info)
+		assert.Equal(t, "http://iiif.io/api/image/2/context.json", info["@context"])
+		assert.Equal(t, "https://example.org/iiif/v2", info["@id"])
+		assert.Equal(t, []interface{}{"http://iiif.io/api/image/2/level0.json"}, info["profile"])
+		assert.Equal(t, []interface{}{
+			map[string]interface{}{"width": 129.0, "height": 75.0},
+			map[string]interface{}{"width": 257.0, "height": 150.0},
+		}, info["sizes"])
+
+		assertJPEG(t, filepath.Join(out, "0,0,512,256", "512,", "0", "default.jpg"), 512, 256)
+		assertJPEG(t, filepath.Join(out, "0,0,513,300", "257,", "0", "default.jpg"), 257, 150)
+		assertJPEG(t, filepath.Join(out, "full", "257,", "0", "default.jpg"), 257, 150)
+		assertJPEG(t, filepath.Join(out, "full", "129,", "0", "default.jpg"), 129, 75)
+	})
+
+	t.Run("FullMax", func(t *testing.T) {
+		out := filepath.Join(dir, "small")
+		small := writeLevels(filepath.Join(dir, "small-levels"), 200, 100, 1, 1)
+		n, err := WriteIIIF(context.Background(), small, out, IIIFOptions{ID: "https://example.org/iiif/small"})
+		assert.Nil(t, err, "WriteIIIF")
+		assert.Equal(t, 3, n, "number of files")
+		assertJPEG(t, filepath.Join(out, "0,0,200,100", "200,100", "0", "default.jpg"), 200, 100)
+		assertJPEG(t, filepath.Join(out, "full", "200,100", "0", "default.jpg"), 200, 100)
+		assertJPEG(t, filepath.Join(out, "full", "max", "0", "default.jpg"), 200, 100)
+	})
+
+	t.Run("NotEmpty", func(t *testing.T) {
+		out := filepath.Join(dir, "notempty")
+		os.MkdirAll(out, 0755)
+		ioutil.WriteFile(filepath.Join(out, "other.txt"), nil, 0644)
+		_, err := WriteIIIF(context.Background(), levels, out, IIIFOptions{ID: "x"})
+		assert.NotNil(t, err, "WriteIIIF")
+		_, err = os.Stat(filepath.Join(out, "other.txt"))
+		assert.Nil(t, err, "existing file is kept")
+	})
+
+	t.Run("WrongLevelSize", func(t *testing.T) {
+		out := filepath.Join(dir, "wrong")
+		_, err := WriteIIIF(context.Background(), []string{levels[0], levels[2]}, out, IIIFOptions{ID: "x"})
+		assert.NotNil(t, err, "WriteIIIF")
+		assertMissing(t, out)
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		out := filepath.Join(dir, "canceled")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := WriteIIIF(ctx, levels, out, IIIFOptions{ID: "x"})
+		assert.True(t, errors.Is(err, context.Canceled), "error %v is context.Canceled", err)
+		assertMissing(t, out)
+	})
+}
+
+// writeLevels writes n levels of the w x h image with spp samples per
+// pixel to dir, each half the size of the one above, and returns their
+// paths.
+func writeLevels(dir string, w, h, spp, n int) []string {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		panic(err)
+	}
+	var files []string
+	for i := 0; i < n; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("level_%d.tif", i))
+		writeLevel(file, w>>uint(i), h>>uint(i), spp)
+		files = append(files, file)
+	}
+	return files
+}
+
+// writeLevel writes an uncompressed 8-bit TIFF of w x h pixels in one
+// strip.
+func writeLevel(path string, w, h, spp int) {
+	pix := make([]byte, w*h*spp)
+	for i := range pix {
+		pix[i] = byte(i * 7 % 251)
+	}
+	photometric := ptiff.PhotometricRGB
+	if spp == 1 {
+		photometric = ptiff.PhotometricMinIsBlack
+	}
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.WriteString("II")
+	binary.Write(&buf, le, uint16(42))
+	binary.Write(&buf, le, uint32(8+len(pix)))
+	buf.Write(pix)
+
+	entries := [][3]uint32{ // tag, type (3 SHORT, 4 LONG), value
+		{uint32(ptiff.TagImageWidth), 4, uint32(w)},
+		{uint32(ptiff.TagImageLength), 4, uint32(h)},
+		{uint32(ptiff.TagBitsPerSample), 3, 8},
+		{uint32(ptiff.TagCompression), 3, uint32(ptiff.CompressionNone)},
+		{uint32(ptiff.TagPhotometricInterpretation), 3, uint32(photometric)},
+		{uint32(ptiff.TagStripOffsets), 4, 8},
+		{uint32(ptiff.TagSamplesPerPixel), 3, uint32(spp)},
+		{uint32(ptiff.TagRowsPerStrip), 4, uint32(h)},
+		{uint32(ptiff.TagStripByteCounts), 4, uint32(len(pix))},
+	}
+	binary.Write(&buf, le, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(&buf, le, uint16(e[0]))
+		binary.Write(&buf, le, uint16(e[1]))
+		binary.Write(&buf, le, uint32(1))
+		if e[1] == 3 {
+			binary.Write(&buf, le, uint16(e[2]))
+			binary.Write(&buf, le, uint16(0))
+		} else {
+			binary.Write(&buf, le, e[2])
+		}
+	}
+	binary.Write(&buf, le, uint32(0))
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		panic(err)
+	}
+}
+
+func readJSON(t *testing.T, path string, v interface{}) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s - %v", path, err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("failed to parse %s - %v", path, err)
+	}
+}
+
+func assertJPEG(t *testing.T, path string, w, h int) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Errorf("missing %s", path)
+		return
+	}
+	defer f.Close()
+	cfg, err := jpeg.DecodeConfig(f)
+	if assert.Nil(t, err, "decode %s", path) {
+		assert.Equal(t, [2]int{w, h}, [2]int{cfg.Width, cfg.Height}, "size of %s", path)
+	}
+}
+
+func assertMissing(t *testing.T, path string) {
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "%s should not exist", path)
+}
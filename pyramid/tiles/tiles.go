@@ -0,0 +1,271 @@
+// Package tiles writes the levels of a pyramid as trees of image files
+// that a plain web server can serve: IIIF level-0 static tiles, Deep Zoom
+// and Zoomify images.
+//
+// The levels are the intermediate TIFF files made by the agent, ordered
+// from the full-resolution image down, each half the size of the one
+// above. They must have 8 bits per sample and be gray or RGB.
+package tiles
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gigamorph/go-pyramid/pyramid/ptiff"
+)
+
+// level is a level image opened for reading.
+type level struct {
+	f      *ptiff.File
+	im     *ptiff.Image
+	Width  int
+	Height int
+}
+
+func openLevel(file string) (*level, error) {
+	f, err := ptiff.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	im, err := f.Image(0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ok := im.BitsPerSample == 8 && im.SampleFormat == ptiff.SampleFormatUint &&
+		(im.SamplesPerPixel == 1 && im.Photometric == ptiff.PhotometricMinIsBlack ||
+			im.SamplesPerPixel == 3 && im.Photometric == ptiff.PhotometricRGB)
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("%s is not 8-bit gray or RGB (%d samples of %d bits, photometric %d)",
+			file, im.SamplesPerPixel, im.BitsPerSample, im.Photometric)
+	}
+	return &level{f: f, im: im, Width: im.Width, Height: im.Height}, nil
+}
+
+func (l *level) Close() error {
+	return l.f.Close()
+}
+
+// halvings reads the image of a pyramid halved k times, for k = 0, 1, ...
+// rounding up: the k-th image is read from the k-th level file, with the
+// edge pixels repeated where it is a pixel smaller, and the images after
+// the last level file are made from it in memory by averaging blocks of
+// 2x2 pixels.
+type halvings struct {
+	files  []string
+	Width  int // size of the full-resolution image
+	Height int
+	K      int    // halvings of the current image
+	l      *level // file of the current image, nil once files are used up
+	last   *band  // the current image once files are used up
+}
+
+func openHalvings(files []string) (*halvings, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no levels")
+	}
+	l, err := openLevel(files[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to open level 0 - %v", err)
+	}
+	return &halvings{files: files, Width: l.Width, Height: l.Height, l: l}, nil
+}
+
+// Size returns the size of the current image.
+func (h *halvings) Size() (int, int) {
+	return ceilDiv(h.Width, 1<<uint(h.K)), ceilDiv(h.Height, 1<<uint(h.K))
+}
+
+// readBand reads the rows y0 to y1-1 of the current image, or as many of
+// them as the level file has.
+func (h *halvings) readBand(y0, y1 int) (*band, error) {
+	if h.l != nil {
+		return h.l.readBand(y0, y1)
+	}
+	return h.last, nil
+}
+
+// Next moves on to the image halved once more.
+func (h *halvings) Next() error {
+	k := h.K + 1
+	if h.l != nil && k < len(h.files) {
+		h.l.Close()
+		l, err := openLevel(h.files[k])
+		h.l = l
+		if err != nil {
+			return fmt.Errorf("failed to open level %d - %v", k, err)
+		}
+		if l.Width != h.Width>>uint(k) || l.Height != h.Height>>uint(k) {
+			return fmt.Errorf("level %d is %dx%d, expected %dx%d",
+				k, l.Width, l.Height, h.Width>>uint(k), h.Height>>uint(k))
+		}
+		h.K = k
+		return nil
+	}
+	if h.l != nil {
+		last, err := h.l.readBand(0, h.l.Height)
+		h.l.Close()
+		h.l = nil
+		if err != nil {
+			return fmt.Errorf("failed to read level %d - %v", h.K, err)
+		}
+		h.last = last
+	}
+	h.K = k
+	h.last = h.last.halve(h.Size())
+	return nil
+}
+
+func (h *halvings) Close() error {
+	if h.l != nil {
+		return h.l.Close()
+	}
+	return nil
+}
+
+// band holds the rows y0 to y0+n-1 of a level.
+type band struct {
+	pix   []byte
+	y0, n int
+	width int
+	spp   int
+}
+
+// readBand reads the rows y0 to y1-1 of the level, or as many of them as
+// the level has.
+func (l *level) readBand(y0, y1 int) (*band, error) {
+	if y0 < 0 {
+		y0 = 0
+	}
+	if y1 > l.Height {
+		y1 = l.Height
+	}
+	if y0 >= y1 {
+		y0 = y1 - 1
+	}
+	b := &band{y0: y0, n: y1 - y0, width: l.Width, spp: l.im.SamplesPerPixel}
+	b.pix = make([]byte, b.n*l.im.RowBytes())
+	if err := l.im.ReadRows(y0, b.n, b.pix); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// crop returns the w x h image whose top left corner is at x, y in the
+// coordinates of the level. Pixels outside the band repeat the nearest
+// pixel of the band, so that a tile may be a pixel larger than what is
+// left of the level when its size is rounded up.
+func (b *band) crop(x, y, w, h int) image.Image {
+	clamp := func(v, max int) int {
+		if v < 0 {
+			return 0
+		}
+		if v >= max {
+			return max - 1
+		}
+		return v
+	}
+	rowBytes := b.width * b.spp
+
+	if b.spp == 1 {
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for j := 0; j < h; j++ {
+			src := b.pix[clamp(y+j-b.y0, b.n)*rowBytes:]
+			dst := img.Pix[j*img.Stride:]
+			for i := 0; i < w; i++ {
+				dst[i] = src[clamp(x+i, b.width)]
+			}
+		}
+		return img
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for j := 0; j < h; j++ {
+		src := b.pix[clamp(y+j-b.y0, b.n)*rowBytes:]
+		dst := img.Pix[j*img.Stride:]
+		for i := 0; i < w; i++ {
+			s := src[clamp(x+i, b.width)*3:]
+			dst[i*4], dst[i*4+1], dst[i*4+2], dst[i*4+3] = s[0], s[1], s[2], 0xff
+		}
+	}
+	return img
+}
+
+// halve returns the w x h image made by averaging blocks of 2x2 pixels of
+// the band, which must hold the whole level. Pixels outside the band
+// repeat the nearest pixel of the band, as in crop.
+func (b *band) halve(w, h int) *band {
+	clamp := func(v, max int) int {
+		if v >= max {
+			return max - 1
+		}
+		return v
+	}
+	rowBytes := b.width * b.spp
+	out := &band{pix: make([]byte, w*h*b.spp), n: h, width: w, spp: b.spp}
+	for y := 0; y < h; y++ {
+		r0 := b.pix[clamp(2*y, b.n)*rowBytes:]
+		r1 := b.pix[clamp(2*y+1, b.n)*rowBytes:]
+		dst := out.pix[y*w*b.spp:]
+		for x := 0; x < w; x++ {
+			x0, x1 := clamp(2*x, b.width)*b.spp, clamp(2*x+1, b.width)*b.spp
+			for i := 0; i < b.spp; i++ {
+				sum := int(r0[x0+i]) + int(r0[x1+i]) + int(r1[x0+i]) + int(r1[x1+i])
+				dst[x*b.spp+i] = byte((sum + 2) / 4)
+			}
+		}
+	}
+	return out
+}
+
+// prepareDir creates dir, which must not exist or be empty so that no
+// file of another image is left in the tree.
+func prepareDir(dir string) error {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(dir, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Readdirnames(1); err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s exists and is not empty", dir)
+}
+
+// writeImage writes img to path as "jpg" or "png", creating the
+// directories leading to it.
+func writeImage(path string, img image.Image, format string, quality int) (err error) {
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	if format == "png" {
+		return png.Encode(f, img)
+	}
+	return jpeg.Encode(f, img, &jpeg.Options{Quality: quality})
+}
+
+// ceilDiv returns a/b rounded up.
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,146 @@
+package tiles
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ZoomifyOptions controls the tiles written by WriteZoomify.
+type ZoomifyOptions struct {
+	TileSize int // width and height of the tiles (default 256)
+	Quality  int // JPEG quality (1-100, default 90)
+}
+
+func (o ZoomifyOptions) withDefaults() ZoomifyOptions {
+	if o.TileSize == 0 {
+		o.TileSize = 256
+	}
+	if o.Quality == 0 {
+		o.Quality = 90
+	}
+	return o
+}
+
+func (o ZoomifyOptions) validate() error {
+	if o.TileSize <= 0 {
+		return fmt.Errorf("invalid tile size %d", o.TileSize)
+	}
+	if o.Quality < 1 || o.Quality > 100 {
+		return fmt.Errorf("invalid JPEG quality %d", o.Quality)
+	}
+	return nil
+}
+
+// zoomifyGroupSize is the number of tiles in a TileGroup folder.
+const zoomifyGroupSize = 256
+
+const zoomifyProperties = `<IMAGE_PROPERTIES WIDTH="%d" HEIGHT="%d" NUMTILES="%d" NUMIMAGES="1" VERSION="1.8" TILESIZE="%d" />
+`
+
+// WriteZoomify writes levels to dir as a Zoomify image: dir/ImageProperties.xml
+// and the tiles in dir/TileGroup<g>/<tier>-<col>-<row>.jpg.
+//
+// Tier 0 is the smallest image, which fits in a single tile, and the last
+// tier the full-resolution image; each tier is half the size of the one
+// above, read from levels as described in halvings. Tiles are numbered
+// from tier 0 up, row by row within a tier, and tile i goes to TileGroup
+// i/256.
+//
+// dir must not exist or be empty; it is removed if WriteZoomify fails.
+// WriteZoomify returns the number of tiles written.
+func WriteZoomify(ctx context.Context, levels []string, dir string, opts ZoomifyOptions) (n int, err error) {
+	opts = opts.withDefaults()
+	if err = opts.validate(); err != nil {
+		return 0, fmt.Errorf("tiles.WriteZoomify invalid options - %v", err)
+	}
+	if len(levels) == 0 {
+		return 0, fmt.Errorf("tiles.WriteZoomify no levels")
+	}
+	if err = prepareDir(dir); err != nil {
+		return 0, fmt.Errorf("tiles.WriteZoomify failed to create %s - %v", dir, err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	h, err := openHalvings(levels)
+	if err != nil {
+		return 0, fmt.Errorf("tiles.WriteZoomify - %v", err)
+	}
+	defer h.Close()
+
+	tiers := zoomifyTiers(h.Width, h.Height, opts.TileSize)
+	first := make([]int, len(tiers)) // number of the first tile of every tier
+	total := 0
+	for z, t := range tiers {
+		first[z] = total
+		total += t[0] * t[1]
+	}
+
+	// The full-resolution image, read first, is the last tier.
+	for z := len(tiers) - 1; z >= 0; z-- {
+		if err = ctx.Err(); err != nil {
+			return n, err
+		}
+		written, err := writeZoomifyTier(ctx, h, z, tiers[z], first[z], dir, opts)
+		n += written
+		if err != nil {
+			return n, fmt.Errorf("tiles.WriteZoomify failed to write tier %d - %w", z, err)
+		}
+		if z > 0 {
+			if err = h.Next(); err != nil {
+				return n, fmt.Errorf("tiles.WriteZoomify - %v", err)
+			}
+		}
+	}
+
+	properties := fmt.Sprintf(zoomifyProperties, h.Width, h.Height, total, opts.TileSize)
+	if err = ioutil.WriteFile(filepath.Join(dir, "ImageProperties.xml"), []byte(properties), 0644); err != nil {
+		return n, fmt.Errorf("tiles.WriteZoomify failed to write ImageProperties.xml - %v", err)
+	}
+	return n, nil
+}
+
+// zoomifyTiers returns the number of tiles across and down of every tier
+// of the image of width x height, from tier 0, a single tile, up to the
+// full-resolution image.
+func zoomifyTiers(width, height, tileSize int) [][2]int {
+	var tiers [][2]int
+	for ts := tileSize; width > ts || height > ts; ts *= 2 {
+		tiers = append([][2]int{{ceilDiv(width, ts), ceilDiv(height, ts)}}, tiers...)
+	}
+	return append([][2]int{{1, 1}}, tiers...)
+}
+
+// writeZoomifyTier writes the tiles of tier z, the current image of h,
+// whose first tile is number first.
+func writeZoomifyTier(ctx context.Context, h *halvings, z int, tiles [2]int, first int, dir string, opts ZoomifyOptions) (n int, err error) {
+	ts := opts.TileSize
+	w, ht := h.Size()
+	for row := 0; row < tiles[1]; row++ {
+		if err = ctx.Err(); err != nil {
+			return n, err
+		}
+		y0 := row * ts
+		th := min(ts, ht-y0)
+		b, err := h.readBand(y0, y0+th)
+		if err != nil {
+			return n, err
+		}
+		for col := 0; col < tiles[0]; col++ {
+			x0 := col * ts
+			group := (first + row*tiles[0] + col) / zoomifyGroupSize
+			path := filepath.Join(dir, fmt.Sprintf("TileGroup%d", group), fmt.Sprintf("%d-%d-%d.jpg", z, col, row))
+			if err = writeImage(path, b.crop(x0, y0, min(ts, w-x0), th), "jpg", opts.Quality); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,69 @@
+package tiles
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteZoomify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiles-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("Tiers", func(t *testing.T) {
+		levels := writeLevels(filepath.Join(dir, "levels"), 513, 300, 3, 3)
+		out := filepath.Join(dir, "out")
+		n, err := WriteZoomify(context.Background(), levels, out, ZoomifyOptions{})
+		assert.Nil(t, err, "WriteZoomify")
+		assert.Equal(t, 1+2+6, n, "number of tiles")
+
+		b, err := ioutil.ReadFile(filepath.Join(out, "ImageProperties.xml"))
+		assert.Nil(t, err, "read ImageProperties.xml")
+		assert.Equal(t, `<IMAGE_PROPERTIES WIDTH="513" HEIGHT="300" NUMTILES="9" NUMIMAGES="1" VERSION="1.8" TILESIZE="256" />`+"\n", string(b))
+
+		tiles := map[string][2]int{
+			"0-0-0.jpg": {129, 75}, // tier 0, a single tile
+			"1-0-0.jpg": {256, 150},
+			"1-1-0.jpg": {1, 150},
+			"2-0-0.jpg": {256, 256}, // full resolution
+			"2-2-0.jpg": {1, 256},
+			"2-2-1.jpg": {1, 44},
+		}
+		for p, size := range tiles {
+			assertJPEG(t, filepath.Join(out, "TileGroup0", p), size[0], size[1])
+		}
+		assertMissing(t, filepath.Join(out, "TileGroup1"))
+	})
+
+	t.Run("TileGroups", func(t *testing.T) {
+		levels := writeLevels(filepath.Join(dir, "square"), 600, 600, 1, 2)
+		out := filepath.Join(dir, "groups")
+		n, err := WriteZoomify(context.Background(), levels, out, ZoomifyOptions{TileSize: 16})
+		assert.Nil(t, err, "WriteZoomify")
+		// tiers of 1, 2x2, 3x3, 5x5, 10x10, 19x19 and 38x38 tiles
+		assert.Equal(t, 1944, n, "number of tiles")
+
+		assertJPEG(t, filepath.Join(out, "TileGroup0", "0-0-0.jpg"), 10, 10)
+		assertJPEG(t, filepath.Join(out, "TileGroup0", "5-0-0.jpg"), 16, 16) // tile 139
+		assertJPEG(t, filepath.Join(out, "TileGroup0", "5-2-6.jpg"), 16, 16) // tile 139 + 6*19 + 2 = 255
+		assertJPEG(t, filepath.Join(out, "TileGroup1", "5-3-6.jpg"), 16, 16) // tile 256
+		assertJPEG(t, filepath.Join(out, "TileGroup1", "6-0-0.jpg"), 16, 16) // tile 500
+		assertJPEG(t, filepath.Join(out, "TileGroup7", "6-37-37.jpg"), 8, 8) // tile 1943
+		assertMissing(t, filepath.Join(out, "TileGroup8"))
+	})
+
+	t.Run("NotEmpty", func(t *testing.T) {
+		out := filepath.Join(dir, "notempty")
+		os.MkdirAll(out, 0755)
+		ioutil.WriteFile(filepath.Join(out, "ImageProperties.xml"), nil, 0644)
+		_, err := WriteZoomify(context.Background(), []string{"none.tif"}, out, ZoomifyOptions{})
+		assert.NotNil(t, err, "WriteZoomify")
+	})
+}
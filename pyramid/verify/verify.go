@@ -0,0 +1,217 @@
+// Package verify checks that a pyramidal TIFF is laid out the way image
+// servers and viewers expect, so that broken pyramids are caught before
+// they are published.
+package verify
+
+import (
+	"fmt"
+
+	"github.com/gigamorph/go-pyramid/pyramid/compression"
+	"github.com/gigamorph/go-pyramid/pyramid/output"
+	"github.com/gigamorph/go-pyramid/pyramid/ptiff"
+)
+
+// Checks, as reported in Violation.Check.
+const (
+	CheckTiled       = "tiled"       // every IFD is tiled with the expected tile size
+	CheckOrder       = "order"       // every level is about half the size of the one above
+	CheckReduced     = "reduced"     // levels after the first are marked as reduced-resolution images
+	CheckCompression = "compression" // the tiles are compressed as requested
+	CheckICCProfile  = "iccProfile"  // every level has an embedded ICC profile
+	CheckSize        = "size"        // the top level has the expected size
+)
+
+// Expected is what the pyramid should be like. Zero fields are not checked.
+type Expected struct {
+	TileWidth   int
+	TileHeight  int
+	Compression compression.Option // only the codec and the predictor are checked
+	Width       int                // size of the top level
+	Height      int
+}
+
+// ExpectedFromOutput returns what the pyramid described by p should be like.
+func ExpectedFromOutput(p *output.Params) Expected {
+	return Expected{
+		TileWidth:   int(p.TileWidth),
+		TileHeight:  int(p.TileHeight),
+		Compression: p.Compression,
+		Width:       int(p.OutputWidth),
+		Height:      int(p.OutputHeight),
+	}
+}
+
+// Level describes one IFD of the pyramid.
+type Level struct {
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	TileWidth   int    `json:"tileWidth"`  // 0 if not tiled
+	TileHeight  int    `json:"tileHeight"` // 0 if not tiled
+	Compression uint16 `json:"compression"`
+	Predictor   uint16 `json:"predictor"`
+	Reduced     bool   `json:"reduced"`
+	ICCProfile  bool   `json:"iccProfile"`
+}
+
+// Violation is a failed check.
+type Violation struct {
+	Check   string `json:"check"`
+	Level   int    `json:"level"` // index of the IFD, -1 for the whole file
+	Message string `json:"message"`
+}
+
+// Report is the result of Verify.
+type Report struct {
+	File       string      `json:"file"`
+	BigTIFF    bool        `json:"bigTIFF"`
+	Levels     []Level     `json:"levels"`
+	Violations []Violation `json:"violations"`
+	Error      string      `json:"error,omitempty"` // why File could not be read, see ErrorReport
+}
+
+// ErrorReport returns the report of a file that could not be read, err
+// being the error of Verify.
+func ErrorReport(path string, err error) *Report {
+	return &Report{File: path, Levels: []Level{}, Violations: []Violation{}, Error: err.Error()}
+}
+
+// OK tells whether the file was read and all checks passed.
+func (r *Report) OK() bool {
+	return r.Error == "" && len(r.Violations) == 0
+}
+
+// Since returns the violations of r that before does not have, such as
+// those caused by rewriting a pyramid that was checked as before.
+func (r *Report) Since(before *Report) []Violation {
+	type key struct {
+		check string
+		level int
+	}
+	known := map[key]bool{}
+	for _, v := range before.Violations {
+		known[key{v.Check, v.Level}] = true
+	}
+	var violations []Violation
+	for _, v := range r.Violations {
+		if !known[key{v.Check, v.Level}] {
+			violations = append(violations, v)
+		}
+	}
+	return violations
+}
+
+func (r *Report) add(check string, level int, format string, args ...interface{}) {
+	r.Violations = append(r.Violations, Violation{Check: check, Level: level, Message: fmt.Sprintf(format, args...)})
+}
+
+// Verify opens the TIFF file at path and checks it against want. It
+// returns an error only if the file cannot be read as a TIFF; failed
+// checks are listed in the report.
+func Verify(path string, want Expected) (*Report, error) {
+	f, err := ptiff.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("verify.Verify failed to open %s - %v", path, err)
+	}
+	defer f.Close()
+
+	r := &Report{File: path, BigTIFF: f.BigTIFF, Levels: []Level{}, Violations: []Violation{}}
+	for _, d := range f.IFDs {
+		subfileType := d.UintOr(ptiff.TagNewSubfileType, 0)
+		l := Level{
+			Width:       int(d.UintOr(ptiff.TagImageWidth, 0)),
+			Height:      int(d.UintOr(ptiff.TagImageLength, 0)),
+			Compression: uint16(d.UintOr(ptiff.TagCompression, uint64(ptiff.CompressionNone))),
+			Predictor:   uint16(d.UintOr(ptiff.TagPredictor, uint64(ptiff.PredictorNone))),
+			Reduced:     subfileType&uint64(ptiff.SubfileReducedImage) != 0,
+			ICCProfile:  d.Has(ptiff.TagICCProfile),
+		}
+		if d.Has(ptiff.TagTileOffsets) {
+			l.TileWidth = int(d.UintOr(ptiff.TagTileWidth, 0))
+			l.TileHeight = int(d.UintOr(ptiff.TagTileLength, 0))
+		}
+		r.Levels = append(r.Levels, l)
+	}
+
+	if len(r.Levels) == 0 {
+		r.add(CheckOrder, -1, "no image")
+		return r, nil
+	}
+	top := r.Levels[0]
+	if want.Width != 0 && want.Height != 0 && (top.Width != want.Width || top.Height != want.Height) {
+		r.add(CheckSize, 0, "top level is %dx%d, expected %dx%d", top.Width, top.Height, want.Width, want.Height)
+	}
+
+	codec, predictor := tiffCompression(want.Compression)
+	for i, l := range r.Levels {
+		switch {
+		case l.TileWidth == 0:
+			r.add(CheckTiled, i, "level is not tiled")
+		case want.TileWidth != 0 && want.TileHeight != 0 && (l.TileWidth != want.TileWidth || l.TileHeight != want.TileHeight):
+			r.add(CheckTiled, i, "tiles are %dx%d, expected %dx%d", l.TileWidth, l.TileHeight, want.TileWidth, want.TileHeight)
+		}
+		if i > 0 {
+			above := r.Levels[i-1]
+			if !halfOf(l.Width, above.Width) || !halfOf(l.Height, above.Height) {
+				r.add(CheckOrder, i, "level is %dx%d, expected about half of %dx%d", l.Width, l.Height, above.Width, above.Height)
+			}
+		}
+		if l.Reduced != (i > 0) {
+			if i == 0 {
+				r.add(CheckReduced, i, "top level is marked as a reduced-resolution image")
+			} else {
+				r.add(CheckReduced, i, "level is not marked as a reduced-resolution image")
+			}
+		}
+		if codec != 0 && !sameCompression(l.Compression, codec) {
+			r.add(CheckCompression, i, "compression is %d, expected %d (%s)", l.Compression, codec, want.Compression.Codec)
+		}
+		if predictor != 0 && l.Predictor != predictor {
+			r.add(CheckCompression, i, "predictor is %d, expected %d", l.Predictor, predictor)
+		}
+		if !l.ICCProfile {
+			r.add(CheckICCProfile, i, "no embedded ICC profile")
+		}
+	}
+	return r, nil
+}
+
+// halfOf tells whether size is half of above, rounded either way.
+func halfOf(size, above int) bool {
+	return size == above/2 || size == (above+1)/2
+}
+
+// tiffCompression returns the values of the Compression and Predictor tags
+// for o, 0 if o does not say.
+func tiffCompression(o compression.Option) (codec, predictor uint16) {
+	switch o.Codec {
+	case compression.None:
+		codec = ptiff.CompressionNone
+	case compression.JPEG:
+		codec = ptiff.CompressionJPEG
+	case compression.Deflate:
+		codec = ptiff.CompressionDeflate
+	case compression.LZW:
+		codec = ptiff.CompressionLZW
+	case compression.ZSTD:
+		codec = ptiff.CompressionZSTD
+	case compression.WebP:
+		codec = ptiff.CompressionWebP
+	}
+	switch o.Codec {
+	case compression.Deflate, compression.LZW, compression.ZSTD:
+		predictor = ptiff.PredictorNone
+		if o.Predictor == compression.PredictorHorizontal {
+			predictor = ptiff.PredictorHorizontal
+		}
+	}
+	return codec, predictor
+}
+
+// sameCompression tells whether the Compression tag value got is codec,
+// taking the old Deflate code as Deflate.
+func sameCompression(got, codec uint16) bool {
+	if got == ptiff.CompressionDeflateOld {
+		got = ptiff.CompressionDeflate
+	}
+	return got == codec
+}
@@ -0,0 +1,177 @@
+package verify
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gigamorph/go-pyramid/pyramid/compression"
+	"github.com/gigamorph/go-pyramid/pyramid/ptiff"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	icc, err := ioutil.ReadFile("../../test/resources/sRGBProfile.icc")
+	if err != nil {
+		panic(err)
+	}
+
+	var levels, noICC []string
+	for i, s := range [][2]int{{601, 400}, {300, 200}, {150, 100}} {
+		levels = append(levels, filepath.Join(dir, fmt.Sprintf("level_%d.tif", i)))
+		writeLevel(levels[i], s[0], s[1], icc)
+		noICC = append(noICC, filepath.Join(dir, fmt.Sprintf("noicc_%d.tif", i)))
+		writeLevel(noICC[i], s[0], s[1], nil)
+	}
+	build := func(name string, inFiles []string, opts ptiff.Options) string {
+		outFile := filepath.Join(dir, name)
+		if err := ptiff.BuildPyramid(inFiles, outFile, opts); err != nil {
+			panic(err)
+		}
+		return outFile
+	}
+	good := build("good.tif", levels, ptiff.Options{Compression: ptiff.CompressionDeflate, Predictor: ptiff.PredictorHorizontal})
+	want := Expected{
+		TileWidth:   256,
+		TileHeight:  256,
+		Compression: compression.Option{Codec: compression.Deflate, Predictor: compression.PredictorHorizontal},
+		Width:       601,
+		Height:      400,
+	}
+
+	checks := func(r *Report) []string {
+		var checks []string
+		for _, v := range r.Violations {
+			checks = append(checks, fmt.Sprintf("%s:%d", v.Check, v.Level))
+		}
+		return checks
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		r, err := Verify(good, want)
+		assert.Nil(t, err, "Verify")
+		assert.True(t, r.OK(), "no violations, got %v", r.Violations)
+		if assert.Equal(t, 3, len(r.Levels), "levels") {
+			assert.Equal(t, Level{
+				Width: 300, Height: 200, TileWidth: 256, TileHeight: 256,
+				Compression: ptiff.CompressionDeflate, Predictor: ptiff.PredictorHorizontal,
+				Reduced: true, ICCProfile: true,
+			}, r.Levels[1], "level 1")
+		}
+	})
+
+	t.Run("Expectations", func(t *testing.T) {
+		w := want
+		w.TileWidth, w.TileHeight = 512, 512
+		w.Compression = compression.Option{Codec: compression.JPEG, Quality: 90}
+		w.Width = 600
+		r, err := Verify(good, w)
+		assert.Nil(t, err, "Verify")
+		assert.Equal(t, []string{
+			"size:0",
+			"tiled:0", "compression:0",
+			"tiled:1", "compression:1",
+			"tiled:2", "compression:2",
+		}, checks(r))
+	})
+
+	t.Run("Predictor", func(t *testing.T) {
+		w := want
+		w.Compression.Predictor = ""
+		r, err := Verify(good, w)
+		assert.Nil(t, err, "Verify")
+		assert.Equal(t, []string{"compression:0", "compression:1", "compression:2"}, checks(r))
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		out := build("order.tif", []string{levels[0], levels[2], levels[1]}, ptiff.Options{})
+		r, err := Verify(out, Expected{})
+		assert.Nil(t, err, "Verify")
+		assert.Equal(t, []string{"order:1", "order:2"}, checks(r))
+	})
+
+	t.Run("NoICCProfile", func(t *testing.T) {
+		out := build("noicc.tif", noICC, ptiff.Options{})
+		r, err := Verify(out, Expected{})
+		assert.Nil(t, err, "Verify")
+		assert.Equal(t, []string{"iccProfile:0", "iccProfile:1", "iccProfile:2"}, checks(r))
+	})
+
+	t.Run("NotTiled", func(t *testing.T) {
+		r, err := Verify(levels[0], Expected{})
+		assert.Nil(t, err, "Verify")
+		assert.Equal(t, []string{"tiled:0"}, checks(r))
+	})
+
+	t.Run("Since", func(t *testing.T) {
+		before, err := Verify(build("since.tif", noICC, ptiff.Options{}), Expected{})
+		assert.Nil(t, err, "Verify")
+		after, err := Verify(levels[0], Expected{})
+		assert.Nil(t, err, "Verify")
+		assert.Equal(t, []string{"tiled:0"}, checks(&Report{Violations: after.Since(before)}), "ICC profile was missing before")
+	})
+
+	t.Run("NotTIFF", func(t *testing.T) {
+		_, err := Verify("../../test/resources/sRGBProfile.icc", want)
+		assert.NotNil(t, err, "Verify")
+
+		r := ErrorReport("../../test/resources/sRGBProfile.icc", err)
+		assert.False(t, r.OK(), "OK")
+		assert.Equal(t, err.Error(), r.Error, "error")
+		assert.Empty(t, r.Violations, "violations")
+	})
+}
+
+// writeLevel writes an uncompressed 8-bit gray TIFF of w x h pixels in one
+// strip, with the ICC profile icc if not nil.
+func writeLevel(path string, w, h int, icc []byte) {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.WriteString("II")
+	binary.Write(&buf, le, uint16(42))
+	binary.Write(&buf, le, uint32(8+w*h+len(icc)))
+	buf.Write(make([]byte, w*h))
+	buf.Write(icc)
+
+	entries := [][4]uint32{ // tag, type (3 SHORT, 4 LONG, 7 UNDEFINED), count, value
+		{uint32(ptiff.TagImageWidth), 4, 1, uint32(w)},
+		{uint32(ptiff.TagImageLength), 4, 1, uint32(h)},
+		{uint32(ptiff.TagBitsPerSample), 3, 1, 8},
+		{uint32(ptiff.TagCompression), 3, 1, uint32(ptiff.CompressionNone)},
+		{uint32(ptiff.TagPhotometricInterpretation), 3, 1, uint32(ptiff.PhotometricMinIsBlack)},
+		{uint32(ptiff.TagStripOffsets), 4, 1, 8},
+		{uint32(ptiff.TagSamplesPerPixel), 3, 1, 1},
+		{uint32(ptiff.TagRowsPerStrip), 4, 1, uint32(h)},
+		{uint32(ptiff.TagStripByteCounts), 4, 1, uint32(w * h)},
+	}
+	if icc != nil {
+		entries = append(entries, [4]uint32{uint32(ptiff.TagICCProfile), 7, uint32(len(icc)), uint32(8 + w*h)})
+	}
+	binary.Write(&buf, le, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(&buf, le, uint16(e[0]))
+		binary.Write(&buf, le, uint16(e[1]))
+		binary.Write(&buf, le, e[2])
+		if e[1] == 3 {
+			binary.Write(&buf, le, uint16(e[3]))
+			binary.Write(&buf, le, uint16(0))
+		} else {
+			binary.Write(&buf, le, e[3])
+		}
+	}
+	binary.Write(&buf, le, uint32(0))
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		panic(err)
+	}
+}
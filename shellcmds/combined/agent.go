@@ -1,25 +1,19 @@
 package combined
 
 import (
-	"log"
+	"context"
 
 	"github.com/gigamorph/go-pyramid/config"
-	"github.com/gigamorph/go-pyramid/shellcmds/vips"
 	"github.com/gigamorph/go-pyramid/util"
 )
 
 func GrayToSRGB(inFile, outFile string) error {
-	var w, h uint
-	var err error
-
-	if w, err = vips.Width(inFile); err != nil {
-		return err
-	}
-	if h, err = vips.Height(inFile); err != nil {
-		return err
-	}
-	log.Printf("width: %d, height: %d", w, h)
+	return GrayToSRGBContext(context.Background(), inFile, outFile)
+}
 
+// GrayToSRGBContext is like GrayToSRGB but stops the programs it runs
+// when ctx is done.
+func GrayToSRGBContext(ctx context.Context, inFile, outFile string) error {
 	args := []string{
 		"-colorspace",
 		"srgb",
@@ -28,6 +22,6 @@ func GrayToSRGB(inFile, outFile string) error {
 		inFile,
 		outFile,
 	}
-	_, err = util.Exec(config.Convert, args)
+	_, err := util.ExecContext(ctx, config.Convert, args)
 	return err
 }
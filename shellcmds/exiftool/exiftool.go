@@ -1,71 +1,131 @@
 package exiftool
 
 import (
+	"context"
 	"fmt"
-	"regexp"
 	"strings"
 
 	"github.com/gigamorph/go-pyramid/config"
 	"github.com/gigamorph/go-pyramid/util"
 )
 
-// GetTag extracts a tag value from the image file
+// GetTag extracts a tag value from the image file. The value is
+// print-converted, e.g. "Horizontal (normal)" for an orientation of 1.
+// Wildcard names such as "XMP-dc:all" are an error, as they stand for
+// several tags.
 func GetTag(filePath, tagName string) (string, error) {
-	var out string
+	return GetTagContext(context.Background(), filePath, tagName)
+}
 
-	args := []string{
-		"-TAG", fmt.Sprintf("-%s", tagName),
-		filePath,
+// GetTagContext is like GetTag but stops exiftool when ctx is done.
+func GetTagContext(ctx context.Context, filePath, tagName string) (string, error) {
+	if isWildcard(tagName) {
+		return "", fmt.Errorf("exiftool.GetTag cannot get wildcard tag %s", tagName)
 	}
+	tags, err := readTags(ctx, filePath, []string{"-j", "-G1"}, tagName)
+	if err != nil {
+		return "", fmt.Errorf("exiftool.GetTag failed - %w", err)
+	}
+	v, _ := tags.Lookup(tagName)
+	return strings.TrimSpace(v.Text), nil
+}
 
-	out, err := util.Exec(config.ExifTool, args)
+// ReadTags reads tags, exiftool tag names such as "Artist", "IPTC:Credit"
+// or "XMP-dc:all", from the image file with one run of exiftool, or every
+// tag if none is given. Unlike GetTag, values are not print-converted,
+// e.g. orientation is 1 rather than "Horizontal (normal)". Tags the file
+// does not have are left out.
+func ReadTags(filePath string, tags ...string) (Tags, error) {
+	return ReadTagsContext(context.Background(), filePath, tags...)
+}
+
+// ReadTagsContext is like ReadTags but stops exiftool when ctx is done.
+func ReadTagsContext(ctx context.Context, filePath string, tags ...string) (Tags, error) {
+	t, err := readTags(ctx, filePath, []string{"-j", "-G1", "-n"}, tags...)
 	if err != nil {
-		return "", fmt.Errorf("exiftool.GetTag failed - %v", err)
+		return nil, fmt.Errorf("exiftool.ReadTags failed - %w", err)
 	}
+	return t, nil
+}
 
-	r := regexp.MustCompile(`^[^:]+: (.*)$`)
-	m := r.FindStringSubmatch(out)
-	if len(m) < 1 {
-		return "", nil
+// readTags runs exiftool with the JSON output options opts.
+func readTags(ctx context.Context, filePath string, opts []string, tags ...string) (Tags, error) {
+	args := append([]string{}, opts...)
+	for _, tag := range tags {
+		args = append(args, "-"+tag)
 	}
-	return strings.TrimSpace(m[1]), nil
+	args = append(args, filePath)
+
+	out, err := util.ExecContext(ctx, config.ExifTool, args)
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseTags([]byte(out))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the output for %s - %v", filePath, err)
+	}
+	return t, nil
 }
 
 // AddTags invokes exiftool with the specified options to apply tags to the image file
 func AddTags(filePath string, options TagsInput) (string, error) {
+	return AddTagsContext(context.Background(), filePath, options)
+}
+
+// AddTagsContext is like AddTags but stops exiftool when ctx is done.
+func AddTagsContext(ctx context.Context, filePath string, options TagsInput) (string, error) {
 	var out string
-	args := make([]string, 0, 8)
+	args := tagArgs(options)
+	args = append(args, filePath)
 
-	if options.CopyrightNotice != "" {
-		args = append(args, fmt.Sprintf("-MWG:copyright=%s", options.CopyrightNotice))
-	}
-	if options.ImageCredit != "" {
-		args = append(args, fmt.Sprintf("-XMP-photoshop:Credit=%s", options.ImageCredit))
-		args = append(args, fmt.Sprintf("-credit=%s", options.ImageCredit))
-	}
-	if options.WebRightsStatement != "" {
-		args = append(args, fmt.Sprintf("-xmp:webstatement=%s", options.WebRightsStatement))
-		args = append(args, fmt.Sprintf("-photoshop:URL=%s", options.WebRightsStatement))
-	}
-	if options.UsageTerms != "" {
-		args = append(args, fmt.Sprintf("-usageterms=%s", options.UsageTerms))
-	}
-	if options.Caption != "" {
-		args = append(args, fmt.Sprintf("-MWG:description=%s", options.Caption))
+	out, err := util.ExecContext(ctx, config.ExifTool, args)
+	if err != nil {
+		return "", fmt.Errorf("exiftool.Run failed - %w", err)
 	}
-	if options.CopyrightStatus != "" {
-		args = append(args, fmt.Sprintf("-XMP-xmpRights:marked=%s", options.CopyrightStatus))
+	return out, nil
+}
+
+// WriteTags is like AddTags but rewrites the image file in place, without
+// keeping a copy of the original.
+func WriteTags(filePath string, options TagsInput) error {
+	return WriteTagsContext(context.Background(), filePath, options)
+}
+
+// WriteTagsContext is like WriteTags but stops exiftool when ctx is done.
+func WriteTagsContext(ctx context.Context, filePath string, options TagsInput) error {
+	args := append([]string{"-overwrite_original"}, tagArgs(options)...)
+	args = append(args, filePath)
+
+	if _, err := util.ExecContext(ctx, config.ExifTool, args); err != nil {
+		return fmt.Errorf("exiftool.WriteTags failed - %w", err)
 	}
-	if options.Source != "" {
-		args = append(args, fmt.Sprintf("-XMP-photoshop:Source=%s", options.Source))
-		args = append(args, fmt.Sprintf("-iptc:source=%s", options.Source))
+	return nil
+}
+
+func tagArgs(options TagsInput) []string {
+	args := make([]string, 0, 10)
+	for _, a := range options.Assignments() {
+		args = append(args, fmt.Sprintf("-%s=%s", a.Tag, a.Value))
 	}
+	return args
+}
 
-	args = append(args, filePath)
+// CopyTags copies tags, exiftool tag names such as "EXIF:Artist" or
+// "XMP:all", from srcFile to dstFile, which is rewritten in place.
+func CopyTags(srcFile, dstFile string, tags ...string) error {
+	return CopyTagsContext(context.Background(), srcFile, dstFile, tags...)
+}
 
-	out, err := util.Exec(config.ExifTool, args)
-	if err != nil {
-		return "", fmt.Errorf("exiftool.Run failed - %v", err)
+// CopyTagsContext is like CopyTags but stops exiftool when ctx is done.
+func CopyTagsContext(ctx context.Context, srcFile, dstFile string, tags ...string) error {
+	args := []string{"-overwrite_original", "-TagsFromFile", srcFile}
+	for _, tag := range tags {
+		args = append(args, "-"+tag)
 	}
-	return out, nil
+	args = append(args, dstFile)
+
+	if _, err := util.ExecContext(ctx, config.ExifTool, args); err != nil {
+		return fmt.Errorf("exiftool.CopyTags failed - %w", err)
+	}
+	return nil
 }
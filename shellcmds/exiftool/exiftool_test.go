@@ -92,3 +92,70 @@ func TestAddTags(t *testing.T) {
 	}
 	assert.Equal(t, source, tagValue, "Add source (tag 2)")
 }
+
+func TestAssignments(t *testing.T) {
+	credit := "Institute of Pagragon of Aethetics"
+	a := TagsInput{ImageCredit: credit, Source: "Museum of Compassion"}.Assignments()
+	assert.Equal(t, []Assignment{
+		{Tag: "XMP-photoshop:Credit", Value: credit},
+		{Tag: "credit", Value: credit, MaxLen: 32, ReadAs: "IPTC:Credit"},
+		{Tag: "XMP-photoshop:Source", Value: "Museum of Compassion"},
+		{Tag: "iptc:source", Value: "Museum of Compassion", MaxLen: 32},
+	}, a, "empty fields are not written")
+
+	assert.True(t, a[1].Truncated(credit[:32]), "IPTC Credit cut to 32 bytes")
+	assert.False(t, a[1].Truncated(credit[:31]), "shorter than the limit")
+	assert.False(t, a[0].Truncated(credit[:32]), "XMP Credit is not limited")
+}
+
+func TestParseTags(t *testing.T) {
+	out := `[{
+  "SourceFile": "a.tif",
+  "IFD0:Orientation": 1,
+  "IFD0:XResolution": 300.5,
+  "XMP-dc:Subject": ["maps", "Boston, MA", 1850],
+  "XMP-dc:Description": "Line one\nLine two: with a colon",
+  "XMP-xmpRights:Marked": false,
+  "XMP-photoshop:Credit": "Institute of Paragon of Aesthetics",
+  "IPTC:Credit": "Institute of Paragon of Aestheti",
+  "ICC_Profile:ProfileDescription": "sRGB",
+  "IFD0:ICC_Profile": "(Binary data 3144 bytes, use -b option to extract)"
+}]`
+	tags, err := parseTags([]byte(out))
+	if !assert.Nil(t, err, "parseTags") {
+		return
+	}
+	assert.Equal(t, 9, len(tags), "SourceFile left out")
+
+	v, ok := tags.Lookup("Orientation")
+	assert.True(t, ok && v.IsNumber && v.Number == 1 && v.Text == "1", "number %+v", v)
+	v, _ = tags.Lookup("EXIF:XResolution")
+	assert.Equal(t, 300.5, v.Number, "family 0 group")
+	v, _ = tags.Lookup("XMP:Subject")
+	assert.Equal(t, []string{"maps", "Boston, MA", "1850"}, v.List, "list")
+	v, _ = tags.Lookup("xmp-dc:description")
+	assert.Equal(t, "Line one\nLine two: with a colon", v.Text, "multi-line value with a colon")
+	v, _ = tags.Lookup("XMP-xmpRights:Marked")
+	assert.Equal(t, "False", v.Text, "boolean")
+	v, _ = tags.Lookup("Credit")
+	assert.Equal(t, "Institute of Paragon of Aesthetics", v.Text, "first tag of the name")
+	v, _ = tags.Lookup("IPTC:Credit")
+	assert.Equal(t, "Institute of Paragon of Aestheti", v.Text, "tag of the group")
+	v, _ = tags.Lookup("ICC_Profile")
+	assert.True(t, v.Binary, "binary")
+	assert.Equal(t, 3144, v.Size, "binary size")
+	_, ok = tags.Lookup("IPTC:Source")
+	assert.False(t, ok, "missing tag")
+	_, ok = tags.Lookup("XMP-dc:all")
+	assert.False(t, ok, "wildcard")
+	_, ok = tags.Lookup("*Credit")
+	assert.False(t, ok, "wildcard")
+
+	_, err = parseTags([]byte("[]"))
+	assert.NotNil(t, err, "no file")
+}
+
+func TestGetTagWildcard(t *testing.T) {
+	_, err := GetTag("a.tif", "XMP-dc:all")
+	assert.NotNil(t, err, "wildcard")
+}
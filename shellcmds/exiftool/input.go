@@ -1,5 +1,7 @@
 package exiftool
 
+import "strings"
+
 // TagsInput defines the parameters for exiftool.AddTags()
 type TagsInput struct {
 	CopyrightNotice    string
@@ -7,6 +9,56 @@ type TagsInput struct {
 	WebRightsStatement string
 	UsageTerms         string
 	Caption            string
-	CopyrightStatus    string
+	CopyrightStatus    string // "True" or "False"
 	Source             string
 }
+
+// Assignment is a value AddTags writes to one tag.
+type Assignment struct {
+	Tag    string // exiftool tag name
+	Value  string
+	MaxLen int    // bytes the tag can hold, 0 if not limited
+	ReadAs string // tag name to read the value back with if Tag is ambiguous
+}
+
+// Assignments returns the values options sets, in the order AddTags
+// writes them.
+func (options TagsInput) Assignments() []Assignment {
+	var a []Assignment
+	add := func(tag, value string, maxLen int) {
+		if value != "" {
+			a = append(a, Assignment{Tag: tag, Value: value, MaxLen: maxLen})
+		}
+	}
+	readAs := func(tag string) {
+		a[len(a)-1].ReadAs = tag
+	}
+	add("MWG:copyright", options.CopyrightNotice, 0)
+	add("XMP-photoshop:Credit", options.ImageCredit, 0)
+	add("credit", options.ImageCredit, 32)
+	if options.ImageCredit != "" {
+		readAs("IPTC:Credit") // exiftool writes Credit to IPTC, but XMP has one too
+	}
+	add("xmp:webstatement", options.WebRightsStatement, 0)
+	add("photoshop:URL", options.WebRightsStatement, 0)
+	add("usageterms", options.UsageTerms, 0)
+	add("MWG:description", options.Caption, 0)
+	add("XMP-xmpRights:marked", options.CopyrightStatus, 0)
+	add("XMP-photoshop:Source", options.Source, 0)
+	add("iptc:source", options.Source, 32)
+	return a
+}
+
+// ReadTag returns the tag name to read the value back with.
+func (a Assignment) ReadTag() string {
+	if a.ReadAs != "" {
+		return a.ReadAs
+	}
+	return a.Tag
+}
+
+// Truncated tells whether got is what is left of the value once cut to
+// the length limit of the tag.
+func (a Assignment) Truncated(got string) bool {
+	return a.MaxLen > 0 && len(a.Value) > a.MaxLen && got == strings.TrimSpace(a.Value[:a.MaxLen])
+}
@@ -0,0 +1,197 @@
+package exiftool
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Tags are the tags read by ReadTags, keyed by "Group:Name" where Group is
+// the family 1 group of exiftool -G1, e.g. "IFD0:Artist", "XMP-dc:Rights"
+// or "IPTC:Credit".
+type Tags map[string]Value
+
+// Value is the value of a tag read from the JSON output of exiftool.
+type Value struct {
+	Text     string   // the value as text; list items are joined with ", "
+	Number   float64  // the value if IsNumber
+	IsNumber bool     // whether the value is a number
+	List     []string // the items if the value is a list, nil otherwise
+	Binary   bool     // whether the value is binary data, which is not read
+	Size     int      // bytes of binary data
+	pos      int      // position in the output of exiftool
+}
+
+// binaryMarker is what exiftool gives instead of binary data unless -b
+// is used.
+var binaryMarker = regexp.MustCompile(`^\(Binary data (\d+) bytes, use -b option to extract\)$`)
+
+// familyGroups lists the family 1 groups of family 0 groups that are not
+// their prefix, so that e.g. "EXIF:Artist" finds "IFD0:Artist".
+var familyGroups = map[string][]string{
+	"exif": {"ifd0", "ifd1", "exififd", "gps", "interopifd", "subifd", "globparamifd"},
+}
+
+// Lookup returns the value of tag, an exiftool tag name with an optional
+// group as passed to ReadTags, e.g. "Credit", "IPTC:Credit" or
+// "XMP:Credit". Names and groups are matched ignoring case. Of several
+// matching tags the first one exiftool listed is returned. Wildcard names
+// such as "XMP-dc:all" or "*Date" never match, as they stand for several
+// tags; range over t for those.
+func (t Tags) Lookup(tag string) (Value, bool) {
+	if isWildcard(tag) {
+		return Value{}, false
+	}
+	group, name := "", tag
+	if i := strings.LastIndex(tag, ":"); i >= 0 {
+		group, name = strings.ToLower(tag[:i]), tag[i+1:]
+	}
+	var found Value
+	ok := false
+	for key, v := range t {
+		kgroup, kname := "", key
+		if i := strings.LastIndex(key, ":"); i >= 0 {
+			kgroup, kname = strings.ToLower(key[:i]), key[i+1:]
+		}
+		if !strings.EqualFold(kname, name) || !inGroup(kgroup, group) {
+			continue
+		}
+		if !ok || v.pos < found.pos {
+			found, ok = v, true
+		}
+	}
+	return found, ok
+}
+
+// isWildcard tells whether tag stands for several tags, such as
+// "XMP-dc:all" or "*Date".
+func isWildcard(tag string) bool {
+	name := tag[strings.LastIndex(tag, ":")+1:]
+	return strings.EqualFold(name, "all") || strings.ContainsAny(name, "*?")
+}
+
+// inGroup tells whether the family 1 group kgroup is group, a group of
+// family 0 such as "xmp" or "exif", or any group if group is empty.
+func inGroup(kgroup, group string) bool {
+	if group == "" || kgroup == group || strings.HasPrefix(kgroup, group+"-") {
+		return true
+	}
+	for _, g := range familyGroups[group] {
+		if kgroup == g {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTags parses the output of exiftool -j -G1 -n for one file.
+func parseTags(out []byte) (Tags, error) {
+	d := json.NewDecoder(bytes.NewReader(out))
+	d.UseNumber()
+	var files []map[string]json.RawMessage
+	if err := d.Decode(&files); err != nil {
+		return nil, err
+	}
+	if len(files) != 1 {
+		return nil, fmt.Errorf("expected tags of one file, got %d", len(files))
+	}
+	order, err := keyOrder(out)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := Tags{}
+	for key, raw := range files[0] {
+		if key == "SourceFile" {
+			continue
+		}
+		v, err := parseValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s - %v", key, err)
+		}
+		v.pos = order[key]
+		tags[key] = v
+	}
+	return tags, nil
+}
+
+// keyOrder returns the positions of the keys of the first object of the
+// JSON array out.
+func keyOrder(out []byte) (map[string]int, error) {
+	d := json.NewDecoder(bytes.NewReader(out))
+	for i := 0; i < 2; i++ { // [ {
+		if _, err := d.Token(); err != nil {
+			return nil, err
+		}
+	}
+	order := map[string]int{}
+	for i := 0; d.More(); i++ {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		order[fmt.Sprint(t)] = i
+		var skip json.RawMessage
+		if err = d.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+func parseValue(raw json.RawMessage) (Value, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var x interface{}
+	if err := d.Decode(&x); err != nil {
+		return Value{}, err
+	}
+
+	var v Value
+	switch x := x.(type) {
+	case []interface{}:
+		v.List = make([]string, len(x))
+		for i, item := range x {
+			v.List[i] = text(item)
+		}
+		v.Text = strings.Join(v.List, ", ")
+	case json.Number:
+		n, err := x.Float64()
+		if err != nil {
+			return Value{}, err
+		}
+		v.Text, v.Number, v.IsNumber = x.String(), n, true
+	case string:
+		v.Text = x
+		if m := binaryMarker.FindStringSubmatch(x); m != nil {
+			v.Binary = true
+			v.Size, _ = strconv.Atoi(m[1])
+		}
+	default:
+		v.Text = text(x)
+	}
+	return v, nil
+}
+
+// text returns the value x decoded from JSON as exiftool would print it.
+func text(x interface{}) string {
+	switch x := x.(type) {
+	case string:
+		return x
+	case json.Number:
+		return x.String()
+	case bool:
+		if x {
+			return "True"
+		}
+		return "False"
+	case nil:
+		return ""
+	default:
+		b, _ := json.Marshal(x)
+		return string(b)
+	}
+}
@@ -1,6 +1,7 @@
 package imagemagick
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strings"
@@ -16,6 +17,11 @@ func tempDirArg(tempDir string) string {
 
 // ImageFormat returns the "magick" value, e.g. "TIFF", "JPEG"
 func ImageFormat(fpath string, tempDir *string) (string, error) {
+	return ImageFormatContext(context.Background(), fpath, tempDir)
+}
+
+// ImageFormatContext is like ImageFormat but stops identify when ctx is done.
+func ImageFormatContext(ctx context.Context, fpath string, tempDir *string) (string, error) {
 	var out string
 
 	args := make([]string, 0, 5)
@@ -25,7 +31,7 @@ func ImageFormat(fpath string, tempDir *string) (string, error) {
 	}
 	args = append(args, fmt.Sprintf("%s[0]", fpath))
 
-	out, err := util.Exec(config.Identify, args)
+	out, err := util.ExecContext(ctx, config.Identify, args)
 	if err != nil {
 		return "", err
 	}
@@ -34,6 +40,11 @@ func ImageFormat(fpath string, tempDir *string) (string, error) {
 
 // Channels returns the channels string acquired from the image file by ImageMagick/identify.
 func Channels(fpath string, tempDir *string) (channels string, err error) {
+	return ChannelsContext(context.Background(), fpath, tempDir)
+}
+
+// ChannelsContext is like Channels but stops identify when ctx is done.
+func ChannelsContext(ctx context.Context, fpath string, tempDir *string) (channels string, err error) {
 	var out string
 
 	args := make([]string, 0, 5)
@@ -43,7 +54,7 @@ func Channels(fpath string, tempDir *string) (channels string, err error) {
 	}
 	args = append(args, fmt.Sprintf("%s[0]", fpath))
 
-	if out, err = util.Exec(config.Identify, args); err != nil {
+	if out, err = util.ExecContext(ctx, config.Identify, args); err != nil {
 		return "", err
 	}
 	return out, err
@@ -52,6 +63,11 @@ func Channels(fpath string, tempDir *string) (channels string, err error) {
 // ICCProfile returns the ICC profile identifier string acquired from
 // the image by ImageMagic/identify.
 func ICCProfile(fpath string, tempDir *string) (iccProfile string, err error) {
+	return ICCProfileContext(context.Background(), fpath, tempDir)
+}
+
+// ICCProfileContext is like ICCProfile but stops identify when ctx is done.
+func ICCProfileContext(ctx context.Context, fpath string, tempDir *string) (iccProfile string, err error) {
 	var out string
 
 	args := make([]string, 0, 5)
@@ -61,7 +77,7 @@ func ICCProfile(fpath string, tempDir *string) (iccProfile string, err error) {
 	}
 	args = append(args, fmt.Sprintf("%s[0]", fpath))
 
-	if out, err = util.Exec(config.Identify, args); err != nil {
+	if out, err = util.ExecContext(ctx, config.Identify, args); err != nil {
 		return "", err
 	}
 	return out, err
@@ -70,6 +86,11 @@ func ICCProfile(fpath string, tempDir *string) (iccProfile string, err error) {
 // GetInfo returns multiple information from identify.
 // Running identify for those separately is very costly for large images.
 func GetInfo(fpath string, tempDir *string) (string, string, string, string, error) {
+	return GetInfoContext(context.Background(), fpath, tempDir)
+}
+
+// GetInfoContext is like GetInfo but stops identify when ctx is done.
+func GetInfoContext(ctx context.Context, fpath string, tempDir *string) (string, string, string, string, error) {
 	args := make([]string, 0, 5)
 	args = append(args, "-format", "%[m]|%[channels]|%[bit-depth]|%[profile:icc]")
 	if tempDir != nil {
@@ -77,22 +98,28 @@ func GetInfo(fpath string, tempDir *string) (string, string, string, string, err
 	}
 	args = append(args, fmt.Sprintf("%s[0]", fpath))
 
-	out, err := util.Exec(config.Identify, args)
+	out, err := util.ExecContext(ctx, config.Identify, args)
 	if err != nil {
-		return "", "", "", "", fmt.Errorf("imagemagick.GetInfo failed - %v", err)
+		return "", "", "", "", fmt.Errorf("imagemagick.GetInfo failed - %w", err)
 	}
 	values := strings.Split(out, "|")
 	return values[0], values[1], values[2], values[3], err
 }
 
 func GrayToSRGB(inFile, outFile string, tempDir *string) error {
+	return GrayToSRGBContext(context.Background(), inFile, outFile, tempDir)
+}
+
+// GrayToSRGBContext is like GrayToSRGB but stops the programs it runs
+// when ctx is done.
+func GrayToSRGBContext(ctx context.Context, inFile, outFile string, tempDir *string) error {
 	var w, h uint
 	var err error
 
-	if w, err = vips.Width(inFile); err != nil {
+	if w, err = vips.WidthContext(ctx, inFile); err != nil {
 		return err
 	}
-	if h, err = vips.Height(inFile); err != nil {
+	if h, err = vips.HeightContext(ctx, inFile); err != nil {
 		return err
 	}
 	log.Printf("width: %d, height: %d", w, h)
@@ -108,6 +135,23 @@ func GrayToSRGB(inFile, outFile string, tempDir *string) error {
 		args = append(args, "-define", tempDirArg(*tempDir))
 	}
 
-	_, err = util.Exec(config.VIPSThumbnail, args)
+	_, err = util.ExecContext(ctx, config.VIPSThumbnail, args)
+	return err
+}
+
+// ReduceDepth scales the samples of inFile to 8 bits. With dither, ordered
+// dithering hides the banding that smooth gradients may show otherwise.
+func ReduceDepth(inFile, outFile string, dither bool) error {
+	return ReduceDepthContext(context.Background(), inFile, outFile, dither)
+}
+
+// ReduceDepthContext is like ReduceDepth but stops convert when ctx is done.
+func ReduceDepthContext(ctx context.Context, inFile, outFile string, dither bool) error {
+	args := []string{fmt.Sprintf("%s[0]", inFile)}
+	if dither {
+		args = append(args, "-ordered-dither", "o8x8,256")
+	}
+	args = append(args, "-depth", "8", outFile)
+	_, err := util.ExecContext(ctx, config.Convert, args)
 	return err
 }
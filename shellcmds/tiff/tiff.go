@@ -1,6 +1,7 @@
 package tiff
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/gigamorph/go-pyramid/config"
@@ -9,25 +10,43 @@ import (
 
 // BuildPyramid contcatenates tiles into one pyramid TIFF
 func BuildPyramid(inFiles []string, outFile string, options map[string]string) (err error) {
+	return BuildPyramidContext(context.Background(), inFiles, outFile, options)
+}
+
+// BuildPyramidContext is like BuildPyramid but stops tiffcp when ctx is done.
+func BuildPyramidContext(ctx context.Context, inFiles []string, outFile string, options map[string]string) (err error) {
 	args := make([]string, 0, 32)
 
 	// c: compression. e.g.) "jpeg:90"
 	if c := options["c"]; c != "" {
 		args = append(args, "-c", c)
 	}
+	// 8: write BigTIFF if "true"
+	if options["8"] == "true" {
+		args = append(args, "-8")
+	}
+
+	// w, l: tile width and length (default 256)
+	w, l := options["w"], options["l"]
+	if w == "" {
+		w = "256"
+	}
+	if l == "" {
+		l = "256"
+	}
 
 	args = append(args,
-		"-t",        // output to tiles
-		"-w", "256", // tile width
-		"-l", "256", // tile length
+		"-t",    // output to tiles
+		"-w", w, // tile width
+		"-l", l, // tile length
 		"-m", "12288", // maximum memory allocation size in MiB
 	)
 	args = append(args, inFiles...)
 	args = append(args, outFile)
 
-	_, err = util.Exec(config.TIFFCopy, args)
+	_, err = util.ExecContext(ctx, config.TIFFCopy, args)
 	if err != nil {
-		return fmt.Errorf("tiff.BuildPyramid util.Exec failed - %v", err)
+		return fmt.Errorf("tiff.BuildPyramid util.Exec failed - %w", err)
 	}
 	return nil
 }
@@ -1,8 +1,9 @@
 package vips
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"os"
 	"strconv"
 
 	"github.com/gigamorph/go-pyramid/config"
@@ -11,6 +12,11 @@ import (
 
 // Width returns the pixel width of the imaage
 func Width(fpath string) (w uint, err error) {
+	return WidthContext(context.Background(), fpath)
+}
+
+// WidthContext is like Width but stops vipsheader when ctx is done.
+func WidthContext(ctx context.Context, fpath string) (w uint, err error) {
 	var out string
 	var width int64
 
@@ -20,7 +26,7 @@ func Width(fpath string) (w uint, err error) {
 		fmt.Sprintf("%s[0]", fpath),
 	}
 
-	if out, err = util.Exec(config.VIPSHeader, args); err != nil {
+	if out, err = util.ExecContext(ctx, config.VIPSHeader, args); err != nil {
 		return 0, err
 	}
 
@@ -33,6 +39,11 @@ func Width(fpath string) (w uint, err error) {
 
 // Height returns the pixel width of the imaage.
 func Height(fpath string) (h uint, err error) {
+	return HeightContext(context.Background(), fpath)
+}
+
+// HeightContext is like Height but stops vipsheader when ctx is done.
+func HeightContext(ctx context.Context, fpath string) (h uint, err error) {
 	var out string
 	var height int64
 
@@ -41,7 +52,7 @@ func Height(fpath string) (h uint, err error) {
 		fmt.Sprintf("%s[0]", fpath),
 	}
 
-	if out, err = util.Exec(config.VIPSHeader, args); err != nil {
+	if out, err = util.ExecContext(ctx, config.VIPSHeader, args); err != nil {
 		return 0, err
 	}
 
@@ -54,6 +65,11 @@ func Height(fpath string) (h uint, err error) {
 
 // RemoveAlpha strippes the alpha channel from inFile.
 func RemoveAlpha(inFile, outFile string) error {
+	return RemoveAlphaContext(context.Background(), inFile, outFile)
+}
+
+// RemoveAlphaContext is like RemoveAlpha but stops vips when ctx is done.
+func RemoveAlphaContext(ctx context.Context, inFile, outFile string) error {
 	args := []string{
 		"im_extract_bands",
 		inFile,
@@ -61,12 +77,18 @@ func RemoveAlpha(inFile, outFile string) error {
 		"0",
 		"3",
 	}
-	_, err := util.Exec(config.VIPS, args)
+	_, err := util.ExecContext(ctx, config.VIPS, args)
 	return err
 }
 
 // RemoveAlphaFromGraya strippes the alpha channel from a greyscale with alpha
 func RemoveAlphaFromGraya(inFile, outFile string) error {
+	return RemoveAlphaFromGrayaContext(context.Background(), inFile, outFile)
+}
+
+// RemoveAlphaFromGrayaContext is like RemoveAlphaFromGraya but stops vips
+// when ctx is done.
+func RemoveAlphaFromGrayaContext(ctx context.Context, inFile, outFile string) error {
 	args := []string{
 		"im_extract_bands",
 		inFile,
@@ -74,7 +96,7 @@ func RemoveAlphaFromGraya(inFile, outFile string) error {
 		"0",
 		"1",
 	}
-	_, err := util.Exec(config.VIPS, args)
+	_, err := util.ExecContext(ctx, config.VIPS, args)
 	return err
 }
 
@@ -87,30 +109,51 @@ func RemoveAlphaFromGraya(inFile, outFile string) error {
 // call vipsthumbnail instead which does some magick behind the scenes
 // to properly convert between the profiles - per Dave Beaudet @NGA
 func FixGray(inFile, outFile string) error {
+	return FixGrayContext(context.Background(), inFile, outFile)
+}
+
+// FixGrayContext is like FixGray but stops the programs it runs when
+// ctx is done.
+func FixGrayContext(ctx context.Context, inFile, outFile string) error {
 	var w, h uint
 	var err error
 
-	if w, err = Width(inFile); err != nil {
+	if w, err = WidthContext(ctx, inFile); err != nil {
 		return err
 	}
-	if h, err = Height(inFile); err != nil {
+	if h, err = HeightContext(ctx, inFile); err != nil {
 		return err
 	}
-	log.Printf("width: %d, height: %d", w, h)
+	return FixGraySizeContext(ctx, inFile, outFile, w, h)
+}
 
+// FixGraySizeContext is like FixGrayContext for callers that already know
+// the size of inFile, which saves running vipsheader twice.
+func FixGraySizeContext(ctx context.Context, inFile, outFile string, width, height uint) error {
 	args := []string{
 		inFile,
 		fmt.Sprintf("--eprofile=%s", config.TargetICCProfileIIIF),
-		"--size", fmt.Sprintf("%dx%d", w, h),
+		"--size", fmt.Sprintf("%dx%d", width, height),
 		"--intent", "relative",
 		"-o", fmt.Sprintf("%s[compression=none,strip]", outFile),
 	}
-	_, err = util.Exec(config.VIPSThumbnail, args)
+	_, err := util.ExecContext(ctx, config.VIPSThumbnail, args)
 	return err
 }
 
 // ICCTransform changes the color profile.
 func ICCTransform(inFile, outFile, iccProfile string) error {
+	return ICCTransformContext(context.Background(), inFile, outFile, iccProfile)
+}
+
+// ICCTransformContext is like ICCTransform but stops vips when ctx is done.
+func ICCTransformContext(ctx context.Context, inFile, outFile, iccProfile string) error {
+	return ICCTransformDepthContext(ctx, inFile, outFile, iccProfile, 8)
+}
+
+// ICCTransformDepthContext is like ICCTransformContext but writes depth
+// (8 or 16) bits per sample.
+func ICCTransformDepthContext(ctx context.Context, inFile, outFile, iccProfile string, depth uint) error {
 	args := []string{
 		"icc_transform",
 		inFile,
@@ -120,42 +163,152 @@ func ICCTransform(inFile, outFile, iccProfile string) error {
 		"--embedded",
 		"--input-profile", config.TargetICCProfileIIIF,
 		"--intent", "relative",
+		"--depth", strconv.FormatUint(uint64(depth), 10),
+	}
+	_, err := util.ExecContext(ctx, config.VIPS, args)
+	return err
+}
+
+// CMYKToRGB converts a CMYK image, with or without alpha, to the RGB
+// profile iccProfile with depth (8 or 16) bits per sample. The profile
+// embedded in inFile is the source profile unless cmykProfile is not empty.
+func CMYKToRGB(inFile, outFile, cmykProfile, iccProfile string, depth uint) error {
+	return CMYKToRGBContext(context.Background(), inFile, outFile, cmykProfile, iccProfile, depth)
+}
+
+// CMYKToRGBContext is like CMYKToRGB but stops vips when ctx is done.
+func CMYKToRGBContext(ctx context.Context, inFile, outFile, cmykProfile, iccProfile string, depth uint) error {
+	args := []string{
+		"icc_transform",
+		inFile,
+		fmt.Sprintf("%s[compression=none]", outFile),
+		iccProfile,
+		"--intent", "relative",
+		"--depth", strconv.FormatUint(uint64(depth), 10),
 	}
-	_, err := util.Exec(config.VIPS, args)
+	if cmykProfile != "" {
+		args = append(args, "--input-profile", cmykProfile)
+	} else {
+		args = append(args, "--embedded")
+	}
+	_, err := util.ExecContext(ctx, config.VIPS, args)
 	return err
 }
 
 // Resize the image.
 func Resize(inFile, outFile string, width, height uint) error {
+	return ResizeContext(context.Background(), inFile, outFile, width, height)
+}
+
+// ResizeContext is like Resize but stops vipsthumbnail when ctx is done.
+func ResizeContext(ctx context.Context, inFile, outFile string, width, height uint) error {
 	args := []string{
 		inFile,
 		"--size", fmt.Sprintf("%dx%d!", width, height),
 		"-o", outFile,
 	}
-	_, err := util.Exec(config.VIPSThumbnail, args)
+	_, err := util.ExecContext(ctx, config.VIPSThumbnail, args)
 	return err
 }
 
+// ResampleOptions controls how Resample scales an image.
+type ResampleOptions struct {
+	Kernel      string  // "nearest", "linear", "cubic", "lanczos3", ...; "" for the vips default
+	LinearLight bool    // resample in linear light (scRGB) rather than in the encoded values
+	Sharpen     float64 // sigma of vips sharpen applied after resizing, 0 for none
+	Bands       uint    // bands of inFile, 1 or 3, to convert back from linear light
+	Depth       uint    // bits per sample of inFile, to convert back from linear light
+}
+
+// Resample scales inFile of inWidth x inHeight to exactly width x height
+// with vips resize, which unlike vipsthumbnail lets the kernel be chosen.
+// Intermediate images are written next to outFile and removed afterwards.
+func Resample(inFile, outFile string, inWidth, inHeight, width, height uint, opts ResampleOptions) error {
+	return ResampleContext(context.Background(), inFile, outFile, inWidth, inHeight, width, height, opts)
+}
+
+// ResampleContext is like Resample but stops vips when ctx is done.
+func ResampleContext(ctx context.Context, inFile, outFile string, inWidth, inHeight, width, height uint, opts ResampleOptions) error {
+	if inWidth == 0 || inHeight == 0 {
+		return fmt.Errorf("vips.Resample invalid input size %dx%d", inWidth, inHeight)
+	}
+	hscale := float64(width) / float64(inWidth)
+	vscale := float64(height) / float64(inHeight)
+	resize := []string{"resize", "", "", strconv.FormatFloat(hscale, 'f', -1, 64),
+		"--vscale", strconv.FormatFloat(vscale, 'f', -1, 64)}
+	if opts.Kernel != "" {
+		resize = append(resize, "--kernel", opts.Kernel)
+	}
+
+	// Each step reads the output of the one before.
+	var steps [][]string
+	if opts.LinearLight {
+		steps = append(steps, []string{"colourspace", "", "", "scrgb"})
+	}
+	steps = append(steps, resize)
+	if opts.LinearLight {
+		space := "srgb"
+		switch {
+		case opts.Bands == 1 && opts.Depth > 8:
+			space = "grey16"
+		case opts.Bands == 1:
+			space = "b-w"
+		case opts.Depth > 8:
+			space = "rgb16"
+		}
+		steps = append(steps, []string{"colourspace", "", "", space})
+	}
+	if opts.Sharpen > 0 {
+		steps = append(steps, []string{"sharpen", "", "", "--sigma", strconv.FormatFloat(opts.Sharpen, 'f', -1, 64)})
+	}
+
+	src := inFile
+	for i, args := range steps {
+		dst := outFile
+		if i < len(steps)-1 {
+			dst = fmt.Sprintf("%s.%d.v", outFile, i)
+			defer os.Remove(dst)
+		}
+		args[1], args[2] = src, dst
+		if _, err := util.ExecContext(ctx, config.VIPS, args); err != nil {
+			return fmt.Errorf("vips.Resample %s failed - %w", args[0], err)
+		}
+		src = dst
+	}
+	return nil
+}
+
 // ResizeBoundedNoExpand resizes the image to fit the bounding box of width x height
 // with aspect ratio preserved, but does not resize it if the source image
 // is smaller
 func ResizeBoundedNoExpand(inFile, outFile string, width, height uint) error {
+	return ResizeBoundedNoExpandContext(context.Background(), inFile, outFile, width, height)
+}
+
+// ResizeBoundedNoExpandContext is like ResizeBoundedNoExpand but stops
+// vipsthumbnail when ctx is done.
+func ResizeBoundedNoExpandContext(ctx context.Context, inFile, outFile string, width, height uint) error {
 	args := []string{
 		inFile,
 		"--size", fmt.Sprintf("%dx%d>", width, height),
 		"-o", outFile,
 	}
-	_, err := util.Exec(config.VIPSThumbnail, args)
+	_, err := util.ExecContext(ctx, config.VIPSThumbnail, args)
 	return err
 }
 
 // ToTiff converts inFile to TIFF format.
 func ToTiff(inFile, outFile string) error {
+	return ToTiffContext(context.Background(), inFile, outFile)
+}
+
+// ToTiffContext is like ToTiff but stops vips when ctx is done.
+func ToTiffContext(ctx context.Context, inFile, outFile string) error {
 	args := []string{
 		"tiffsave",
 		inFile,
 		outFile,
 	}
-	_, err := util.Exec(config.VIPS, args)
+	_, err := util.ExecContext(ctx, config.VIPS, args)
 	return err
 }
@@ -1,15 +1,20 @@
 package util
 
 import (
+	"errors"
 	"os/exec"
 )
 
 // GetStderr tries to extract what was printed to stderr from exec,
-// assuming e is an exec.ExitError.
+// assuming e is or wraps an *ExecError or an *exec.ExitError.
 func GetStderr(e error) string {
-	e2, ok := e.(*exec.ExitError)
-	if (!ok) {
-		return ""
+	var execErr *ExecError
+	if errors.As(e, &execErr) {
+		return execErr.Stderr
 	}
-	return string(e2.Stderr)
+	var exitErr *exec.ExitError
+	if errors.As(e, &exitErr) {
+		return string(exitErr.Stderr)
+	}
+	return ""
 }
@@ -1,19 +1,106 @@
 package util
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"strings"
 )
 
+// ErrToolNotFound is wrapped by the errors of Exec when the program
+// does not exist or is not in PATH.
+var ErrToolNotFound = errors.New("program not found")
+
+// ExecError is the error returned by Exec when the program cannot be
+// started, fails or is stopped.
+type ExecError struct {
+	Command  string
+	Args     []string
+	ExitCode int    // exit status, -1 if the program did not exit on its own
+	Stderr   string // what the program printed to stderr
+	Err      error  // the underlying error
+}
+
+func (e *ExecError) Error() string {
+	msg := fmt.Sprintf("util.Exec %s failed - %v", e.Command, e.Err)
+	if e.Stderr != "" {
+		msg += " - " + e.Stderr
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error, e.g. ctx.Err() when the program
+// was stopped by ExecContext.
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
 // Exec is a utility wrapper around exec.Command.
 func Exec(command string, args []string) (string, error) {
+	return ExecContext(context.Background(), command, args)
+}
+
+// ExecContext is like Exec but stops the command when ctx is done.
+// The command runs in a process group of its own, and the whole group is
+// killed so that no helper process started by the command is left behind.
+// The error returned in that case wraps ctx.Err().
+//
+// Errors are of type *ExecError.
+func ExecContext(ctx context.Context, command string, args []string) (string, error) {
 	log.Printf("util.Exec %s %s", command, strings.Join(args, " "))
-	out, err := exec.Command(command, args...).Output()
+	execErr := &ExecError{Command: command, Args: args, ExitCode: -1}
+	if err := ctx.Err(); err != nil {
+		execErr.Err = err
+		return "", execErr
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		execErr.Err = err
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			execErr.Err = fmt.Errorf("%w - %v", ErrToolNotFound, err)
+		}
+		return "", execErr
+	}
+	// The process group is killed from this goroutine and only while Wait
+	// has not returned, so that no signal is sent once the process is
+	// reaped and its pid may be reused.
+	waited := make(chan error, 1)
+	go func() {
+		waited <- cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-waited:
+	case <-ctx.Done():
+		select {
+		case err = <-waited:
+		default:
+			killProcessGroup(cmd)
+			err = <-waited
+		}
+	}
+
 	if err != nil {
-		return string(out), fmt.Errorf("util.Exec exec.Command %s failed - %v - %s", command, err, GetStderr(err))
+		execErr.Stderr = strings.TrimSpace(stderr.String())
+		execErr.Err = err
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			execErr.Err = ctxErr
+		} else if e, ok := err.(*exec.ExitError); ok {
+			e.Stderr = stderr.Bytes() // as exec.Cmd.Output does
+			execErr.ExitCode = e.ExitCode()
+		}
+		return stdout.String(), execErr
 	}
-	sout := strings.TrimSpace(string(out))
+	sout := strings.TrimSpace(stdout.String())
 	return sout, nil
 }
@@ -0,0 +1,66 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecContext(t *testing.T) {
+	out, err := ExecContext(context.Background(), "sh", []string{"-c", "echo hello"})
+	assert.Nil(t, err, "successful command")
+	assert.Equal(t, "hello", out, "output")
+
+	_, err = Exec("sh", []string{"-c", "echo oops >&2; exit 3"})
+	assert.NotNil(t, err, "failing command")
+	assert.Contains(t, err.Error(), "oops", "stderr in error")
+
+	// The child keeps stdout open, so Wait would block until it exits
+	// unless the whole process group is killed.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = ExecContext(ctx, "sh", []string{"-c", "sleep 10 & sleep 10; wait"})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "deadline error, got %v", err)
+	assert.True(t, time.Since(start) < 5*time.Second, "process tree killed")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = ExecContext(ctx, "sh", []string{"-c", "echo never"})
+	assert.True(t, errors.Is(err, context.Canceled), "canceled error, got %v", err)
+
+	// Nothing is left running to kill the process group once ExecContext
+	// has returned, even if ctx is done right after.
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		_, err = ExecContext(ctx, "sh", []string{"-c", "exit 0"})
+		cancel()
+		assert.Nil(t, err, "command finished before cancel")
+	}
+	assert.Equal(t, before, runtime.NumGoroutine(), "goroutines left")
+}
+
+func TestExecError(t *testing.T) {
+	_, err := Exec("sh", []string{"-c", "echo oops >&2; exit 3"})
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("not an *ExecError - %v", err)
+	}
+	assert.Equal(t, "sh", execErr.Command, "command")
+	assert.Equal(t, 3, execErr.ExitCode, "exit code")
+	assert.Equal(t, "oops", execErr.Stderr, "stderr")
+	assert.Equal(t, "oops", GetStderr(fmt.Errorf("wrapped - %w", err)), "GetStderr")
+
+	_, err = Exec("/no/such/program", nil)
+	assert.True(t, errors.Is(err, ErrToolNotFound), "missing program with path, got %v", err)
+	_, err = Exec("no-such-program-in-path", nil)
+	assert.True(t, errors.Is(err, ErrToolNotFound), "missing program in PATH, got %v", err)
+	errors.As(err, &execErr)
+	assert.Equal(t, -1, execErr.ExitCode, "no exit code")
+}
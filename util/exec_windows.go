@@ -0,0 +1,14 @@
+package util
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessGroup kills cmd. Processes started by cmd are not tracked
+// on Windows.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
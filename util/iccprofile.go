@@ -1,59 +1,80 @@
 package util
 
 import (
-	"bytes"
 	"encoding/binary"
 	"log"
+	"strings"
+	"unicode/utf16"
 )
 
 // TagSigDesc is the hexadecimal representation of the tag signature for "desc"
 const TagSigDesc uint32 = 0x64657363
 
 // GetICCProfileDesc extracts the ASCII name part ("desc") from the byte array of the ICC profile.
+// Both the ICC v2 (textDescriptionType) and v4 (multiLocalizedUnicodeType)
+// encodings are supported. It returns "" if the profile is malformed or
+// has no description.
+//
+// Deprecated: use icc.Parse and Profile.Description of package
+// pyramid/icc, which report why a profile cannot be read.
 func GetICCProfileDesc(iccProfile []byte) string {
-	var err error
-	var nTags, tagSignature, tagDataOffset, tagDataSize uint32
-	var start int
-
 	if len(iccProfile) < 132 {
-		log.Printf("WARNING util.GetICCProfileDesc invailid string [%s]\n", string(iccProfile))
+		log.Printf("WARNING util.GetICCProfileDesc invalid profile of %d bytes\n", len(iccProfile))
 		return ""
 	}
-
-	err = binary.Read(bytes.NewReader(iccProfile[128:132]), binary.BigEndian, &nTags)
-	if err != nil {
-		log.Printf("Error reading tags count - %v", err)
-		return ""
-	}
-
-	for i := 0; i < int(nTags); i++ {
-		start = 132 + 12*i
-		err = binary.Read(bytes.NewReader(iccProfile[start:start+4]), binary.BigEndian, &tagSignature)
-		if err != nil {
-			log.Printf("Error reading tag signature for %d - %v\n", i, err)
+	be := binary.BigEndian
+	nTags := be.Uint32(iccProfile[128:132])
+	for i := uint64(0); i < uint64(nTags); i++ {
+		start := 132 + 12*i
+		if start+12 > uint64(len(iccProfile)) {
 			break
 		}
-		if tagSignature == TagSigDesc {
-			err = binary.Read(bytes.NewReader(iccProfile[start+4:start+8]), binary.BigEndian, &tagDataOffset)
-			if err != nil {
-				log.Printf("Error reading tag data offset for %d - %v\n", i, err)
-				break
-			}
-			err = binary.Read(bytes.NewReader(iccProfile[start+8:start+12]), binary.BigEndian, &tagDataSize)
-			if err != nil {
-				log.Printf("Error reading tag data size for %d - %v\n", i, err)
-				break
-			}
-			tagData := string(iccProfile[tagDataOffset : tagDataOffset+tagDataSize])
-			if err != nil {
-				log.Printf("Error reading tag data size for %d - %v\n", i, err)
-				break
-
-			}
-			return tagData[4:]
+		if be.Uint32(iccProfile[start:start+4]) != TagSigDesc {
+			continue
+		}
+		offset := uint64(be.Uint32(iccProfile[start+4 : start+8]))
+		size := uint64(be.Uint32(iccProfile[start+8 : start+12]))
+		if offset+size > uint64(len(iccProfile)) {
+			break
+		}
+		if desc, ok := decodeDesc(iccProfile[offset : offset+size]); ok {
+			return desc
 		}
+		break
 	}
 
 	log.Printf("WARNING util.GetICCProfileDesc ICC profile description not found\n")
 	return ""
 }
+
+// decodeDesc decodes a "desc" tag of type textDescriptionType (v2) or
+// the first record of a multiLocalizedUnicodeType (v4).
+func decodeDesc(data []byte) (string, bool) {
+	if len(data) < 12 {
+		return "", false
+	}
+	be := binary.BigEndian
+	switch string(data[:4]) {
+	case "desc":
+		n := uint64(be.Uint32(data[8:12]))
+		if 12+n > uint64(len(data)) {
+			return "", false
+		}
+		return strings.TrimRight(string(data[12:12+n]), "\x00"), true
+	case "mluc":
+		if len(data) < 28 || be.Uint32(data[8:12]) == 0 {
+			return "", false
+		}
+		n := uint64(be.Uint32(data[20:24]))
+		offset := uint64(be.Uint32(data[24:28]))
+		if offset+n > uint64(len(data)) {
+			return "", false
+		}
+		units := make([]uint16, n/2)
+		for i := range units {
+			units[i] = be.Uint16(data[offset+2*uint64(i):])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00"), true
+	}
+	return "", false
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetICCProfileDesc(t *testing.T) {
+	b, err := ioutil.ReadFile("../test/resources/sRGBProfile.icc")
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, "sRGB IEC61966-2.1", GetICCProfileDesc(b), "sRGB")
+
+	b, err = ioutil.ReadFile("../test/resources/AdobeRGB1998.icc")
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, "Adobe RGB (1998)", GetICCProfileDesc(b), "Adobe RGB")
+
+	assert.Equal(t, "", GetICCProfileDesc(b[:200]), "truncated")
+	assert.Equal(t, "", GetICCProfileDesc([]byte("not a profile")), "garbage")
+	assert.Equal(t, "Display", GetICCProfileDesc(v4Profile("Display")), "v4")
+}
+
+// v4Profile returns a profile whose only tag is a v4 description.
+func v4Profile(desc string) []byte {
+	be := binary.BigEndian
+	text := utf16.Encode([]rune(desc))
+	tag := make([]byte, 28+2*len(text))
+	copy(tag, "mluc")
+	be.PutUint32(tag[8:], 1)   // records
+	be.PutUint32(tag[12:], 12) // record size
+	copy(tag[16:], "enUS")
+	be.PutUint32(tag[20:], uint32(2*len(text)))
+	be.PutUint32(tag[24:], 28)
+	for i, u := range text {
+		be.PutUint16(tag[28+2*i:], u)
+	}
+
+	p := make([]byte, 144, 144+len(tag))
+	be.PutUint32(p[128:], 1)
+	be.PutUint32(p[132:], TagSigDesc)
+	be.PutUint32(p[136:], 144)
+	be.PutUint32(p[140:], uint32(len(tag)))
+	return append(p, tag...)
+}